@@ -4,18 +4,28 @@ import (
 	"fmt"
 	"log"
 	"os"
-	"os/signal"
-	"syscall"
 	"time"
 
-	"github.com/google/shlex"
-	"github.com/robfig/cron/v3"
+	"github.com/google/uuid"
 	"github.com/urfave/cli/v2"
 )
 
 func main() {
-	defer recovery()
+	// Log is replaced by InitLogger, so it is looked up only once a panic occurs
+	defer func() {
+		if recoveryMessage := recover(); recoveryMessage != nil {
+			Log.Fatal.Printf("Uncaught error: %v", recoveryMessage)
+		}
+	}()
+
+	err := newApp().Run(os.Args)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
 
+// newApp returns the command line app with all flags and commands
+func newApp() *cli.App {
 	// Free up "-h"
 	cli.HelpFlag = &cli.BoolFlag{
 		Name:  "help",
@@ -28,11 +38,23 @@ func main() {
 		Usage:   "print only the version",
 	}
 
-	app := &cli.App{
+	return &cli.App{
 		Name:    "rotating-rsync-backup",
-		Version: "v3.0.7",
+		Version: appVersion,
 		Usage:   "Create hardlinked backups using rsync and rotate them",
 		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:     "config",
+				Aliases:  []string{"C"},
+				Usage:    "Path to a YAML or TOML config file defining one or more profiles. Keys are the names of the command line options (e.g. max-daily), set either per profile under \"profiles.<name>\" or for all profiles under \"defaults\". Options passed on the command line override the file for all profiles.",
+				Required: false,
+			},
+			&cli.StringSliceFlag{
+				Name:     "profile",
+				Aliases:  []string{"p"},
+				Usage:    "Name of a profile from the config file to run. Specify multiple times for multiple values. Defaults to running all profiles.",
+				Required: false,
+			},
 			&cli.StringFlag{
 				Name:     "profile-name",
 				Aliases:  []string{"pn", "n"},
@@ -50,20 +72,27 @@ func main() {
 				Name:     "cron",
 				Aliases:  []string{"c"},
 				Value:    "",
-				Usage:    "Cron expression. When specified, the profile is not run immediately followed by the program exiting. Rather, it is run according to the passed cron schedule. Prefix with CRON_TZ= to set a timezone. Full documentation: https://pkg.go.dev/github.com/robfig/cron",
+				Usage:    "Cron expression. When specified, the profile is not run immediately followed by the program exiting. Rather, it is run according to the passed cron schedule. Prefix with CRON_TZ= or use --timezone to set a timezone. Full documentation: https://pkg.go.dev/github.com/robfig/cron. When using --config, each profile can have its own schedule; all selected profiles are then run by one long-running process.",
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "timezone",
+				Aliases:  []string{"tz"},
+				Value:    "",
+				Usage:    "Timezone for the cron schedule, e.g. Europe/Berlin. Defaults to the local timezone.",
 				Required: false,
 			},
 			&cli.StringSliceFlag{
 				Name:     "source",
 				Aliases:  []string{"s"},
-				Usage:    "Source path(s) passed to rsync. Specify multiple times for multiple values.",
+				Usage:    "Source folder(s) to back up: a local path, a remote path as [user@]host:path, ssh://[user@]host[:port]/path[?ssh-options=<options>&rsync-path=<command>] (URL-encoded), or a path in a module of an rsync daemon as rsync://[user@]host[:port]/module/path or [user@]host::module/path. Remote sources are pulled over ssh using --ssh-options followed by the source's own options, or from the rsync daemon using --password-file; they require a local target, and all sources of a profile must be on the same host. As with rsync, a trailing slash backs up a folder's contents rather than the folder itself. Specify multiple times for multiple values.",
 				Required: false,
 			},
-			&cli.StringFlag{
+			&cli.StringSliceFlag{
 				Name:     "target",
 				Aliases:  []string{"t"},
-				Usage:    "Required. Target path. This should be an absolute folder path. For paths on remote hosts, --target-host must be specified. For custom SSH options, such as  target host user/port, pass the -e option to rsync using --rsync-options.",
-				Required: true,
+				Usage:    "Required unless --config is used. Target path. This should be an absolute folder path. For paths on remote hosts, --target-host must be specified. For a module of an rsync daemon, use rsync://[user@]host[:port]/module/path instead. For custom SSH options, such as  target host user/port, pass the -e option to rsync using --rsync-options. Specify multiple times to mirror each backup to several targets; targets can then also be given as file:///path or ssh://[user@]host[:port]/path, and URL targets accept the parameters name=<name>, max-<tier>=<n> and max-<tier>-age=<duration> (e.g. ?name=offsite&max-daily=14) to override the profile's limits.",
+				Required: false,
 			},
 			&cli.StringFlag{
 				Name:     "target-host",
@@ -84,11 +113,21 @@ func main() {
 				Usage:    "Target port",
 				Required: false,
 			},
+			&cli.BoolFlag{
+				Name:     "parallel-targets",
+				Usage:    "Back up to and rotate all targets at the same time instead of one after the other",
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "password-file",
+				Usage:    "File containing the password for rsync daemon sources and targets, passed to rsync's --password-file. Must not be readable by other users.",
+				Required: false,
+			},
 			&cli.StringFlag{
 				Name:     "rsync-options",
 				Aliases:  []string{"r"},
 				Value:    "",
-				Usage:    "Extra rsync options. Note that -a and --link-dest are always prepended to these because they are central to how this tool works. -e \"ssh ...\" is also prepended; if you require custom SSH options, pass them in --ssh-options.",
+				Usage:    "Extra rsync options. Note that -a, --delete, --partial-dir and --link-dest are always prepended to these because they are central to how this tool works. For sources and targets accessed over ssh, -e \"ssh ...\" is also prepended; if you require custom SSH options, pass them in --ssh-options. --stats, --itemize-changes and --out-format are always appended, since the transfer statistics and changes are parsed from rsync's output; the lines for each file and the statistics are only logged if -v or -i, or --stats, are given here.",
 				Required: false,
 			},
 			&cli.StringFlag{
@@ -98,6 +137,12 @@ func main() {
 				Usage:    "Extra ssh options. Used for calls to ssh and in rsync's -e option.",
 				Required: false,
 			},
+			&cli.StringFlag{
+				Name:     "ssh-client",
+				Value:    sshClientExec,
+				Usage:    "SSH client used for operations on remote targets: \"exec\" (the ssh command, once per operation) or \"native\" (built-in client, one connection per run; does not read ~/.ssh/config). rsync always uses the ssh command.",
+				Required: false,
+			},
 			&cli.UintFlag{
 				Name:     "max-main",
 				Aliases:  []string{"mM", "M"},
@@ -105,6 +150,13 @@ func main() {
 				Usage:    "Max number of backups to keep in the main folder (e.g. 10 backups per day)",
 				Required: false,
 			},
+			&cli.UintFlag{
+				Name:     "max-hourly",
+				Aliases:  []string{"mh"},
+				Value:    0,
+				Usage:    "Max number of backups to keep in the optional hourly folder (after which the oldest are moved to the daily folder). 0 disables the hourly folder unless --max-hourly-age is set; excess backups then move from the main folder to the daily folder directly.",
+				Required: false,
+			},
 			&cli.UintFlag{
 				Name:     "max-daily",
 				Aliases:  []string{"md", "d"},
@@ -123,7 +175,105 @@ func main() {
 				Name:     "max-monthly",
 				Aliases:  []string{"mm", "m"},
 				Value:    12,
-				Usage:    "Max number of backups to keep in the monthly folder (after which the oldest are *discarded*)",
+				Usage:    "Max number of backups to keep in the monthly folder (after which the oldest are moved to the yearly folder if enabled, and *discarded* otherwise)",
+				Required: false,
+			},
+			&cli.UintFlag{
+				Name:     "max-yearly",
+				Aliases:  []string{"my"},
+				Value:    0,
+				Usage:    "Max number of backups to keep in the optional yearly folder (after which the oldest are *discarded*). 0 disables the yearly folder unless --max-yearly-age is set.",
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "max-main-age",
+				Usage:    "Max age of backups to keep in the main folder, e.g. 14d. See \"Age-based retention\" in the README.",
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "max-hourly-age",
+				Usage:    "Max age of backups to keep in the hourly folder, e.g. 14d. See \"Age-based retention\" in the README.",
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "max-daily-age",
+				Usage:    "Max age of backups to keep in the daily folder, e.g. 14d. See \"Age-based retention\" in the README.",
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "max-weekly-age",
+				Usage:    "Max age of backups to keep in the weekly folder, e.g. 14d. See \"Age-based retention\" in the README.",
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "max-monthly-age",
+				Usage:    "Max age of backups to keep in the monthly folder, e.g. 14d. See \"Age-based retention\" in the README.",
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "max-yearly-age",
+				Usage:    "Max age of backups to keep in the yearly folder, e.g. 14d. See \"Age-based retention\" in the README.",
+				Required: false,
+			},
+			&cli.UintFlag{
+				Name:     "max-error",
+				Value:    0,
+				Usage:    "Max number of _error folders of failed backups to keep in the target folder. 0 keeps all unless --max-error-age is set.",
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "max-error-age",
+				Usage:    "Max age of _error folders of failed backups to keep, as a duration such as 36h, 14d, 8w or 3y. Failed backups exceeding either --max-error or --max-error-age are deleted.",
+				Required: false,
+			},
+			&cli.BoolFlag{
+				Name:     "link-dest-error",
+				Usage:    "Pass the most recent _error folder as an additional --link-dest to rsync if it is more recent than the last complete backup, so files transferred before a failure are not transferred again.",
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "retention-mode",
+				Value:    retentionModePermissive,
+				Usage:    "How the max count and max age of a folder are combined when both are set: \"permissive\" moves a backup on only if it exceeds both limits, \"strict\" if it exceeds either.",
+				Required: false,
+			},
+			&cli.StringSliceFlag{
+				Name:     "tier",
+				Usage:    "Tier in the rotation chain, as <folder name>:<period>:<max>[:<max age>], e.g. _daily:day:7 or _daily:day:7:14d. Period is hour, day, week, month, quarter, year or a duration such as 6h or 3d. Specify multiple times, most recent tier first. Replaces the default chain built from --max-hourly, --max-daily, --max-weekly, --max-monthly and --max-yearly and their --max-*-age counterparts.",
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "resume-max-age",
+				Value:    "24h",
+				Usage:    "Max time since the leftover _progress folder of an interrupted backup was last modified to continue it in the next run instead of starting from scratch. 0 disables resuming.",
+				Required: false,
+			},
+			&cli.BoolFlag{
+				Name:     "remove-interrupted",
+				Usage:    "Remove leftover _progress folders of interrupted backups that are not resumed, because they exceed --resume-max-age or are superseded by a more recent one. By default, they are kept.",
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "lock-timeout",
+				Value:    "0s",
+				Usage:    "How long to wait for the lock on the target folder if another run holds it, e.g. 30m. By default, the run fails immediately.",
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "lock-stale-after",
+				Value:    "15m",
+				Usage:    "Age of the last heartbeat after which the lock of another run is considered stale and broken. Locks of runs on this host are also broken as soon as their process is gone. 0 disables the heartbeat check.",
+				Required: false,
+			},
+			&cli.StringSliceFlag{
+				Name:     "hook",
+				Usage:    "Command to run at a point of the run, as <event>[,<option>...]:<command>, e.g. \"pre-backup,target,timeout=10m:pg_dumpall > /srv/dump.sql\". Events: pre-backup, post-backup (after rsync, whether it succeeded or not), post-rotation, on-success, on-failure. Options: local (default) or target to run the command on the target host, fatal or advisory (default: fatal for pre-backup, advisory otherwise), timeout=<duration>. Commands receive RRB_* environment variables. Specify multiple times for multiple values.",
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "hook-timeout",
+				Value:    "10m",
+				Usage:    "Default timeout for hooks without a timeout option. 0 disables the timeout.",
 				Required: false,
 			},
 			&cli.BoolFlag{
@@ -177,6 +327,54 @@ func main() {
 				Usage:    "Skip verification of SMTP server certificates.",
 				Required: false,
 			},
+			&cli.StringFlag{
+				Name:     "report-policy",
+				Value:    reportPolicyAlways,
+				Usage:    "Which runs to send report mails for: always; warn, for runs with warnings or errors; change, for the first failed run and the first successful run after failures; daily or weekly, for a digest of all runs since the last digest.",
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "state-dir",
+				Usage:    "Folder to keep state between runs in, such as the last reported result for --report-policy change. Defaults to $XDG_STATE_HOME/rotating-rsync-backup or ~/.local/state/rotating-rsync-backup.",
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "report-json",
+				Usage:    "Write a JSON report of each run to this file (replaced atomically), or to stdout for \"-\", in which case the log is printed to stderr. Independent of --report-disabled.",
+				Required: false,
+			},
+			&cli.StringSliceFlag{
+				Name:     "webhook-url",
+				Usage:    "URL to POST a JSON report to after each run, independent of report mails and --report-policy. Specify multiple times for multiple values.",
+				Required: false,
+			},
+			&cli.StringSliceFlag{
+				Name:     "webhook-header",
+				Usage:    "Header to send with webhook calls, as \"Name: value\". Specify multiple times for multiple values.",
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "webhook-secret",
+				Usage:    "Secret to sign webhook calls with: the " + webhookTimestampHeader + " header is set to the time of the call in Unix seconds, and the " + webhookSignatureHeader + " header to \"sha256=\" followed by the hex-encoded HMAC-SHA256 of the timestamp, a dot and the body. Visible to other users in the process list; prefer --webhook-secret-file or the " + webhookSecretEnv + " environment variable.",
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "webhook-secret-file",
+				Usage:    "File containing the secret to sign webhook calls with, see --webhook-secret",
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "webhook-timeout",
+				Value:    "10s",
+				Usage:    "Timeout for each webhook call. 0 disables the timeout.",
+				Required: false,
+			},
+			&cli.UintFlag{
+				Name:     "webhook-retries",
+				Value:    3,
+				Usage:    "Number of times a failed webhook call is retried, after 1s, 2s, 4s and so on. Calls rejected by the server with a 4xx status other than 429 are not retried.",
+				Required: false,
+			},
 			&cli.BoolFlag{
 				Name:     "verbose",
 				Aliases:  []string{"v"},
@@ -185,177 +383,342 @@ func main() {
 				Required: false,
 			},
 		},
+		Commands: []*cli.Command{
+			{
+				Name:   "list",
+				Usage:  "List all backups in all tiers of the target(s), including leftovers of interrupted (_progress) and failed (_error) backups",
+				Action: listCommand,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:    "format",
+						Aliases: []string{"f"},
+						Value:   "table",
+						Usage:   "Output format: table or json",
+					},
+				},
+			},
+			{
+				Name:   "restore",
+				Usage:  "Restore files from a backup to a local folder",
+				Action: restoreCommand,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "from",
+						Aliases:  []string{"f"},
+						Value:    "latest",
+						Usage:    "Backup to restore from: a backup name, \"latest\" for the most recent backup, or <tier>:<n> for the n-th most recent backup in a tier (main or a tier name such as daily), e.g. weekly:1",
+						Required: false,
+					},
+					&cli.StringFlag{
+						Name:     "path",
+						Usage:    "Path inside the backup to restore. As with rsync, a trailing slash restores the contents of a folder rather than the folder itself. Defaults to the whole backup.",
+						Required: false,
+					},
+					&cli.StringFlag{
+						Name:     "to",
+						Usage:    "Local destination folder",
+						Required: true,
+					},
+					&cli.BoolFlag{
+						Name:     "dry-run",
+						Usage:    "Only show what would be restored",
+						Required: false,
+					},
+					&cli.BoolFlag{
+						Name:     "force",
+						Usage:    "Restore into the destination even if it is not empty, overwriting existing files",
+						Required: false,
+					},
+				},
+			},
+			{
+				Name:      "pin",
+				Usage:     "Pin a backup, protecting it from being moved or deleted by rotation",
+				ArgsUsage: "[--until <time>] [--reason <reason>] <backup>",
+				Action:    pinCommand,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "until",
+						Usage:    "Time the pin expires, as 2006-01-02, \"2006-01-02 15:04\" or an RFC 3339 timestamp. Defaults to never.",
+						Required: false,
+					},
+					&cli.StringFlag{
+						Name:     "reason",
+						Usage:    "Reason for pinning the backup, shown in logs and listings",
+						Required: false,
+					},
+				},
+			},
+			{
+				Name:      "unpin",
+				Usage:     "Remove the pin from a backup",
+				ArgsUsage: "<backup>",
+				Action:    unpinCommand,
+			},
+			{
+				Name:   "rotate",
+				Usage:  "Rotate the backups in the target folder(s) without creating a new backup",
+				Action: rotateCommand,
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:     "dry-run",
+						Usage:    "Only print the moves and deletions the rotation would perform",
+						Required: false,
+					},
+				},
+			},
+		},
 		Action: func(c *cli.Context) error {
-			var options Options
-
-			options.Verbose = c.Bool("verbose")
-
-			InitLogger(options.Verbose)
-
-			options.profileName = c.String("profile-name")
-
-			options.sources = c.StringSlice("source")
-			// Validate sources
-			if len(options.sources) == 0 {
-				panic("No sources specified")
-			}
-			// TODO Check if source validation can be reimplemented while taking care of remote sources
-			// for _, source := range options.sources {
-			// 	var invalidSource bool
-			// 	if !filepath.IsAbs(source) {
-			// 		invalidSource = true
-			// 		Log.Fatal.Printf("Source must be absolute: %s", source)
-			// 	}
-
-			// 	if invalidSource {
-			// 		panic("Invalid sources")
-			// 	}
-			// }
-
-			options.target = c.String("target")
-			options.targetHost = c.String("target-host")
-			options.targetUser = c.String("target-user")
-			options.targetPort = c.Uint("target-port")
-
-			rsyncOptionsRaw := c.String("rsync-options")
-			splitRsyncOptions, err := shlex.Split(rsyncOptionsRaw)
-			if err != nil {
-				panic(fmt.Sprintf("Invalid --rsync-options: %v", err))
-			}
-			options.rsyncOptions = splitRsyncOptions
+			InitLogger(c.Bool("verbose"))
 
-			sshOptionsRaw := c.String("ssh-options")
-			splitSSHOptions, err := shlex.Split(sshOptionsRaw)
+			optionsList, err := resolveProfiles(c, true)
 			if err != nil {
-				panic(fmt.Sprintf("Invalid --ssh-options: %v", err))
+				return err
 			}
-			options.sshOptions = splitSSHOptions
-
-			options.maxMain = c.Uint("max-main")
-			options.maxDaily = c.Uint("max-daily")
-			options.maxWeekly = c.Uint("max-weekly")
-			options.maxMonthly = c.Uint("max-monthly")
-
-			options.ReportOptions.enabled = !c.Bool("report-disabled")
-			options.ReportOptions.recipients = c.StringSlice("report-recipient")
-			options.ReportOptions.from = c.String("report-from")
-			options.ReportOptions.smtpHost = c.String("report-smtp-host")
-			options.ReportOptions.smtpPort = c.Uint("report-smtp-port")
-			options.ReportOptions.smtpUsername = c.String("report-smtp-username")
-			options.ReportOptions.smtpPassword = c.String("report-smtp-password")
-			options.ReportOptions.smtpInsecure = c.Bool("report-smtp-insecure")
-
-			// TODO Validate user/port
-
-			cronExpression := c.String("cron")
-			if cronExpression == "" {
-				run(&options)
-				if options.ReportOptions.enabled {
-					SendReportMail(&options)
-				}
-			} else {
-				specParser := cron.NewParser(cron.SecondOptional | cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor)
-				_, err := specParser.Parse(cronExpression)
 
-				if err != nil {
-					panic(fmt.Sprintf("Invalid cron expression for schedule: %v", err))
+			scheduled := 0
+			for _, options := range optionsList {
+				if options.cron != "" {
+					scheduled++
 				}
+			}
 
-				cronLogger := cron.PrintfLogger(log.New(os.Stderr, "cron: ", log.LstdFlags|log.Lmsgprefix))
-				c := cron.New(
-					cron.WithParser(specParser),
-					cron.WithLogger(cronLogger),
-					cron.WithChain(
-						cron.Recover(cronLogger),
-						cron.Recover(cron.DiscardLogger),
-						cron.DelayIfStillRunning(cronLogger),
-						cron.DelayIfStillRunning(cron.DiscardLogger),
-					),
-				)
-
-				// Make entryID available inside func
-				var entryID cron.EntryID
-				entryID, err = c.AddFunc(cronExpression, func() {
-					run(&options)
-					Log.Info.Printf("Next execution: %s", c.Entry(entryID).Next)
-
+			if scheduled == 0 {
+				for _, options := range optionsList {
+					options.log = NewLogger(options.LogOutput(), options.Verbose, "")
+					run(options)
+					if options.ReportOptions.jsonPath != "" {
+						WriteRunReport(options)
+					}
+					SendWebhooks(options)
 					if options.ReportOptions.enabled {
-						SendReportMail(&options)
+						SendReport(options)
+					}
+				}
+			} else {
+				if scheduled != len(optionsList) {
+					for _, options := range optionsList {
+						if options.cron == "" {
+							return fmt.Errorf("profile %s: no cron expression set, but other selected profiles are scheduled; either schedule all selected profiles or none", options.profileName)
+						}
 					}
-					Log.Reset()
-				})
-				if err != nil {
-					panic(fmt.Sprintf("Error adding cron job: %v", err))
 				}
 
-				c.Start()
-				fmt.Printf("Started cron: %s, next execution: %s", cronExpression, c.Entry(entryID).Next)
-
-				// Wait indefinitely while listening for SIGINT/SIGTERM
-				exitSignal := make(chan os.Signal)
-				signal.Notify(exitSignal, syscall.SIGINT, syscall.SIGTERM)
-				<-exitSignal
+				if err := RunDaemon(optionsList); err != nil {
+					return err
+				}
 			}
 
 			return nil
 		},
 	}
+}
+
+// resolveProfiles returns the options for all profiles to run: either the profiles selected
+// from the config file passed in --config, or a single profile built from the command line.
+// See NewOptions for requireSources.
+func resolveProfiles(c *cli.Context, requireSources bool) ([]*Options, error) {
+	configPath := c.String("config")
+	if configPath == "" {
+		if len(c.StringSlice("profile")) > 0 {
+			return nil, fmt.Errorf("--profile: requires --config")
+		}
+
+		options, err := NewOptions(c.String("profile-name"), &flagSource{c}, requireSources)
+		if err != nil {
+			return nil, err
+		}
+
+		return []*Options{options}, nil
+	}
 
-	err := app.Run(os.Args)
+	config, err := LoadConfig(configPath, c.App.Flags)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
+
+	return config.Options(c.StringSlice("profile"), c, requireSources)
 }
 
-func run(options *Options) {
-	defer recovery()
-
-	Log.Debug.Println("profileName:", options.profileName)
-	Log.Debug.Println("sources:", options.sources)
-	Log.Debug.Println("target:", options.TargetPath())
-	Log.Debug.Println("targetHost:", options.targetHost)
-	Log.Debug.Println("targetUser:", options.targetUser)
-	Log.Debug.Println("targetPort:", options.targetPort)
-	Log.Debug.Println("rsyncOptions:", options.rsyncOptions)
-	Log.Debug.Println("sshOptions:", options.sshOptions)
-	Log.Debug.Println("ReportOptions.enabled:", options.ReportOptions.enabled)
-	Log.Debug.Println("ReportOptions.recipients:", options.ReportOptions.recipients)
-	Log.Debug.Println("ReportOptions.from:", options.ReportOptions.from)
-	Log.Debug.Println("ReportOptions.smtpHost:", options.ReportOptions.smtpHost)
-	Log.Debug.Println("ReportOptions.smtpPort:", options.ReportOptions.smtpPort)
-	Log.Debug.Println("ReportOptions.smtpUsername:", options.ReportOptions.smtpUsername)
-	if options.ReportOptions.smtpPassword == "" {
-		Log.Debug.Println("ReportOptions.smtpPassword:", "")
-	} else {
-		Log.Debug.Println("ReportOptions.smtpPassword:", "*****")
+// commandProfiles resolves the profiles for a command operating on an existing target and
+// sets up their loggers. Log output goes to stderr, keeping stdout free for command output.
+func commandProfiles(c *cli.Context) ([]*Options, error) {
+	optionsList, err := resolveProfiles(c, false)
+	if err != nil {
+		return nil, err
 	}
-	Log.Debug.Println("ReportOptions.smtpInsecure:", options.ReportOptions.smtpInsecure)
-	Log.Debug.Println("maxMain:", options.maxMain)
-	Log.Debug.Println("maxDaily:", options.maxDaily)
-	Log.Debug.Println("maxWeekly:", options.maxWeekly)
-	Log.Debug.Println("maxMonthly:", options.maxMonthly)
 
-	Log.Info.Printf("Starting up: profile %s", options.profileName)
+	for _, options := range optionsList {
+		options.log = NewLogger(os.Stderr, options.Verbose, "")
+	}
+
+	return optionsList, nil
+}
+
+// closeTargets closes the targets of all passed profiles
+func closeTargets(optionsList []*Options) {
+	for _, options := range optionsList {
+		options.CloseTarget()
+	}
+}
+
+// recoverError turns a panic into an error returned from a command's action. Must be
+// deferred directly.
+func recoverError(err *error) {
+	if recoveryMessage := recover(); recoveryMessage != nil {
+		*err = fmt.Errorf("%v", recoveryMessage)
+	}
+}
+
+func run(options *Options) {
+	defer recovery(options.log)
+	defer options.CloseTarget()
 
 	currentTime := time.Now()
 	thisBackupName := currentTime.Format(BackupFolderTimeFormat)
-	Log.Info.Printf("New backup will be called: %s", thisBackupName)
+	options.hookState = hookState{backupName: thisBackupName}
+	options.rsyncStats = nil
+	options.changeSummary = nil
+	options.backupMetadata = nil
+	options.rotationActions = nil
+	options.inventory = nil
+	options.freeSpace = nil
+	options.runID = uuid.New().String()
+	options.runStarted = currentTime
+	options.runPhases = &runPhases{}
+
+	runs := newTargetRuns(options)
+	defer closeTargetRuns(runs)
+	defer runFailureHooks(options)
+
+	options.log.Debug.Println("profileName:", options.profileName)
+	options.log.Debug.Println("sources:", options.sources)
+	options.log.Debug.Println("target:", options.TargetPath())
+	options.log.Debug.Println("targetHost:", options.targetHost)
+	options.log.Debug.Println("targetUser:", options.targetUser)
+	options.log.Debug.Println("targetPort:", options.targetPort)
+	options.log.Debug.Println("targets:", len(options.targets))
+	options.log.Debug.Println("parallelTargets:", options.parallelTargets)
+	options.log.Debug.Println("rsyncOptions:", options.rsyncOptions)
+	options.log.Debug.Println("sshOptions:", options.sshOptions)
+	options.log.Debug.Println("sshClient:", options.sshClient)
+	options.log.Debug.Println("cron:", options.cron)
+	options.log.Debug.Println("timezone:", options.timezone)
+	options.log.Debug.Println("ReportOptions.enabled:", options.ReportOptions.enabled)
+	options.log.Debug.Println("ReportOptions.recipients:", options.ReportOptions.recipients)
+	options.log.Debug.Println("ReportOptions.from:", options.ReportOptions.from)
+	options.log.Debug.Println("ReportOptions.smtpHost:", options.ReportOptions.smtpHost)
+	options.log.Debug.Println("ReportOptions.smtpPort:", options.ReportOptions.smtpPort)
+	options.log.Debug.Println("ReportOptions.smtpUsername:", options.ReportOptions.smtpUsername)
+	if options.ReportOptions.smtpPassword == "" {
+		options.log.Debug.Println("ReportOptions.smtpPassword:", "")
+	} else {
+		options.log.Debug.Println("ReportOptions.smtpPassword:", "*****")
+	}
+	options.log.Debug.Println("ReportOptions.smtpInsecure:", options.ReportOptions.smtpInsecure)
+	options.log.Debug.Println("ReportOptions.policy:", options.ReportOptions.policy)
+	options.log.Debug.Println("ReportOptions.stateDir:", options.ReportOptions.stateDir)
+	options.log.Debug.Println("ReportOptions.jsonPath:", options.ReportOptions.jsonPath)
+	options.log.Debug.Println("WebhookOptions.urls:", len(options.WebhookOptions.urls))
+	if options.WebhookOptions.secret == "" {
+		options.log.Debug.Println("WebhookOptions.secret:", "")
+	} else {
+		options.log.Debug.Println("WebhookOptions.secret:", "*****")
+	}
+	options.log.Debug.Println("WebhookOptions.timeout:", options.WebhookOptions.timeout)
+	options.log.Debug.Println("WebhookOptions.retries:", options.WebhookOptions.retries)
+	options.log.Debug.Println("maxMain:", options.maxMain)
+	options.log.Debug.Println("maxMainAge:", options.maxMainAge)
+	options.log.Debug.Println("retentionMode:", options.retentionMode)
+	options.log.Debug.Println("tiers:", options.tiers)
+	options.log.Debug.Println("maxError:", options.maxError)
+	options.log.Debug.Println("maxErrorAge:", options.maxErrorAge)
+	options.log.Debug.Println("linkDestError:", options.linkDestError)
+	options.log.Debug.Println("lockTimeout:", options.lockTimeout)
+	options.log.Debug.Println("lockStaleAfter:", options.lockStaleAfter)
+	options.log.Debug.Println("resumeMaxAge:", options.resumeMaxAge)
+	options.log.Debug.Println("removeLeftover:", options.removeLeftover)
+	options.log.Debug.Println("hookTimeout:", options.hookTimeout)
+	options.log.Debug.Println("hooks:", options.hooks)
+
+	options.log.Info.Printf("Starting up: profile %s", options.profileName)
+	options.log.Info.Printf("New backup will be called: %s", thisBackupName)
+
+	runTargets(runs, false, func(targetOptions *Options) {
+		targetOptions.phase("prepare", func() { PrepareTargetFolder(targetOptions) })
+	})
+	checkTargetRuns(runs, false)
+
+	options.phase("validate-sources", func() { ValidateSources(options) })
+
+	options.phase("pre-backup-hooks", func() {
+		if err := RunHooks(options, hookPreBackup); err != nil {
+			panic(err.Error())
+		}
+	})
+
+	runTargets(runs, options.parallelTargets, func(targetOptions *Options) {
+		targetOptions.phase("backup", func() {
+			lastBackupRelativePath := DetermineLastBackup(targetOptions)
+			if lastBackupRelativePath == "" {
+				targetOptions.log.Info.Println("No existing backup detected.")
+			} else {
+				targetOptions.log.Info.Printf("Last backup: %s", lastBackupRelativePath)
+			}
 
-	PrepareTargetFolder(options)
+			CreateBackup(targetOptions, thisBackupName, lastBackupRelativePath)
+		})
+		targetOptions.phase("rotate", func() { RotateBackups(targetOptions) })
+
+		if inventory, err := BackupInventory(targetOptions); err != nil {
+			targetOptions.log.Warn.Printf("Could not list backups after rotation: %v", err)
+		} else {
+			targetOptions.inventory = inventory
+		}
+
+		if freeSpace, err := targetOptions.Target().FreeSpace(targetOptions.TargetPath()); err == errNotSupported {
+			targetOptions.log.Debug.Printf("Free space on target: unknown, %v", err)
+		} else if err != nil {
+			targetOptions.log.Warn.Printf("Could not determine free space on target: %v", err)
+		} else {
+			targetOptions.log.Info.Printf("Free space on target: %s", FormatBytes(freeSpace))
+			targetOptions.freeSpace = &freeSpace
+		}
+	})
+
+	for _, run := range runs {
+		if run.status.Result != targetResultFailed {
+			run.status.Result = targetResultOK
+		}
+	}
+	logTargetStatuses(options)
+	checkTargetRuns(runs, true)
+
+	options.phase("on-success-hooks", func() {
+		if err := RunHooks(options, hookOnSuccess); err != nil {
+			panic(err.Error())
+		}
+	})
+}
 
-	lastBackupRelativePath := DetermineLastBackup(options)
-	if lastBackupRelativePath == "" {
-		Log.Info.Println("No existing backup detected.")
-	} else {
-		Log.Info.Printf("Last backup: %s", lastBackupRelativePath)
+// runFailureHooks runs the on-failure hooks if the run failed, passing the panic on to
+// recovery afterwards. Must be deferred directly.
+func runFailureHooks(options *Options) {
+	recoveryMessage := recover()
+	if recoveryMessage == nil {
+		return
+	}
+
+	options.hookState.err = fmt.Sprintf("%v", recoveryMessage)
+	if err := RunHooks(options, hookOnFailure); err != nil {
+		options.log.Error.Println(err)
 	}
 
-	CreateBackup(options, thisBackupName, lastBackupRelativePath)
-	RotateBackups(options)
+	panic(recoveryMessage)
 }
 
-func recovery() {
+func recovery(_log *logger) {
 	if recoveryMessage := recover(); recoveryMessage != nil {
-		Log.Fatal.Printf("Uncaught error: %v", recoveryMessage)
+		_log.Fatal.Printf("Uncaught error: %v", recoveryMessage)
 	}
 }
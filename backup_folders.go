@@ -2,169 +2,159 @@ package main
 
 import (
 	"fmt"
-	"io/ioutil"
-	"os"
-	"path"
 	"path/filepath"
-
-	"github.com/alessio/shellescape"
-	"github.com/google/uuid"
+	"strings"
 )
 
 // ListBackupsInPath returns a string slice contaning relative paths to all backups
 // in the passed absPath, relative to basePath
 func ListBackupsInPath(options *Options, basePath string, absPath string) []string {
-	Log.Debug.Printf("listBackupsInPath(%s)", absPath)
+	options.log.Debug.Printf("listBackupsInPath(%s)", absPath)
 	backups := []string{}
 
-	if options.IsRemoteTarget() {
-		stdout, _, _, err := sshCall(
-			options,
-			fmt.Sprintf("find %s -type d -maxdepth 1", shellescape.Quote(absPath)),
-			Log.Debug,
-		)
+	folderNames, err := ListFoldersInPath(options, absPath)
+	if err != nil {
+		panic(fmt.Sprintf("listBackupsInPath: %v", err))
+	}
+
+	for _, folderName := range folderNames {
+		folderRelativePath, err := filepath.Rel(basePath, filepath.Join(absPath, folderName))
 		if err != nil {
-			panic(fmt.Sprintf("listBackupsInPath: unexpected error while listing remote target folder %s: %v", options.TargetPath(), err))
+			panic(fmt.Sprintf("listBackupsInPath: unexpected error while computing relative path on folder %s: %v", filepath.Join(absPath, folderName), err))
 		}
 
-		for _, folderPath := range stdout {
-			folderRelativePath, err := filepath.Rel(basePath, folderPath)
-			if err != nil {
-				panic(fmt.Sprintf("listBackupsInPath: unexpected error while computing relative path on folder %s: %v", folderPath, err))
-			}
-
-			folderName := path.Base(folderPath)
-			Log.Debug.Printf("listBackupsInPath: candidate folder: %s", folderRelativePath)
+		options.log.Debug.Printf("listBackupsInPath: candidate folder: %s", folderRelativePath)
 
-			if BackupFolderNameRegex.MatchString(folderName) {
-				Log.Debug.Printf("listBackupsInPath: matched folder: %s", folderRelativePath)
-				backups = append(backups, folderRelativePath)
-			}
+		if BackupFolderNameRegex.MatchString(folderName) {
+			options.log.Debug.Printf("listBackupsInPath: matched folder: %s", folderRelativePath)
+			backups = append(backups, folderRelativePath)
 		}
-	} else {
-		files, err := ioutil.ReadDir(absPath)
+	}
+
+	return backups
+}
+
+// ListFoldersInPath returns the names of all folders directly inside absPath on the target
+func ListFoldersInPath(options *Options, absPath string) ([]string, error) {
+	folderNames, err := options.Target().ListFolders(absPath)
+	if err != nil {
+		return nil, fmt.Errorf("unexpected error while listing %s target folder %s: %v", options.Target(), absPath, err)
+	}
+
+	return folderNames, nil
+}
+
+// MoveBackup renames the backup folder at fromPath to toPath, along with the files kept next
+// to it (see BackupInfoFilePath)
+func MoveBackup(options *Options, fromPath string, toPath string) error {
+	if err := options.Target().Rename(fromPath, toPath); err != nil {
+		return err
+	}
+
+	for _, fileName := range backupInfoFileNames {
+		infoPath := BackupInfoFilePath(fromPath, fileName)
+		stat, err := options.Target().Stat(infoPath)
 		if err != nil {
-			panic(fmt.Sprintf("listBackupsInPath: unexpected error while listing local target folder %s: %v", options.TargetPath(), err))
+			return err
+		} else if !stat.Exists {
+			continue
 		}
 
-		for _, f := range files {
-			if !f.IsDir() {
-				continue
-			}
+		if err := options.Target().Rename(infoPath, BackupInfoFilePath(toPath, fileName)); err != nil {
+			return err
+		}
+	}
 
-			folderRelativePath, err := filepath.Rel(basePath, filepath.Join(absPath, f.Name()))
-			if err != nil {
-				panic(fmt.Sprintf("listBackupsInPath: unexpected error while computing relative path on folder %s: %v", filepath.Join(absPath, f.Name()), err))
-			}
+	return nil
+}
 
-			folderName := path.Base(f.Name())
-			Log.Debug.Printf("listBackupsInPath: candidate folder: %s", folderName)
+// RemoveBackup deletes the backup folder at absPath, along with the files kept next to it
+// (see BackupInfoFilePath)
+func RemoveBackup(options *Options, absPath string) error {
+	if err := options.Target().RemoveAll(absPath); err != nil {
+		return err
+	}
 
-			if BackupFolderNameRegex.MatchString(folderName) {
-				Log.Debug.Printf("listBackupsInPath: matched folder: %s", folderRelativePath)
-				backups = append(backups, folderRelativePath)
-			}
+	for _, fileName := range backupInfoFileNames {
+		if err := options.Target().RemoveAll(BackupInfoFilePath(absPath, fileName)); err != nil {
+			return err
 		}
 	}
 
-	return backups
+	return nil
+}
+
+// ReadLatestSymlink returns the name of the backup the __latest symlink in absPath points
+// to, or an empty string if there is no such symlink
+func ReadLatestSymlink(options *Options, absPath string) string {
+	linkTarget, err := options.Target().Readlink(filepath.Join(absPath, LatestSymlinkName))
+	if err != nil || strings.TrimSpace(linkTarget) == "" {
+		return ""
+	}
+
+	return filepath.Base(linkTarget)
 }
 
 // PrepareTargetFolder ensures all relevant folders exist at the target location
 func PrepareTargetFolder(options *Options) {
+	options.log.Info.Printf("Check/prepare target folder: %s (%s)", options.TargetPath(), options.Target())
 
-	if options.IsRemoteTarget() {
-		Log.Info.Printf(
-			"Check/prepare target folder: %s on %s@%s:%d",
-			options.TargetPath(),
-			options.targetUser,
-			options.targetHost,
-			options.targetPort,
-		)
-
-		EnsureRemoteFolderExists(options, options.TargetPath())
-		EnsureRemoteFolderExists(options, options.DailyFolderPath())
-		EnsureRemoteFolderExists(options, options.WeeklyFolderPath())
-		EnsureRemoteFolderExists(options, options.MonthlyFolderPath())
-	} else {
-		Log.Info.Printf("Check/prepare target folder: %s", options.TargetPath())
-
-		EnsureLocalFolderExists(options, options.TargetPath())
-		EnsureLocalFolderExists(options, options.DailyFolderPath())
-		EnsureLocalFolderExists(options, options.WeeklyFolderPath())
-		EnsureLocalFolderExists(options, options.MonthlyFolderPath())
+	EnsureFolderExists(options, options.Target(), options.TargetPath())
+	AcquireTargetLock(options)
+	for _, tier := range options.tiers {
+		EnsureFolderExists(options, options.Target(), options.TierFolderPath(tier))
 	}
 }
 
-// EnsureRemoteFolderExists checks for the existence of a remote folder at absPathOnRemote
-// and creates it if it does not yet exist
-func EnsureRemoteFolderExists(options *Options, absPathOnRemote string) {
-	Log.Debug.Printf("EnsureRemoteFolderExists(%s)", absPathOnRemote)
+// ValidateTargetFolder performs the checks of PrepareTargetFolder without creating missing
+// folders or taking the lock, for dry runs
+func ValidateTargetFolder(options *Options) {
+	options.log.Info.Printf("Check target folder: %s (%s)", options.TargetPath(), options.Target())
 
-	existsCode, err := uuid.NewRandom()
-	if err != nil {
-		panic("EnsureRemoteFolderExists: Could not generate okUuid for remote target check")
+	if !FolderExists(options, options.Target(), options.TargetPath()) {
+		panic(fmt.Sprintf("ValidateTargetFolder: target folder %s does not exist", options.TargetPath()))
 	}
+	for _, tier := range options.tiers {
+		if !FolderExists(options, options.Target(), options.TierFolderPath(tier)) {
+			panic(fmt.Sprintf("ValidateTargetFolder: tier folder %s does not exist yet; it is created by the next backup or rotation", options.TierFolderPath(tier)))
+		}
+	}
+}
 
-	notExistsCode, err := uuid.NewRandom()
+// FolderExists checks for the existence of a folder at absPath on the passed target. Panics if
+// something other than a folder exists there.
+func FolderExists(options *Options, target Target, absPath string) bool {
+	stat, err := target.Stat(absPath)
 	if err != nil {
-		panic("EnsureRemoteFolderExists: Could not generate notOkUuid for remote target check")
-	}
-
-	stdout, _, _, err := sshCall(
-		options,
-		fmt.Sprintf(
-			"if [ -d %s ]; then echo %s; else echo %s; fi",
-			shellescape.Quote(absPathOnRemote),
-			existsCode.String(),
-			notExistsCode.String(),
-		),
-		Log.Debug,
-	)
-	if err != nil {
-		panic(fmt.Sprintf("EnsureRemoteFolderExists: error checking for remote folder existence: %v", err))
-	} else if stdout[0] == existsCode.String() {
-		Log.Debug.Println("EnsureRemoteFolderExists: remote folder exists")
-		return
-	} else if stdout[0] != notExistsCode.String() {
-		panic("EnsureRemoteFolderExists: unexpected output checking for remote folder existence (was waiting for one of existCode/notExistsCode")
+		panic(fmt.Sprintf("FolderExists: unexpected error while checking for %s existence: %v", absPath, err))
 	}
 
-	Log.Debug.Println("EnsureRemoteFolderExists: remote folder does not exist, creating")
+	if !stat.Exists {
+		return false
+	}
 
-	_, _, _, err = sshCall(
-		options,
-		fmt.Sprintf("mkdir -p -m 0700 %s", shellescape.Quote(absPathOnRemote)),
-		Log.Debug,
-	)
-	if err != nil {
-		panic(fmt.Sprintf("EnsureRemoteFolderExists: unexpected error while creating remote folder %s: %v", absPathOnRemote, err))
+	options.log.Debug.Printf("FolderExists: target %s exists", absPath)
+
+	if !stat.IsDir {
+		panic(fmt.Sprintf("FolderExists: %s is not a folder", absPath))
 	}
+
+	options.log.Debug.Printf("FolderExists: %s is a folder, as expected", absPath)
+	return true
 }
 
-// EnsureLocalFolderExists checks for the existence of a local folder at absPath
+// EnsureFolderExists checks for the existence of a folder at absPath on the passed target
 // and creates it if it does not yet exist
-func EnsureLocalFolderExists(options *Options, absPath string) {
-	Log.Debug.Printf("EnsureLocalFolderExists(%s)", absPath)
-
-	if stat, err := os.Stat(absPath); err == nil {
-		Log.Debug.Printf("EnsureLocalFolderExists: target %s exists", absPath)
+func EnsureFolderExists(options *Options, target Target, absPath string) {
+	options.log.Debug.Printf("EnsureFolderExists(%s)", absPath)
 
-		if stat.IsDir() {
-			Log.Debug.Printf("EnsureLocalFolderExists: %s is a folder, as expected", absPath)
-			return
-		} else {
-			panic(fmt.Sprintf("EnsureLocalFolderExists: %s is not a folder", absPath))
-		}
-	} else if os.IsNotExist(err) {
-		Log.Debug.Printf("EnsureLocalFolderExists: %s does not exist, creating", absPath)
-		err := os.MkdirAll(absPath, 0700)
+	if FolderExists(options, target, absPath) {
+		return
+	}
 
-		if err != nil {
-			panic(fmt.Sprintf("EnsureLocalFolderExists: %s does not exist and could not be created", absPath))
-		}
-	} else {
-		panic(fmt.Sprintf("EnsureLocalFolderExists: unexpected error while checking for %s existence: %v", absPath, err))
+	options.log.Debug.Printf("EnsureFolderExists: %s does not exist, creating", absPath)
+	if err := target.MkdirAll(absPath, 0700); err != nil {
+		panic(fmt.Sprintf("EnsureFolderExists: %s does not exist and could not be created: %v", absPath, err))
 	}
 }
 
@@ -174,9 +164,9 @@ func DetermineLastBackup(options *Options) string {
 	var backups []string
 
 	backups = append(backups, ListBackupsInPath(options, options.TargetPath(), options.TargetPath())...)
-	backups = append(backups, ListBackupsInPath(options, options.TargetPath(), options.DailyFolderPath())...)
-	backups = append(backups, ListBackupsInPath(options, options.TargetPath(), options.WeeklyFolderPath())...)
-	backups = append(backups, ListBackupsInPath(options, options.TargetPath(), options.MonthlyFolderPath())...)
+	for _, tier := range options.tiers {
+		backups = append(backups, ListBackupsInPath(options, options.TargetPath(), options.TierFolderPath(tier))...)
+	}
 
 	if len(backups) > 0 {
 		// sort.Strings(backups)
@@ -6,27 +6,97 @@ import (
 	"io"
 	"log"
 	"os/exec"
+	"sync"
+	"syscall"
+	"time"
 )
 
-func sshCall(options *Options, sshCmd string, logger *log.Logger) ([]string, []string, int, error) {
+func sshCall(options *Options, host string, sshOptions []string, sshCmd string, logger *log.Logger) ([]string, []string, int, error) {
+	return sshCallWithInput(options, host, sshOptions, sshCmd, nil, logger)
+}
+
+// sshCallWithInput runs sshCmd like sshCall, passing input to its stdin
+func sshCallWithInput(options *Options, host string, sshOptions []string, sshCmd string, input io.Reader, logger *log.Logger) ([]string, []string, int, error) {
 	args := []string{}
 
-	args = append(args, options.SSHOptions()...)
-	args = append(args, options.targetHost)
+	args = append(args, sshOptions...)
+	args = append(args, host)
 	args = append(args, sshCmd)
 
-	return call("ssh", args, "ssh", logger)
+	options.log.Debug.Printf("call: Full command line: %s %v", "ssh", args)
+
+	cmd := exec.Command("ssh", args...)
+	cmd.Stdin = input
+	fullStdout, fullStderr, exitCode, err := callCmd(cmd, 0, logLines("ssh", logger))
+
+	options.log.Debug.Printf("call: Command finished with error: %v", err)
+
+	return fullStdout, fullStderr, exitCode, err
+}
+
+func call(options *Options, command string, args []string, logLabel string, logger *log.Logger) ([]string, []string, int, error) {
+	options.log.Debug.Printf("call: Full command line: %s %v", command, args)
+
+	fullStdout, fullStderr, exitCode, err := callCmd(exec.Command(command, args...), 0, logLines(logLabel, logger))
+
+	options.log.Debug.Printf("call: Command finished with error: %v", err)
+
+	return fullStdout, fullStderr, exitCode, err
+}
+
+// callWithHandler runs command like call, but passes each output line to handleLine
+// instead of logging it. The lines are not collected, since commands such as the rsync call
+// creating a backup print a line per file.
+func callWithHandler(options *Options, command string, args []string, handleLine lineHandler) (int, error) {
+	options.log.Debug.Printf("call: Full command line: %s %v", command, args)
+
+	exitCode, err := runCmd(exec.Command(command, args...), 0, handleLine)
+
+	options.log.Debug.Printf("call: Command finished with error: %v", err)
+
+	return exitCode, err
 }
 
-func call(command string, args []string, logLabel string, logger *log.Logger) ([]string, []string, int, error) {
+// lineHandler handles a line of output of a command on the stream streamName (stdout or
+// stderr)
+type lineHandler func(streamName string, line string)
+
+// logLines returns a lineHandler logging each line to logger, labeled with logLabel
+func logLines(logLabel string, logger *log.Logger) lineHandler {
 	if logLabel == "" {
 		logLabel = "exec"
 	}
 
-	Log.Debug.Printf("call: Full command line: %s %v", command, args)
+	return func(streamName string, line string) {
+		logger.Println(fmt.Sprintf("[ %s %s ] %s", logLabel, streamName, line))
+	}
+}
+
+// callCmd runs the prepared cmd like runCmd, and additionally returns its stdout and stderr
+// lines
+func callCmd(cmd *exec.Cmd, timeout time.Duration, handleLine lineHandler) ([]string, []string, int, error) {
+	var fullStdout []string
+	var fullStderr []string
+
+	// Each stream is handled by its own goroutine, so each slice is only appended to by one
+	exitCode, err := runCmd(cmd, timeout, func(streamName string, line string) {
+		if streamName == "stdout" {
+			fullStdout = append(fullStdout, line)
+		} else {
+			fullStderr = append(fullStderr, line)
+		}
+
+		handleLine(streamName, line)
+	})
 
-	cmd := exec.Command(command, args...)
+	return fullStdout, fullStderr, exitCode, err
+}
 
+// runCmd runs the prepared cmd, passing its output lines to handleLine, and returns its exit
+// code. If timeout is not 0, the command and all processes it started are killed once it
+// expires. These are local processes only: for ssh, this kills the ssh client, while the
+// remote command keeps running until it writes to the closed connection or ends.
+func runCmd(cmd *exec.Cmd, timeout time.Duration, handleLine lineHandler) (int, error) {
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
 		panic(fmt.Sprintf("call: Could not get StdoutPipe: %v", err))
@@ -37,18 +107,37 @@ func call(command string, args []string, logLabel string, logger *log.Logger) ([
 		panic(fmt.Sprintf("call: Could not get Stderr: %v", err))
 	}
 
+	if timeout > 0 {
+		// Run the command in its own process group, so children holding on to its output
+		// streams are killed as well
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	}
+
 	if err := cmd.Start(); err != nil {
 		panic(fmt.Sprintf("call: could not Start() cmd: %v", err))
 	}
 
-	var fullStdout []string
-	var fullStderr []string
+	var timer *time.Timer
+	if timeout > 0 {
+		timer = time.AfterFunc(timeout, func() {
+			syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		})
+	}
 
-	go handleCallStream("stdout", logLabel, stdout, &fullStdout, logger)
-	go handleCallStream("stderr", logLabel, stderr, &fullStderr, logger)
+	// Both streams must be read completely before calling Wait(), which closes the pipes
+	var streams sync.WaitGroup
+	streams.Add(2)
+	go handleCallStream("stdout", stdout, handleLine, &streams)
+	go handleCallStream("stderr", stderr, handleLine, &streams)
+	streams.Wait()
 
 	err = cmd.Wait()
 
+	// A timer that can no longer be stopped has fired
+	if timer != nil && !timer.Stop() {
+		return -1, fmt.Errorf("timed out after %s", FormatDuration(timeout))
+	}
+
 	exitCode := 0
 	if err != nil {
 		if exitError, ok := err.(*exec.ExitError); ok {
@@ -56,24 +145,14 @@ func call(command string, args []string, logLabel string, logger *log.Logger) ([
 		}
 	}
 
-	Log.Debug.Printf("call: Command finished with error: %v", err)
-	// if err != nil {
-	// 	panic(fmt.Sprintf("sshCall: returned with error %v", err))
-	// }
-
-	// Log.Debug.Println("call: All stdout lines", fullStdout)
-	// Log.Debug.Println("call: All stderr lines", fullStderr)
-
-	return fullStdout, fullStderr, exitCode, err
+	return exitCode, err
 }
 
-func handleCallStream(streamName string, logLabel string, stdout io.ReadCloser, stash *[]string, logger *log.Logger) {
+func handleCallStream(streamName string, stdout io.ReadCloser, handleLine lineHandler, done *sync.WaitGroup) {
+	defer done.Done()
+
 	scanner := bufio.NewScanner(stdout)
 	for scanner.Scan() {
-		line := scanner.Text()
-		*stash = append(*stash, line)
-
-		logLine := fmt.Sprintf("[ %s %s ] %s", logLabel, streamName, line)
-		logger.Println(logLine)
+		handleLine(streamName, scanner.Text())
 	}
 }
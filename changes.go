@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Kinds of changes to a path in a backup, compared to the previous backup
+const (
+	changeNewFile   = "new file"
+	changeContent   = "content"
+	changeMetadata  = "metadata"
+	changeDeleted   = "deleted"
+	changeNewFolder = "new folder"
+	changeSymlink   = "symlink"
+)
+
+// changeSummaryVersion is the version of the format of ChangesFileName
+const changeSummaryVersion = 1
+
+// maxTopChanges is the number of paths kept in ChangeSummary.Top
+const maxTopChanges = 100
+
+// reportTopChanges is the number of paths of ChangeSummary.Top shown in reports
+const reportTopChanges = 10
+
+// itemizedLineRegex matches a line printed by rsync for rsyncOutFormat (without its prefix):
+// the itemized changes, the file size and the path
+var itemizedLineRegex = regexp.MustCompile(`^(.{11}) ([\d,.]+) (.*)$`)
+
+// ChangedPath is a path that changed in a backup
+type ChangedPath struct {
+	Path   string `json:"path"`
+	Change string `json:"change"`
+	Size   uint64 `json:"size"`
+}
+
+// ChangeSummary summarizes what changed in a backup compared to the previous backup, built
+// from rsync's itemized changes (see rsync's --itemize-changes)
+type ChangeSummary struct {
+	Version         int    `json:"version"`
+	NewFiles        uint64 `json:"newFiles"`
+	ContentChanges  uint64 `json:"contentChanges"`
+	MetadataChanges uint64 `json:"metadataChanges"`
+	Deletions       uint64 `json:"deletions"`
+	NewFolders      uint64 `json:"newFolders"`
+	Symlinks        uint64 `json:"symlinks"`
+	// Top are the largest new and changed files, largest first, at most maxTopChanges
+	Top []ChangedPath `json:"top"`
+
+	// newPaths is the number of new paths of any type, see CountDeletions
+	newPaths uint64
+}
+
+// NewChangeSummary returns an empty ChangeSummary
+func NewChangeSummary() *ChangeSummary {
+	return &ChangeSummary{Version: changeSummaryVersion, Top: []ChangedPath{}}
+}
+
+// classifyItemizedChange returns the kind of change described by an itemized change string
+// such as ">f.st......", or an empty string if the item did not change
+func classifyItemizedChange(itemized string) string {
+	if strings.HasPrefix(itemized, "*deleting") {
+		return changeDeleted
+	}
+	if len(itemized) < 3 {
+		return ""
+	}
+
+	updateType, fileType, attributes := itemized[0], itemized[1], itemized[2:]
+	isNew := strings.Trim(attributes, "+") == ""
+
+	switch {
+	case fileType == 'L':
+		return changeSymlink
+	case fileType == 'd' && isNew:
+		return changeNewFolder
+	case fileType == 'f' && isNew:
+		return changeNewFile
+	case fileType == 'f' && (updateType == '<' || updateType == '>'):
+		// The file was transferred
+		return changeContent
+	case strings.Trim(attributes, ". ") != "":
+		return changeMetadata
+	}
+
+	return ""
+}
+
+// CountDeletions sets Deletions to the number of paths of the previous backup that are not
+// part of this one, given the number of paths in both (see RsyncStats.FilesTotal). A backup
+// is created in a new folder, so rsync does not report deletions; but with --link-dest, it
+// itemizes every path that was not in the previous backup as new (e.g. "cd+++++++++"), so
+// the paths taken over from the previous backup are all paths but the new ones.
+func (summary *ChangeSummary) CountDeletions(previousPaths uint64, paths uint64) {
+	kept := uint64(0)
+	if paths > summary.newPaths {
+		kept = paths - summary.newPaths
+	}
+
+	summary.Deletions = 0
+	if previousPaths > kept {
+		summary.Deletions = previousPaths - kept
+	}
+}
+
+// Add counts the change in a line printed by rsync for rsyncOutFormat (without its prefix)
+func (summary *ChangeSummary) Add(line string) {
+	matches := itemizedLineRegex.FindStringSubmatch(line)
+	if matches == nil {
+		return
+	}
+
+	itemized := strings.TrimRight(matches[1], " ")
+	if len(itemized) > 2 && itemized[0] != '*' && strings.Trim(itemized[2:], "+") == "" {
+		summary.newPaths++
+	}
+
+	change := classifyItemizedChange(itemized)
+	size, _ := strconv.ParseUint(strings.NewReplacer(",", "", ".", "").Replace(matches[2]), 10, 64)
+
+	switch change {
+	case changeNewFile:
+		summary.NewFiles++
+	case changeContent:
+		summary.ContentChanges++
+	case changeMetadata:
+		summary.MetadataChanges++
+	case changeDeleted:
+		summary.Deletions++
+	case changeNewFolder:
+		summary.NewFolders++
+	case changeSymlink:
+		summary.Symlinks++
+	}
+
+	if change == changeNewFile || change == changeContent {
+		summary.Top = append(summary.Top, ChangedPath{Path: matches[3], Change: change, Size: size})
+		// Only trimmed now and then, rather than on every line
+		if len(summary.Top) >= 2*maxTopChanges {
+			summary.trimTop()
+		}
+	}
+}
+
+// trimTop sorts Top by size and drops all but the largest maxTopChanges paths
+func (summary *ChangeSummary) trimTop() {
+	sort.SliceStable(summary.Top, func(i, j int) bool {
+		return summary.Top[i].Size > summary.Top[j].Size
+	})
+	if len(summary.Top) > maxTopChanges {
+		summary.Top = summary.Top[:maxTopChanges]
+	}
+}
+
+// Counts returns the number of changes of each kind for logs and reports
+func (summary ChangeSummary) Counts() string {
+	return fmt.Sprintf(
+		"%d new files, %d content changes, %d metadata changes, %d deletions, %d new folders, %d symlinks",
+		summary.NewFiles,
+		summary.ContentChanges,
+		summary.MetadataChanges,
+		summary.Deletions,
+		summary.NewFolders,
+		summary.Symlinks,
+	)
+}
+
+// Total returns the number of changed paths
+func (summary ChangeSummary) Total() uint64 {
+	return summary.NewFiles + summary.ContentChanges + summary.MetadataChanges + summary.Deletions + summary.NewFolders + summary.Symlinks
+}
+
+// WriteChangeSummary stores the change summary next to the backup at backupPath
+func WriteChangeSummary(options *Options, backupPath string, summary *ChangeSummary) error {
+	return writeBackupInfoFile(options, backupPath, ChangesFileName, summary)
+}
@@ -0,0 +1,83 @@
+package main
+
+import "testing"
+
+func TestClassifyItemizedChange(t *testing.T) {
+	tests := []struct {
+		itemized string
+		expected string
+	}{
+		{">f+++++++++", changeNewFile},
+		{">f.st......", changeContent},
+		{"<f.st......", changeContent},
+		{".f...p.....", changeMetadata},
+		{".f....o....", changeMetadata},
+		{"cd+++++++++", changeNewFolder},
+		{".d..t......", changeMetadata},
+		{"cL+++++++++", changeSymlink},
+		{"cLc.T......", changeSymlink},
+		{"*deleting", changeDeleted},
+		{".f", ""},
+		{".f         ", ""},
+		{".d.........", ""},
+	}
+
+	for _, test := range tests {
+		if change := classifyItemizedChange(test.itemized); change != test.expected {
+			t.Errorf("classifyItemizedChange(%q) = %q, expected %q", test.itemized, change, test.expected)
+		}
+	}
+}
+
+func TestChangeSummaryAdd(t *testing.T) {
+	summary := NewChangeSummary()
+	for _, line := range []string{
+		">f+++++++++ 1,234 new.txt",
+		">f.st...... 5,000,000 big.iso",
+		".f...p..... 10 script.sh",
+		"*deleting   0 old.txt",
+		"cd+++++++++ 4,096 folder/",
+		"cL+++++++++ 7 link -> new.txt",
+		"garbage",
+	} {
+		summary.Add(line)
+	}
+	summary.trimTop()
+
+	if summary.NewFiles != 1 || summary.ContentChanges != 1 || summary.MetadataChanges != 1 ||
+		summary.Deletions != 1 || summary.NewFolders != 1 || summary.Symlinks != 1 {
+		t.Errorf("got counts %s", summary.Counts())
+	}
+	if len(summary.Top) != 2 || summary.Top[0].Path != "big.iso" || summary.Top[0].Size != 5000000 {
+		t.Errorf("got top %+v", summary.Top)
+	}
+}
+
+func TestChangeSummaryCountDeletions(t *testing.T) {
+	tests := []struct {
+		name          string
+		lines         []string
+		previousPaths uint64
+		paths         uint64
+		want          uint64
+	}{
+		{"unchanged", nil, 10, 10, 0},
+		{"only new paths", []string{"cd+++++++++ 4,096 folder/", ">f+++++++++ 1 folder/new.txt"}, 10, 12, 0},
+		{"new and deleted paths", []string{">f+++++++++ 1 new.txt", ">f.st...... 2 changed.txt"}, 10, 8, 3},
+		{"everything deleted", nil, 10, 0, 10},
+		{"more new paths than paths", []string{">f+++++++++ 1 a", ">f+++++++++ 1 b"}, 10, 1, 10},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			summary := NewChangeSummary()
+			for _, line := range test.lines {
+				summary.Add(line)
+			}
+			summary.CountDeletions(test.previousPaths, test.paths)
+			if summary.Deletions != test.want {
+				t.Errorf("got %d deletions, want %d", summary.Deletions, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v2"
+)
+
+// configExcludedKeys holds the names of command line options that cannot be used as keys
+// in a config file, either because they select what to run or because they are derived
+// from the file itself (the profile name is the profile's key)
+var configExcludedKeys = map[string]bool{
+	"config":       true,
+	"profile":      true,
+	"profile-name": true,
+}
+
+// Config is a parsed config file. Every command line option (except the ones listed in
+// configExcludedKeys) can be used as a key, both in the "defaults" section and in each
+// profile below "profiles". Options passed on the command line take precedence over profile
+// keys, which in turn take precedence over defaults. Options not set anywhere keep the
+// default of their flag.
+type Config struct {
+	path     string
+	defaults map[string]interface{}
+	profiles map[string]map[string]interface{}
+}
+
+// LoadConfig reads and validates the config file at path. The format is determined by the
+// file extension: .toml files are parsed as TOML, everything else as YAML (and thus JSON).
+// The passed flags determine which keys are valid.
+func LoadConfig(path string, flags []cli.Flag) (*Config, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("%s: could not read config file: %v", path, err)
+	}
+
+	raw := map[string]interface{}{}
+	if strings.ToLower(filepath.Ext(path)) == ".toml" {
+		if _, err := toml.Decode(string(content), &raw); err != nil {
+			return nil, fmt.Errorf("%s: invalid TOML: %v", path, err)
+		}
+	} else {
+		var rawYAML interface{}
+		if err := yaml.Unmarshal(content, &rawYAML); err != nil {
+			return nil, fmt.Errorf("%s: invalid YAML: %v", path, err)
+		}
+		if rawYAML != nil {
+			rawMap, ok := normalizeConfigValue(rawYAML).(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("%s: top level must be a mapping", path)
+			}
+			raw = rawMap
+		}
+	}
+
+	config := &Config{
+		path:     path,
+		defaults: map[string]interface{}{},
+		profiles: map[string]map[string]interface{}{},
+	}
+
+	validKeys := map[string]bool{}
+	for _, flag := range flags {
+		name := flag.Names()[0]
+		if !configExcludedKeys[name] {
+			validKeys[name] = true
+		}
+	}
+
+	for key, value := range raw {
+		switch key {
+		case "defaults":
+			section, err := config.section(key, value, validKeys)
+			if err != nil {
+				return nil, err
+			}
+			config.defaults = section
+		case "profiles":
+			profiles, ok := value.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("%s: %s: expected a mapping of profile names to profiles", path, key)
+			}
+			for profileName, profileValue := range profiles {
+				if strings.TrimSpace(profileName) == "" {
+					return nil, fmt.Errorf("%s: %s: profile names must not be empty", path, key)
+				}
+				section, err := config.section(key+"."+profileName, profileValue, validKeys)
+				if err != nil {
+					return nil, err
+				}
+				config.profiles[profileName] = section
+			}
+		default:
+			return nil, fmt.Errorf("%s: %s: unknown key (expected \"defaults\" or \"profiles\")", path, key)
+		}
+	}
+
+	if len(config.profiles) == 0 {
+		return nil, fmt.Errorf("%s: profiles: no profiles defined", path)
+	}
+
+	return config, nil
+}
+
+// section checks that value is a mapping containing only known keys and returns it
+func (config *Config) section(keyPath string, value interface{}, validKeys map[string]bool) (map[string]interface{}, error) {
+	if value == nil {
+		return map[string]interface{}{}, nil
+	}
+
+	section, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s: %s: expected a mapping", config.path, keyPath)
+	}
+
+	for key := range section {
+		if configExcludedKeys[key] {
+			return nil, fmt.Errorf("%s: %s.%s: option cannot be set in a config file", config.path, keyPath, key)
+		}
+		if !validKeys[key] {
+			return nil, fmt.Errorf("%s: %s.%s: unknown key", config.path, keyPath, key)
+		}
+	}
+
+	return section, nil
+}
+
+// ProfileNames returns the names of all profiles in the config file, sorted alphabetically
+func (config *Config) ProfileNames() []string {
+	names := []string{}
+	for name := range config.profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// Options builds an Options struct for each of the passed profile names, or for every profile
+// if no names are passed. Settings not found in the file are read from the passed context.
+// See NewOptions for requireSources.
+func (config *Config) Options(profileNames []string, c *cli.Context, requireSources bool) ([]*Options, error) {
+	if len(profileNames) == 0 {
+		profileNames = config.ProfileNames()
+	}
+
+	optionsList := []*Options{}
+	for _, profileName := range profileNames {
+		if _, ok := config.profiles[profileName]; !ok {
+			return nil, fmt.Errorf("%s: profiles: no profile named %q (available: %s)", config.path, profileName, strings.Join(config.ProfileNames(), ", "))
+		}
+
+		options, err := NewOptions(profileName, &profileSource{config: config, profileName: profileName, context: c}, requireSources)
+		if err != nil {
+			return nil, err
+		}
+		optionsList = append(optionsList, options)
+	}
+
+	return optionsList, nil
+}
+
+// profileSource is an optionSource reading options passed on the command line, then the
+// profile in a config file, then its defaults section and finally the flag defaults
+type profileSource struct {
+	config      *Config
+	profileName string
+	context     *cli.Context
+	errors      []string
+}
+
+// lookup returns the raw value for the passed key and the key path it was found at. Options
+// passed on the command line are not looked up, so they override the config file.
+func (source *profileSource) lookup(name string) (interface{}, string, bool) {
+	if source.context.IsSet(name) {
+		return nil, "", false
+	}
+	if value, ok := source.config.profiles[source.profileName][name]; ok {
+		return value, fmt.Sprintf("profiles.%s.%s", source.profileName, name), true
+	}
+	if value, ok := source.config.defaults[name]; ok {
+		return value, "defaults." + name, true
+	}
+
+	return nil, "", false
+}
+
+func (source *profileSource) addError(keyPath string, message string, value interface{}) {
+	source.errors = append(source.errors, fmt.Sprintf("%s: %s: %s, got %v", source.config.path, keyPath, message, value))
+}
+
+func (source *profileSource) String(name string) string {
+	value, keyPath, ok := source.lookup(name)
+	if !ok {
+		return source.context.String(name)
+	}
+
+	if str, ok := value.(string); ok {
+		return str
+	}
+
+	source.addError(keyPath, "expected a string", value)
+	return ""
+}
+
+func (source *profileSource) StringSlice(name string) []string {
+	value, keyPath, ok := source.lookup(name)
+	if !ok {
+		return source.context.StringSlice(name)
+	}
+
+	switch typedValue := value.(type) {
+	case string:
+		return []string{typedValue}
+	case []interface{}:
+		slice := []string{}
+		for _, item := range typedValue {
+			str, ok := item.(string)
+			if !ok {
+				source.addError(keyPath, "expected a list of strings", value)
+				return nil
+			}
+			slice = append(slice, str)
+		}
+		return slice
+	}
+
+	source.addError(keyPath, "expected a string or a list of strings", value)
+	return nil
+}
+
+func (source *profileSource) Uint(name string) uint {
+	value, keyPath, ok := source.lookup(name)
+	if !ok {
+		return source.context.Uint(name)
+	}
+
+	switch typedValue := value.(type) {
+	case int:
+		if typedValue >= 0 {
+			return uint(typedValue)
+		}
+	case int64:
+		if typedValue >= 0 {
+			return uint(typedValue)
+		}
+	case uint64:
+		return uint(typedValue)
+	}
+
+	source.addError(keyPath, "expected a non-negative integer", value)
+	return 0
+}
+
+func (source *profileSource) Bool(name string) bool {
+	value, keyPath, ok := source.lookup(name)
+	if !ok {
+		return source.context.Bool(name)
+	}
+
+	if b, ok := value.(bool); ok {
+		return b
+	}
+
+	source.addError(keyPath, "expected true or false", value)
+	return false
+}
+
+func (source *profileSource) Describe(name string) string {
+	if _, keyPath, ok := source.lookup(name); ok {
+		return fmt.Sprintf("%s: %s", source.config.path, keyPath)
+	}
+	if source.context.IsSet(name) {
+		return "--" + name
+	}
+
+	return fmt.Sprintf("%s: profiles.%s.%s", source.config.path, source.profileName, name)
+}
+
+func (source *profileSource) Err() error {
+	if len(source.errors) == 0 {
+		return nil
+	}
+
+	return fmt.Errorf("%s", strings.Join(source.errors, "\n"))
+}
+
+// normalizeConfigValue converts the map[interface{}]interface{} values produced by the
+// YAML parser into map[string]interface{}, recursively
+func normalizeConfigValue(value interface{}) interface{} {
+	switch typedValue := value.(type) {
+	case map[interface{}]interface{}:
+		normalized := map[string]interface{}{}
+		for key, item := range typedValue {
+			normalized[fmt.Sprintf("%v", key)] = normalizeConfigValue(item)
+		}
+		return normalized
+	case []interface{}:
+		normalized := make([]interface{}, len(typedValue))
+		for i, item := range typedValue {
+			normalized[i] = normalizeConfigValue(item)
+		}
+		return normalized
+	}
+
+	return value
+}
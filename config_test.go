@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/urfave/cli/v2"
+)
+
+// resolveConfigProfiles writes content to a config file named fileName and resolves its
+// profiles with the passed command line arguments
+func resolveConfigProfiles(t *testing.T, fileName string, content string, args ...string) ([]*Options, error) {
+	folder, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(folder)
+
+	path := filepath.Join(folder, fileName)
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var optionsList []*Options
+	var resolveErr error
+	app := newApp()
+	app.Action = func(c *cli.Context) error {
+		optionsList, resolveErr = resolveProfiles(c, true)
+		return nil
+	}
+	if err := app.Run(append([]string{"rotating-rsync-backup", "--config", path}, args...)); err != nil {
+		t.Fatalf("app.Run: %v", err)
+	}
+
+	return optionsList, resolveErr
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		err     string
+	}{
+		{"unknown top level key", "profile:\n  www: {}\n", "unknown key"},
+		{"no profiles", "defaults:\n  max-daily: 3\n", "no profiles defined"},
+		{"unknown option", "profiles:\n  www:\n    max-dayly: 3\n", "profiles.www.max-dayly: unknown key"},
+		{"excluded option", "profiles:\n  www:\n    config: other.yaml\n", "cannot be set in a config file"},
+		{"profile not a mapping", "profiles:\n  www: /srv/www\n", "expected a mapping"},
+		{"top level not a mapping", "- www\n", "top level must be a mapping"},
+		{"invalid YAML", "profiles: [\n", "invalid YAML"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := resolveConfigProfiles(t, "backup.yaml", test.content)
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("got error %v, expected it to contain %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	yamlConfig := `
+defaults:
+  target: /backups/default
+  max-main: 10
+profiles:
+  www:
+    source: /srv/www/
+    target: /backups/www
+    max-main: 24
+  db:
+    source: [/var/backups/db/]
+`
+	tomlConfig := `
+[defaults]
+target = "/backups/default"
+max-main = 10
+
+[profiles.www]
+source = "/srv/www/"
+target = "/backups/www"
+max-main = 24
+
+[profiles.db]
+source = ["/var/backups/db/"]
+`
+
+	tests := []struct {
+		name     string
+		fileName string
+		content  string
+		args     []string
+		// expected holds the target and max-main of the profiles db and www, in this order
+		expected []string
+	}{
+		{"yaml", "backup.yaml", yamlConfig, nil, []string{"/backups/default 10", "/backups/www 24"}},
+		{"toml", "backup.toml", tomlConfig, nil, []string{"/backups/default 10", "/backups/www 24"}},
+		{"command line", "backup.yaml", yamlConfig, []string{"--max-main", "5"}, []string{"/backups/default 5", "/backups/www 5"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			optionsList, err := resolveConfigProfiles(t, test.fileName, test.content, test.args...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			actual := []string{}
+			for _, options := range optionsList {
+				actual = append(actual, fmt.Sprintf("%s %d", options.target, options.maxMain))
+			}
+			if !reflect.DeepEqual(actual, test.expected) {
+				t.Errorf("got %v, expected %v", actual, test.expected)
+			}
+		})
+	}
+}
+
+func TestConfigTypeErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		err     string
+	}{
+		{"number for a duration", "profiles:\n  www:\n    source: /srv/www/\n    target: /backups/www\n    lock-timeout: 5\n", "profiles.www.lock-timeout: expected a string, got 5"},
+		{"string for a number", "profiles:\n  www:\n    source: /srv/www/\n    target: /backups/www\n    max-main: ten\n", "profiles.www.max-main: expected a non-negative integer, got ten"},
+		{"negative number", "defaults:\n  max-daily: -1\nprofiles:\n  www:\n    source: /srv/www/\n    target: /backups/www\n", "defaults.max-daily: expected a non-negative integer, got -1"},
+		{"mapping for a list", "profiles:\n  www:\n    source: {path: /srv/www/}\n    target: /backups/www\n", "profiles.www.source: expected a string or a list of strings"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := resolveConfigProfiles(t, "backup.yaml", test.content)
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("got error %v, expected it to contain %q", err, test.err)
+			}
+		})
+	}
+}
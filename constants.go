@@ -2,6 +2,12 @@ package main
 
 import "regexp"
 
+// appVersion is the version of this tool
+const appVersion string = "v3.0.7"
+
+// HourlyFolderName is a helper constant holding the name of the hourly backup grouping folder
+const HourlyFolderName string = "_hourly"
+
 // DailyFolderName is a helper constant holding the name of the daily backup grouping folder
 const DailyFolderName string = "_daily"
 
@@ -11,9 +17,43 @@ const WeeklyFolderName string = "_weekly"
 // MonthlyFolderName is a helper constant holding the name of the monthly backup grouping folder
 const MonthlyFolderName string = "_monthly"
 
+// YearlyFolderName is a helper constant holding the name of the yearly backup grouping folder
+const YearlyFolderName string = "_yearly"
+
+// LatestSymlinkName is the name of the symlink pointing to the most recent backup in each folder
+const LatestSymlinkName string = "__latest"
+
+// PinsFileName is the name of the pin registry file in the target folder, see pins.go
+const PinsFileName string = "__pins.json"
+
+// LockFolderName is the name of the lock folder in the target folder, see lock.go
+const LockFolderName string = "__lock.d"
+
+// LockFileName is the name of the file local target folders are flocked on, see lock.go
+const LockFileName string = "__lock"
+
+// ChangesFileName is the suffix of the change summary file next to each backup folder, see
+// changes.go and BackupInfoFilePath
+const ChangesFileName string = "changes.json"
+
+// MetadataFileName is the suffix of the backup metadata file next to each backup folder, see
+// metadata.go and BackupInfoFilePath
+const MetadataFileName string = "metadata.json"
+
+// backupInfoFileNames are the suffixes of all files kept next to each backup folder
+var backupInfoFileNames = []string{MetadataFileName, ChangesFileName}
+
+// RsyncPartialDirName is the name of the folder rsync keeps partially transferred files in,
+// see --partial-dir
+const RsyncPartialDirName string = ".rsync-partial"
+
 // BackupFolderTimeFormat is the time format used to format backup folder names and parse
 // them back into a time instance
 const BackupFolderTimeFormat string = "2006-01-02_15-04-05"
 
 // BackupFolderNameRegex will match a correct backup folder name (with no suffixes)
 var BackupFolderNameRegex = regexp.MustCompile("^(\\d{4})-(\\d{2})-(\\d{2})_(\\d{2})-(\\d{2})-(\\d{2})$")
+
+// LeftoverFolderNameRegex will match the folder of an interrupted (_progress) or failed (_error)
+// backup
+var LeftoverFolderNameRegex = regexp.MustCompile("^(\\d{4}-\\d{2}-\\d{2}_\\d{2}-\\d{2}-\\d{2})_(progress|error)$")
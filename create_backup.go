@@ -2,19 +2,110 @@ package main
 
 import (
 	"fmt"
-	"os"
 	"path/filepath"
 	"strings"
-
-	"github.com/alessio/shellescape"
+	"time"
 )
 
+// FindResumableBackup looks for _progress folders left behind by interrupted backups in the
+// target folder. The most recent one is returned if it was last modified within the
+// configured resume max age. The others are kept, unless --remove-interrupted is set. If
+// resuming is disabled, an empty string is returned.
+func FindResumableBackup(options *Options) string {
+	if options.resumeMaxAge == 0 && !options.removeLeftover {
+		return ""
+	}
+
+	folderNames, err := ListFoldersInPath(options, options.TargetPath())
+	if err != nil {
+		panic(fmt.Sprintf("FindResumableBackup: %v", err))
+	}
+
+	leftovers := []string{}
+	for _, folderName := range folderNames {
+		if matches := LeftoverFolderNameRegex.FindStringSubmatch(folderName); matches != nil && matches[2] == "progress" {
+			leftovers = append(leftovers, matches[1])
+		}
+	}
+	SortBackupList(&leftovers, true)
+
+	resumeFolderName := ""
+	for _, backupName := range leftovers {
+		folderName := backupName + "_progress"
+
+		var reason string
+		if resumeFolderName != "" {
+			reason = "superseded by " + resumeFolderName
+		} else if options.resumeMaxAge == 0 {
+			reason = "resuming is disabled"
+		} else {
+			age := interruptedBackupAge(options, backupName)
+			if age <= options.resumeMaxAge {
+				resumeFolderName = folderName
+				continue
+			}
+			reason = fmt.Sprintf("last modified %s ago, more than %s", FormatAge(age), FormatDuration(options.resumeMaxAge))
+		}
+
+		if !options.removeLeftover {
+			options.log.Info.Printf("Keeping interrupted backup %s: %s", folderName, reason)
+			continue
+		}
+
+		options.log.Info.Printf("Removing interrupted backup %s: %s", folderName, reason)
+		if err := RemoveBackup(options, filepath.Join(options.TargetPath(), folderName)); err != nil {
+			options.log.Error.Printf("Could not remove interrupted backup %s: %v", folderName, err)
+		}
+	}
+
+	return resumeFolderName
+}
+
+// interruptedBackupAge returns the time since the _progress folder of the interrupted backup
+// backupName was last modified, or since the backup was started if the target does not report
+// modification times
+func interruptedBackupAge(options *Options, backupName string) time.Duration {
+	folderPath := filepath.Join(options.TargetPath(), backupName+"_progress")
+
+	stat, err := options.Target().Stat(folderPath)
+	if err != nil {
+		panic(fmt.Sprintf("FindResumableBackup: could not check %s: %v", folderPath, err))
+	}
+	if !stat.ModTime.IsZero() {
+		return time.Since(stat.ModTime)
+	}
+
+	backupTime, err := BackupNameToTime(backupName)
+	if err != nil {
+		panic(fmt.Sprintf("FindResumableBackup: error parsing backup folder %s into time: %v", folderPath, err))
+	}
+
+	return BackupAge(backupTime, time.Now())
+}
+
+// countDeletions counts the deletions since the last backup at lastBackupRelativePath, see
+// ChangeSummary.CountDeletions. Backups created by versions not storing their number of paths
+// in their metadata cannot be compared against.
+func countDeletions(options *Options, lastBackupRelativePath string) {
+	lastMetadata, err := ReadBackupMetadata(options, filepath.Join(options.TargetPath(), lastBackupRelativePath))
+	if err != nil {
+		options.log.Warn.Printf("Could not read metadata of the last backup %s, so deletions are not counted: %v", lastBackupRelativePath, err)
+		return
+	} else if lastMetadata == nil || lastMetadata.Stats == nil || lastMetadata.Stats.FilesTotal == 0 {
+		options.log.Info.Printf("The metadata of the last backup %s does not record its number of files, so deletions are not counted", lastBackupRelativePath)
+		return
+	}
+
+	options.changeSummary.CountDeletions(lastMetadata.Stats.FilesTotal, options.rsyncStats.FilesTotal)
+}
+
 // CreateBackup runs all necessary commands to create a new backup based on the passed
 // backup name thisBackupName and the relative path lastBackupRelativePath to the last backup
 // to use as hard link destination. Note that lastBackupRelativePath is relative to the MAIn
 // target folder
 func CreateBackup(options *Options, thisBackupName string, lastBackupRelativePath string) {
-	Log.Info.Printf("Backing up sources: %v", options.sources)
+	options.log.Info.Printf("Backing up sources: %v", options.sources)
+	started := time.Now()
 
 	// Add target, check for existence and create if necessary
 	// Use a temporary folder and rename to an error folder if anything fails. That way, if the script is interrupted
@@ -23,63 +114,121 @@ func CreateBackup(options *Options, thisBackupName string, lastBackupRelativePat
 	progressTargetPath := NormalizeFolderPath(filepath.Join(options.TargetPath(), thisBackupName+"_progress"))
 	errorTargetPath := NormalizeFolderPath(filepath.Join(options.TargetPath(), thisBackupName+"_error"))
 
-	args := []string{"-a", "--delete"}
+	if resumeFolderName := FindResumableBackup(options); resumeFolderName != "" {
+		resumePath := NormalizeFolderPath(filepath.Join(options.TargetPath(), resumeFolderName))
+
+		options.log.Info.Printf("Resuming interrupted backup %s as %s", resumeFolderName, thisBackupName)
+		if err := MoveBackup(options, resumePath, progressTargetPath); err != nil {
+			panic(fmt.Sprintf("Could not rename interrupted backup %s to %s: %v", resumePath, progressTargetPath, err))
+		}
+	}
+
+	// Keep partially transferred files in a separate folder if rsync is interrupted, so they
+	// can be continued when resuming. rsync removes the folder once the files are complete.
+	args := []string{"-a", "--delete", "--partial-dir", RsyncPartialDirName}
+	linkDest := []string{}
 
 	if lastBackupRelativePath != "" {
 		// --link-dest must be relative to the TARGET FOLDER, which means the NEWLY created backup folder
 		// (not the "main" folder). Hence the "../".
 		// It does not take user:host@ before the relative path, but figures that out itself
 		args = append(args, "--link-dest", NormalizeFolderPath(filepath.Join("../", lastBackupRelativePath)))
+		linkDest = append(linkDest, lastBackupRelativePath)
+	}
+
+	if options.linkDestError {
+		if errorBackup := DetermineLinkDestErrorBackup(options, lastBackupRelativePath); errorBackup != "" {
+			options.log.Info.Printf("Also linking against failed backup %s", errorBackup)
+			args = append(args, "--link-dest", NormalizeFolderPath(filepath.Join("../", errorBackup)))
+			linkDest = append(linkDest, errorBackup)
+		}
+	}
+
+	connectionOptions := options.Target().RsyncOptions()
+	if len(options.sources) > 0 && options.sources[0].IsRemote() {
+		// All remote sources share the same connection settings, see ParseSources
+		connectionOptions = options.sources[0].RsyncOptions(options)
 	}
 
 	args = append(args, options.rsyncOptions...)
-	args = append(args, "-e", fmt.Sprintf("ssh %s", strings.Join(options.SSHOptions(), " ")))
+	args = append(args, connectionOptions...)
+	// After the configured options, so they can not be overridden
+	args = append(args, "--stats", "--itemize-changes", "--out-format", rsyncOutFormat)
+	metadata := NewBackupMetadata(options, started, append([]string{}, args...))
+	metadata.LinkDest = linkDest
 
 	for _, source := range options.sources {
-		args = append(args, source)
+		args = append(args, source.RsyncArg())
 	}
 
-	if options.IsRemoteTarget() {
-		args = append(args, fmt.Sprintf("%s:%s", options.targetHost, progressTargetPath))
-	} else {
-		args = append(args, progressTargetPath)
-	}
+	args = append(args, options.Target().RsyncPath(progressTargetPath))
 
-	Log.Debug.Printf("createBackup: cmdLine: rsync %s", strings.Join(args, " "))
+	options.log.Debug.Printf("createBackup: cmdLine: rsync %s", strings.Join(args, " "))
 
 	// _, _, _, err := call("printenv", []string{})
-	_, _, exitCode, err := call("rsync", args, "rsync", Log.Info)
+	output := newRsyncOutput(options)
+	start := time.Now()
+	exitCode, err := callWithHandler(options, "rsync", args, output.handleLine)
+	options.hookState.rsyncExitCode = &exitCode
+	// Exit codes 23, 24 and 25 mean that some files could not be transferred or deleted
+	partial := exitCode == 23 || exitCode == 24 || exitCode == 25
+
+	options.rsyncStats = output.Stats()
+	if options.rsyncStats != nil {
+		options.rsyncStats.DurationSeconds = time.Since(start).Seconds()
+		options.log.Info.Printf("Transferred: %s", options.rsyncStats.Summary())
+	}
+	options.changeSummary = output.Changes()
+	if lastBackupRelativePath != "" && options.rsyncStats != nil && (err == nil || partial) {
+		countDeletions(options, lastBackupRelativePath)
+	}
+	options.log.Info.Printf("Changes: %s", options.changeSummary.Counts())
+
+	metadata.Finish(exitCode, options.rsyncStats)
+	options.backupMetadata = metadata
+
+	// Before renaming, so the backup is never complete without them. Failed backups keep them
+	// too, unless rsync failed before creating the folder.
+	if stat, err := options.Target().Stat(progressTargetPath); err == nil && stat.Exists {
+		if err := WriteBackupMetadata(options, progressTargetPath, metadata); err != nil {
+			options.log.Warn.Printf("Could not store backup metadata of %s: %v", progressTargetPath, err)
+		}
+		if err := WriteChangeSummary(options, progressTargetPath, options.changeSummary); err != nil {
+			options.log.Warn.Printf("Could not store change summary of %s: %v", progressTargetPath, err)
+		}
+	}
+
+	// post-backup hooks run whether rsync succeeded or not, e.g. to restart services stopped
+	// by pre-backup hooks. If a fatal one fails, a complete backup is kept, but the run fails.
+	hookErr := RunHooks(options, hookPostBackup)
+
 	if err != nil {
-		if exitCode == 23 || exitCode == 24 || exitCode == 25 {
-			Log.Warn.Printf("Rsync exited with exit code %v; indicating that some files could not be transfered/deleted.", exitCode)
+		if partial {
+			options.log.Warn.Printf("Rsync exited with exit code %v; indicating that some files could not be transfered/deleted.", exitCode)
 		} else {
-			Log.Fatal.Printf("Error executing rsync command: %v", err)
-			Log.Debug.Printf("Renaming progress folder %s to %s", progressTargetPath, errorTargetPath)
+			options.log.Fatal.Printf("Error executing rsync command: %v", err)
+			options.log.Debug.Printf("Renaming progress folder %s to %s", progressTargetPath, errorTargetPath)
 
-			mvErr := os.Rename(progressTargetPath, errorTargetPath)
+			mvErr := MoveBackup(options, progressTargetPath, errorTargetPath)
 			if mvErr != nil {
-				Log.Fatal.Printf("Could not rename progress folder %s to error folder %s", progressTargetPath, errorTargetPath)
+				options.log.Fatal.Printf("Could not rename progress folder %s to error folder %s: %v", progressTargetPath, errorTargetPath, mvErr)
 			}
 
+			// Failed runs do not rotate, so failed backups would pile up without this
+			PruneErrorBackups(options)
+
 			panic(fmt.Sprintf("Error executing rsync command: %v", err))
 		}
 
 	}
 
-	Log.Debug.Printf("Renaming temporary folder %s to %s", progressTargetPath, targetPath)
-	if options.IsRemoteTarget() {
-		_, _, _, err := sshCall(
-			options,
-			fmt.Sprintf("mv %s %s", shellescape.Quote(progressTargetPath), shellescape.Quote(targetPath)),
-			Log.Debug,
-		)
-		if err != nil {
-			panic(fmt.Sprintf("Could not rename remote progress folder %s to final target folder %s", progressTargetPath, targetPath))
-		}
-	} else {
-		mvErr := os.Rename(progressTargetPath, targetPath)
-		if mvErr != nil {
-			panic(fmt.Sprintf("Could not rename progress folder %s to final target folder %s", progressTargetPath, targetPath))
-		}
+	options.log.Debug.Printf("Renaming temporary folder %s to %s", progressTargetPath, targetPath)
+	mvErr := MoveBackup(options, progressTargetPath, targetPath)
+	if mvErr != nil {
+		panic(fmt.Sprintf("Could not rename progress folder %s to final target folder %s: %v", progressTargetPath, targetPath, mvErr))
+	}
+
+	if hookErr != nil {
+		panic(hookErr.Error())
 	}
 }
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestFindResumableBackup(t *testing.T) {
+	now := time.Now()
+	recent := backupName(now, time.Hour)
+	older := backupName(now, 2*time.Hour)
+	old := backupName(now, 48*time.Hour)
+	complete := backupName(now, 3*time.Hour)
+	failed := backupName(now, 4*time.Hour) + "_error"
+	leftovers := []string{recent + "_progress", older + "_progress", old + "_progress"}
+
+	tests := []struct {
+		name           string
+		resumeMaxAge   time.Duration
+		removeLeftover bool
+		expected       string
+		// remaining are the _progress folders expected to be left in the target folder
+		remaining []string
+	}{
+		{"resume most recent", 24 * time.Hour, false, recent + "_progress", leftovers},
+		{"remove others", 24 * time.Hour, true, recent + "_progress", []string{recent + "_progress"}},
+		{"all too old", 30 * time.Minute, false, "", leftovers},
+		{"all too old, remove", 30 * time.Minute, true, "", []string{}},
+		{"disabled", 0, false, "", leftovers},
+		{"disabled, remove", 0, true, "", []string{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			options := newMemoryOptions(t, append([]string{complete, failed}, leftovers...)...)
+			options.resumeMaxAge = test.resumeMaxAge
+			options.removeLeftover = test.removeLeftover
+
+			if resumed := FindResumableBackup(options); resumed != test.expected {
+				t.Errorf("FindResumableBackup = %q, expected %q", resumed, test.expected)
+			}
+
+			folders, err := options.Target().ListFolders(options.TargetPath())
+			if err != nil {
+				t.Fatal(err)
+			}
+			remaining := []string{}
+			for _, folder := range folders {
+				if matches := LeftoverFolderNameRegex.FindStringSubmatch(folder); matches != nil && matches[2] == "progress" {
+					remaining = append(remaining, folder)
+				}
+			}
+			expected := append([]string{}, test.remaining...)
+			sort.Strings(expected)
+			if !reflect.DeepEqual(remaining, expected) {
+				t.Errorf("left %v, expected %v", remaining, expected)
+			}
+			// Complete and failed backups are never touched
+			if len(folders) != len(remaining)+2 {
+				t.Errorf("removed other backups: %v", folders)
+			}
+		})
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// cronParser is the parser used for all cron expressions
+var cronParser = cron.NewParser(cron.SecondOptional | cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor)
+
+// RunDaemon schedules each of the passed profiles according to its own cron expression and
+// blocks until SIGINT/SIGTERM is received. Profiles may run concurrently; each run gets its
+// own logger, so logs and reports never mix.
+func RunDaemon(optionsList []*Options) error {
+	cronLogger := cron.PrintfLogger(log.New(os.Stderr, "cron: ", log.LstdFlags|log.Lmsgprefix))
+	c := cron.New(
+		cron.WithParser(cronParser),
+		cron.WithLogger(cronLogger),
+	)
+
+	entryIDs := map[*Options]cron.EntryID{}
+
+	for _, options := range optionsList {
+		options := options
+
+		// A job wrapper per profile; DelayIfStillRunning is applied per job, so a long-running
+		// profile delays its own next run, but not those of other profiles.
+		job := cron.NewChain(
+			cron.Recover(cronLogger),
+			cron.DelayIfStillRunning(cronLogger),
+		).Then(cron.FuncJob(func() {
+			options.log = NewLogger(options.LogOutput(), options.Verbose, options.profileName)
+			run(options)
+			options.log.Info.Printf("Next execution: %s", c.Entry(entryIDs[options]).Next)
+
+			if options.ReportOptions.jsonPath != "" {
+				WriteRunReport(options)
+			}
+			SendWebhooks(options)
+			if options.ReportOptions.enabled {
+				SendReport(options)
+			}
+		}))
+
+		entryID, err := c.AddJob(options.CronSpec(), job)
+		if err != nil {
+			return fmt.Errorf("profile %s: error adding cron job: %v", options.profileName, err)
+		}
+		entryIDs[options] = entryID
+	}
+
+	c.Start()
+	printSchedule(optionsList, c, entryIDs)
+
+	// Wait indefinitely while listening for SIGINT/SIGTERM
+	exitSignal := make(chan os.Signal, 1)
+	signal.Notify(exitSignal, syscall.SIGINT, syscall.SIGTERM)
+	<-exitSignal
+
+	Log.Info.Println("Received signal, waiting for running profiles to finish")
+	<-c.Stop().Done()
+
+	return nil
+}
+
+// printSchedule prints a table of all scheduled profiles and their next execution
+func printSchedule(optionsList []*Options, c *cron.Cron, entryIDs map[*Options]cron.EntryID) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PROFILE\tSCHEDULE\tTIMEZONE\tNEXT RUN")
+	for _, options := range optionsList {
+		location := time.Local
+		if options.timezone != "" {
+			// Already validated in NewOptions
+			location, _ = time.LoadLocation(options.timezone)
+		}
+		next := c.Entry(entryIDs[options]).Next.In(location)
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", options.profileName, options.cron, location, next)
+	}
+	w.Flush()
+}
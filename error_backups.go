@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// ListErrorBackups returns the names of the _error folders left behind by failed backups in
+// the main target folder, oldest first
+func ListErrorBackups(options *Options) []string {
+	folderNames, err := ListFoldersInPath(options, options.TargetPath())
+	if err != nil {
+		panic(fmt.Sprintf("ListErrorBackups: %v", err))
+	}
+
+	errorBackups := []string{}
+	for _, folderName := range folderNames {
+		if matches := LeftoverFolderNameRegex.FindStringSubmatch(folderName); matches != nil && matches[2] == "error" {
+			errorBackups = append(errorBackups, folderName)
+		}
+	}
+	// Backup names sort chronologically
+	sort.Strings(errorBackups)
+
+	return errorBackups
+}
+
+// ErrorBackupTime returns the time of the failed backup with the passed _error folder name
+func ErrorBackupTime(folderName string) time.Time {
+	matches := LeftoverFolderNameRegex.FindStringSubmatch(folderName)
+	if matches == nil {
+		panic(fmt.Sprintf("ErrorBackupTime: %s is not the folder of a failed backup", folderName))
+	}
+
+	backupTime, err := BackupNameToTime(matches[1])
+	if err != nil {
+		panic(fmt.Sprintf("ErrorBackupTime: error parsing backup folder %s into time: %v", folderName, err))
+	}
+
+	return backupTime
+}
+
+// PlanErrorBackups plans deleting the _error folders of failed backups that exceed the count
+// limit maxError or are older than maxErrorAge. Unlike regular backups, exceeding either limit
+// is enough. A limit of 0 disables it.
+func PlanErrorBackups(options *Options, plan *RotationPlan) {
+	options.log.Debug.Printf("> Handling failed backups (> %d, older than %s)", options.maxError, FormatDuration(options.maxErrorAge))
+
+	errorBackups := ListErrorBackups(options)
+
+	excessCount := 0
+	if options.maxError > 0 && uint(len(errorBackups)) > options.maxError {
+		excessCount = len(errorBackups) - int(options.maxError)
+	}
+
+	for i, folderName := range errorBackups {
+		exceedsCount := i < excessCount
+		exceedsAge := options.maxErrorAge > 0 && BackupAge(ErrorBackupTime(folderName), plan.now) > options.maxErrorAge
+
+		var reason string
+		if exceedsCount && exceedsAge {
+			reason = fmt.Sprintf("failed backup, excess (> %d) and older than %s", options.maxError, FormatDuration(options.maxErrorAge))
+		} else if exceedsAge {
+			reason = fmt.Sprintf("failed backup, older than %s", FormatDuration(options.maxErrorAge))
+		} else if exceedsCount {
+			reason = fmt.Sprintf("failed backup, excess (> %d)", options.maxError)
+		} else {
+			continue
+		}
+
+		plan.Actions = append(plan.Actions, RotationAction{
+			Action: rotationActionDelete,
+			Backup: folderName,
+			From:   options.TargetRelativePath(options.TargetPath()),
+			Reason: reason,
+		})
+	}
+}
+
+// PruneErrorBackups deletes the _error folders of failed backups exceeding the configured
+// limits. It is used after a failed backup, when no rotation takes place.
+func PruneErrorBackups(options *Options) {
+	plan := &RotationPlan{backups: map[string][]string{}, now: time.Now()}
+	PlanErrorBackups(options, plan)
+
+	for _, action := range plan.Actions {
+		options.log.Info.Printf("  delete %s from %s: %s", action.Backup, action.From, action.Reason)
+	}
+	ExecuteRotationPlan(options, plan)
+
+	logErrorBackups(options)
+}
+
+// logErrorBackups logs the _error folders of failed backups remaining on the target, most
+// recent first
+func logErrorBackups(options *Options) {
+	errorBackups := ListErrorBackups(options)
+	if len(errorBackups) == 0 {
+		return
+	}
+
+	options.log.Info.Printf("Failed backups kept on target: %d", len(errorBackups))
+	for i := len(errorBackups) - 1; i >= 0; i-- {
+		options.log.Info.Printf("  %s (%s ago)", errorBackups[i], FormatAge(BackupAge(ErrorBackupTime(errorBackups[i]), time.Now())))
+	}
+}
+
+// DetermineLinkDestErrorBackup returns the most recent _error folder if it is more recent than
+// the last complete backup at lastBackupRelativePath, or an empty string otherwise. Files
+// transferred before the failure can then be hard linked instead of transferred again.
+func DetermineLinkDestErrorBackup(options *Options, lastBackupRelativePath string) string {
+	errorBackups := ListErrorBackups(options)
+	if len(errorBackups) == 0 {
+		return ""
+	}
+
+	errorBackup := errorBackups[len(errorBackups)-1]
+
+	if lastBackupRelativePath != "" {
+		lastBackupTime, err := BackupNameToTime(filepath.Base(lastBackupRelativePath))
+		if err != nil {
+			panic(fmt.Sprintf("DetermineLinkDestErrorBackup: error parsing backup folder %s into time: %v", lastBackupRelativePath, err))
+		}
+
+		if !ErrorBackupTime(errorBackup).After(lastBackupTime) {
+			options.log.Debug.Printf("DetermineLinkDestErrorBackup: %s is older than the last backup, not using it", errorBackup)
+			return ""
+		}
+	}
+
+	return errorBackup
+}
@@ -3,12 +3,15 @@ module rotating-rsync-backup
 go 1.14
 
 require (
+	github.com/BurntSushi/toml v0.3.1
 	github.com/Showmax/go-fqdn v1.0.0
 	github.com/alessio/shellescape v1.2.2
 	github.com/google/shlex v0.0.0-20191202100458-e7afc7fbc510
 	github.com/google/uuid v1.1.1
 	github.com/robfig/cron/v3 v3.0.1
 	github.com/urfave/cli/v2 v2.2.0
+	golang.org/x/crypto v0.0.0-20220722155217-630584e8d5aa
 	gopkg.in/alexcesaro/quotedprintable.v3 v3.0.0-20150716171945-2caba252f4dc // indirect
 	gopkg.in/gomail.v2 v2.0.0-20160411212932-81ebce5c23df
+	gopkg.in/yaml.v2 v2.4.0
 )
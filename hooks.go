@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Hook events, see --hook
+const (
+	hookPreBackup    = "pre-backup"
+	hookPostBackup   = "post-backup"
+	hookOnSuccess    = "on-success"
+	hookOnFailure    = "on-failure"
+	hookPostRotation = "post-rotation"
+)
+
+// hookEvents lists all hook events in the order they occur during a run
+var hookEvents = []string{hookPreBackup, hookPostBackup, hookPostRotation, hookOnSuccess, hookOnFailure}
+
+// Hook is a shell command run at a certain point of a run
+type Hook struct {
+	// Event is the point of the run the hook is run at, see the hook* constants
+	Event   string
+	Command string
+	// OnTarget runs the command on the target host instead of locally. For local targets,
+	// both are the same.
+	OnTarget bool
+	// Timeout is the time after which the command is killed; 0 means no timeout
+	Timeout time.Duration
+	// Fatal hooks fail the run if the command fails; failures of other hooks are only warned
+	// about
+	Fatal bool
+}
+
+func (hook Hook) String() string {
+	location := "local"
+	if hook.OnTarget {
+		location = "target"
+	}
+	severity := "advisory"
+	if hook.Fatal {
+		severity = "fatal"
+	}
+
+	return fmt.Sprintf("%s,%s,timeout=%s,%s:%s", hook.Event, location, FormatDuration(hook.Timeout), severity, hook.Command)
+}
+
+// ParseHook parses a hook definition of the form <event>[,<option>...]:<command>, e.g.
+// "pre-backup,target,timeout=10m:pg_dumpall > /srv/dump.sql". Options are local or target,
+// fatal or advisory, and timeout=<duration>. Hooks time out after defaultTimeout unless
+// specified otherwise; pre-backup hooks are fatal unless specified otherwise, all others are
+// advisory.
+func ParseHook(definition string, defaultTimeout time.Duration) (Hook, error) {
+	separator := strings.Index(definition, ":")
+	if separator < 0 || strings.TrimSpace(definition[separator+1:]) == "" {
+		return Hook{}, fmt.Errorf("invalid hook %q: expected <event>[,<option>...]:<command>", definition)
+	}
+
+	specification := strings.Split(definition[:separator], ",")
+	hook := Hook{
+		Event:   strings.TrimSpace(specification[0]),
+		Command: strings.TrimSpace(definition[separator+1:]),
+		Timeout: defaultTimeout,
+	}
+
+	validEvent := false
+	for _, event := range hookEvents {
+		validEvent = validEvent || hook.Event == event
+	}
+	if !validEvent {
+		return Hook{}, fmt.Errorf("invalid hook %q: unknown event %q, expected one of %s", definition, hook.Event, strings.Join(hookEvents, ", "))
+	}
+	hook.Fatal = hook.Event == hookPreBackup
+
+	for _, option := range specification[1:] {
+		option = strings.TrimSpace(option)
+
+		switch {
+		case option == "local":
+			hook.OnTarget = false
+		case option == "target":
+			hook.OnTarget = true
+		case option == "fatal":
+			hook.Fatal = true
+		case option == "advisory":
+			hook.Fatal = false
+		case strings.HasPrefix(option, "timeout="):
+			timeout, err := ParseDuration(strings.TrimPrefix(option, "timeout="))
+			if err != nil {
+				return Hook{}, fmt.Errorf("invalid hook %q: %v", definition, err)
+			}
+			hook.Timeout = timeout
+		default:
+			return Hook{}, fmt.Errorf("invalid hook %q: unknown option %q, expected local, target, fatal, advisory or timeout=<duration>", definition, option)
+		}
+	}
+
+	return hook, nil
+}
+
+// ParseHooks parses a list of hook definitions, see ParseHook
+func ParseHooks(definitions []string, defaultTimeout time.Duration) ([]Hook, error) {
+	hooks := []Hook{}
+
+	for _, definition := range definitions {
+		hook, err := ParseHook(definition, defaultTimeout)
+		if err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, hook)
+	}
+
+	return hooks, nil
+}
+
+// hookState holds the values passed to hooks that are only known during a run
+type hookState struct {
+	// backupName is the name of the backup created by the run, if any
+	backupName string
+	// rsyncExitCode is rsync's exit code, once rsync has run
+	rsyncExitCode *int
+	// err is the error the run failed with, for on-failure hooks
+	err string
+}
+
+// hookEnv returns the environment variables passed to hooks of the passed event
+func hookEnv(options *Options, event string) []string {
+	env := []string{
+		"RRB_HOOK=" + event,
+		"RRB_PROFILE=" + options.profileName,
+		"RRB_TARGET_PATH=" + options.TargetPath(),
+		"RRB_TARGET_HOST=" + options.targetHost,
+		"RRB_LOG_LEVEL=" + options.ReportLogLevel(),
+	}
+
+	if options.targetName != "" {
+		env = append(env, "RRB_TARGET_NAME="+options.targetName)
+	}
+	if options.hookState.backupName != "" {
+		env = append(
+			env,
+			"RRB_BACKUP_NAME="+options.hookState.backupName,
+			"RRB_BACKUP_PATH="+filepath.Join(options.TargetPath(), options.hookState.backupName),
+		)
+	}
+	if options.hookState.rsyncExitCode != nil {
+		env = append(env, fmt.Sprintf("RRB_RSYNC_EXIT_CODE=%d", *options.hookState.rsyncExitCode))
+	}
+	if options.hookState.err != "" {
+		env = append(env, "RRB_ERROR="+options.hookState.err)
+	}
+
+	return env
+}
+
+// RunHooks runs all hooks of the passed event in order. Their output goes into the log.
+// Failures of advisory hooks are logged as warnings; the first failing fatal hook stops
+// running further hooks and its error is returned.
+func RunHooks(options *Options, event string) error {
+	for _, hook := range options.hooks {
+		if hook.Event != event {
+			continue
+		}
+
+		target := Target(&LocalTarget{})
+		if hook.OnTarget {
+			target = options.Target()
+		}
+
+		options.log.Info.Printf("Running %s hook on %s: %s", event, target, hook.Command)
+		start := time.Now()
+
+		exitCode, err := target.Exec(hook.Command, hookEnv(options, event), hook.Timeout, "hook "+event, options.log.Info)
+		if err == nil {
+			options.log.Info.Printf("%s hook finished after %s", event, time.Since(start).Round(100*time.Millisecond))
+			continue
+		}
+
+		if exitCode > 0 {
+			err = fmt.Errorf("exit code %d", exitCode)
+		}
+
+		if !hook.Fatal {
+			options.log.Warn.Printf("%s hook failed: %s: %v", event, hook.Command, err)
+			continue
+		}
+
+		return fmt.Errorf("%s hook failed: %s: %v", event, hook.Command, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseHook(t *testing.T) {
+	defaultTimeout := 10 * time.Minute
+
+	tests := []struct {
+		definition string
+		expected   Hook
+		err        bool
+	}{
+		{
+			"pre-backup:pg_dumpall > /srv/dump.sql",
+			Hook{Event: hookPreBackup, Command: "pg_dumpall > /srv/dump.sql", Timeout: defaultTimeout, Fatal: true},
+			false,
+		},
+		{
+			"post-backup:echo done",
+			Hook{Event: hookPostBackup, Command: "echo done", Timeout: defaultTimeout},
+			false,
+		},
+		{
+			"pre-backup,target,advisory,timeout=30m:sync",
+			Hook{Event: hookPreBackup, Command: "sync", OnTarget: true, Timeout: 30 * time.Minute},
+			false,
+		},
+		{
+			"on-failure, fatal , local:echo a:b",
+			Hook{Event: hookOnFailure, Command: "echo a:b", Timeout: defaultTimeout, Fatal: true},
+			false,
+		},
+		{"pre-backup", Hook{}, true},
+		{"pre-backup:  ", Hook{}, true},
+		{"before-backup:true", Hook{}, true},
+		{"post-rotation,remote:true", Hook{}, true},
+		{"post-rotation,timeout=-1m:true", Hook{}, true},
+	}
+
+	for _, test := range tests {
+		hook, err := ParseHook(test.definition, defaultTimeout)
+		if test.err {
+			if err == nil {
+				t.Errorf("ParseHook(%q) = %s, expected an error", test.definition, hook)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseHook(%q): unexpected error: %v", test.definition, err)
+		} else if hook != test.expected {
+			t.Errorf("ParseHook(%q) = %s, expected %s", test.definition, hook, test.expected)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+// Backup states as shown by the list command
+const (
+	backupStateComplete = "complete"
+	backupStateProgress = "progress"
+	backupStateError    = "error"
+)
+
+// BackupListEntry describes a single backup folder on the target, or the leftover folder of
+// an interrupted or failed backup
+type BackupListEntry struct {
+	Profile string `json:"profile"`
+	// Target is the name of the target the backup is on, for profiles with several targets
+	Target     string    `json:"target,omitempty"`
+	Tier       string    `json:"tier"`
+	Name       string    `json:"name"`
+	Path       string    `json:"path"`
+	Time       time.Time `json:"time"`
+	AgeSeconds int64     `json:"ageSeconds"`
+	Latest     bool      `json:"latest"`
+	State      string    `json:"state"`
+	// Pin is set if the backup is pinned, see pins.go
+	Pin *Pin `json:"pin,omitempty"`
+	// Metadata describes how the backup was created, if it was created by a version of this
+	// tool storing it, see metadata.go
+	Metadata *BackupMetadata `json:"metadata,omitempty"`
+}
+
+// ListBackups returns all backups in all tiers of the target, as well as leftover
+// _progress/_error folders, ordered by tier and then by time (most recent first)
+func ListBackups(options *Options) ([]BackupListEntry, error) {
+	type tierFolder struct {
+		name string
+		path string
+	}
+
+	tiers := []tierFolder{{"main", options.TargetPath()}}
+	for _, tier := range options.tiers {
+		tiers = append(tiers, tierFolder{tier.Name(), options.TierFolderPath(tier)})
+	}
+
+	now := time.Now()
+	entries := []BackupListEntry{}
+
+	pins, err := LoadPins(options)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, tier := range tiers {
+		// Tier folders are created by the first backup or rotation after they were enabled
+		if i > 0 {
+			stat, err := options.Target().Stat(tier.path)
+			if err != nil {
+				return nil, err
+			} else if !stat.Exists {
+				continue
+			}
+		}
+
+		folderNames, err := ListFoldersInPath(options, tier.path)
+		if err != nil {
+			return nil, err
+		}
+		latest := ReadLatestSymlink(options, tier.path)
+
+		tierEntries := []BackupListEntry{}
+		for _, folderName := range folderNames {
+			timeString := folderName
+			state := backupStateComplete
+
+			if matches := LeftoverFolderNameRegex.FindStringSubmatch(folderName); matches != nil {
+				timeString = matches[1]
+				state = matches[2]
+			} else if !BackupFolderNameRegex.MatchString(folderName) {
+				continue
+			}
+
+			backupTime, err := BackupNameToTime(timeString)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing backup folder %s into time: %v", folderName, err)
+			}
+
+			tierEntries = append(tierEntries, BackupListEntry{
+				Profile:    options.profileName,
+				Target:     options.targetName,
+				Tier:       tier.name,
+				Name:       folderName,
+				Path:       options.TargetRelativePath(filepath.Join(tier.path, folderName)),
+				Time:       backupTime,
+				AgeSeconds: int64(BackupAge(backupTime, now).Seconds()),
+				Latest:     state == backupStateComplete && folderName == latest,
+				State:      state,
+			})
+
+			if pin, ok := pins[folderName]; ok && state == backupStateComplete && pin.Active(now) {
+				tierEntries[len(tierEntries)-1].Pin = &pin
+			}
+		}
+
+		sort.SliceStable(tierEntries, func(i, j int) bool {
+			return tierEntries[i].Time.After(tierEntries[j].Time)
+		})
+		entries = append(entries, tierEntries...)
+	}
+
+	return entries, nil
+}
+
+// ReadBackupListMetadata reads the metadata of the complete and failed backups in entries,
+// which were listed by ListBackups. It is not part of ListBackups, as it reads a file for
+// every backup. Backups whose metadata cannot be read are listed without it, with a warning.
+func ReadBackupListMetadata(options *Options, entries []BackupListEntry) {
+	for i, entry := range entries {
+		if entry.State == backupStateProgress {
+			continue
+		}
+
+		metadata, err := ReadBackupMetadata(options, filepath.Join(options.TargetPath(), entry.Path))
+		if err != nil {
+			options.log.Warn.Printf("Could not read metadata of backup %s: %v", entry.Path, err)
+			continue
+		}
+		entries[i].Metadata = metadata
+	}
+}
+
+// listCommand implements the "list" command
+func listCommand(c *cli.Context) (err error) {
+	defer recoverError(&err)
+
+	format := c.String("format")
+	if format != "table" && format != "json" {
+		return fmt.Errorf("--format: must be one of table, json")
+	}
+
+	optionsList, err := commandProfiles(c)
+	if err != nil {
+		return err
+	}
+	defer closeTargets(optionsList)
+
+	entries := []BackupListEntry{}
+	multipleTargets := false
+	for _, options := range optionsList {
+		targetOptionsList := options.TargetOptions()
+		defer closeTargets(targetOptionsList)
+		multipleTargets = multipleTargets || len(targetOptionsList) > 1
+
+		for _, targetOptions := range targetOptionsList {
+			targetEntries, err := ListBackups(targetOptions)
+			if err != nil {
+				return fmt.Errorf("profile %s: %v", targetOptions.ProfileDescription(), err)
+			}
+			ReadBackupListMetadata(targetOptions, targetEntries)
+			entries = append(entries, targetEntries...)
+		}
+	}
+
+	if format == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(entries)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	if multipleTargets {
+		fmt.Fprintln(w, "PROFILE\tTARGET\tTIER\tNAME\tAGE\tLATEST\tSTATE\tDURATION\tPINNED")
+	} else {
+		fmt.Fprintln(w, "PROFILE\tTIER\tNAME\tAGE\tLATEST\tSTATE\tDURATION\tPINNED")
+	}
+	for _, entry := range entries {
+		latest := ""
+		if entry.Latest {
+			latest = "*"
+		}
+		pinned := ""
+		if entry.Pin != nil {
+			pinned = entry.Pin.Describe()
+		}
+		duration := ""
+		if entry.Metadata != nil {
+			duration = FormatDuration(time.Duration(entry.Metadata.DurationSeconds) * time.Second)
+		}
+		profile := entry.Profile
+		if multipleTargets {
+			profile += "\t" + entry.Target
+		}
+		fmt.Fprintf(
+			w,
+			"%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			profile,
+			entry.Tier,
+			entry.Name,
+			FormatAge(time.Duration(entry.AgeSeconds)*time.Second),
+			latest,
+			entry.State,
+			duration,
+			pinned,
+		)
+	}
+
+	return w.Flush()
+}
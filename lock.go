@@ -0,0 +1,392 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// lockHeartbeatInterval is the interval in which lock holders refresh the heartbeat in their
+// lock, see heartbeatLock
+const lockHeartbeatInterval = time.Minute
+
+// lockOwnerFileName is the name of the file in a lock folder recording its holder
+const lockOwnerFileName = "owner.json"
+
+// lockPollInterval is the interval in which a held lock is retried while waiting for it
+const lockPollInterval = 5 * time.Second
+
+// LockInfo describes the holder of a target lock
+type LockInfo struct {
+	Profile   string    `json:"profile"`
+	User      string    `json:"user"`
+	Host      string    `json:"host"`
+	PID       int       `json:"pid"`
+	Acquired  time.Time `json:"acquired"`
+	Heartbeat time.Time `json:"heartbeat"`
+	// Flock is set if the holder also holds the flock on the lock file of a local target, see
+	// TryFlock
+	Flock bool `json:"flock,omitempty"`
+
+	// err is the reason the holder is unknown, if it could not be read, see readLockInfo
+	err error
+}
+
+// NewLockInfo returns the LockInfo describing the current process running the passed profile
+func NewLockInfo(options *Options) LockInfo {
+	now := time.Now()
+	info := LockInfo{
+		Profile:   options.profileName,
+		PID:       os.Getpid(),
+		Acquired:  now,
+		Heartbeat: now,
+	}
+
+	if currentUser, err := user.Current(); err == nil {
+		info.User = currentUser.Username
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		info.Host = hostname
+	}
+
+	return info
+}
+
+// Describe returns a description of the lock holder for log and error messages
+func (info LockInfo) Describe() string {
+	if info.PID == 0 {
+		if info.err != nil {
+			return fmt.Sprintf("unknown holder: %v", info.err)
+		}
+		return "unknown holder"
+	}
+
+	return fmt.Sprintf(
+		"profile %s, %s@%s, pid %d, since %s (last heartbeat %s ago)",
+		info.Profile,
+		info.User,
+		info.Host,
+		info.PID,
+		info.Acquired.Local().Format("2006-01-02 15:04:05"),
+		FormatAge(time.Since(info.Heartbeat)),
+	)
+}
+
+// IsStale returns true if the holder of the lock has evidently gone away: it ran on this host
+// and its process no longer exists, or its heartbeat is older than staleAfter (if set). The
+// heartbeat of unknown holders is the time their lock last changed, if known.
+func (info LockInfo) IsStale(staleAfter time.Duration, now time.Time) bool {
+	if info.PID == 0 {
+		return staleAfter > 0 && !info.Heartbeat.IsZero() && now.Sub(info.Heartbeat) > staleAfter
+	}
+
+	if hostname, err := os.Hostname(); err == nil && info.Host == hostname {
+		if err := syscall.Kill(info.PID, 0); err == syscall.ESRCH {
+			return true
+		}
+	}
+
+	return staleAfter > 0 && now.Sub(info.Heartbeat) > staleAfter
+}
+
+// TargetLock is a lock held on a target, see TryLockFolder
+type TargetLock interface {
+	// Release releases the lock
+	Release() error
+}
+
+// heartbeatLock is a lock folder on a target. The holder's info is written to ownerPath
+// inside it, and its heartbeat refreshed every lockHeartbeatInterval until the lock is
+// released, so locks of holders that crashed or lost their connection can be detected as
+// stale.
+type heartbeatLock struct {
+	options   *Options
+	target    Target
+	absPath   string
+	ownerPath string
+	info      LockInfo
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+// newHeartbeatLock returns a heartbeatLock for the lock folder at absPath. The caller writes
+// the info using writeInfo and starts the heartbeat once the lock is acquired.
+func newHeartbeatLock(options *Options, target Target, absPath string, ownerPath string, info LockInfo) *heartbeatLock {
+	return &heartbeatLock{
+		options:   options,
+		target:    target,
+		absPath:   absPath,
+		ownerPath: ownerPath,
+		info:      info,
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+}
+
+func (lock *heartbeatLock) writeInfo() error {
+	data, err := json.Marshal(lock.info)
+	if err != nil {
+		return err
+	}
+
+	return lock.target.WriteFile(lock.ownerPath, data)
+}
+
+// heartbeat refreshes the heartbeat in the lock until it is released
+func (lock *heartbeatLock) heartbeat() {
+	defer close(lock.done)
+
+	ticker := time.NewTicker(lockHeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-lock.stop:
+			return
+		case <-ticker.C:
+			lock.info.Heartbeat = time.Now()
+			if err := lock.writeInfo(); err != nil {
+				lock.options.log.Warn.Printf("Could not refresh lock %s: %v", lock.absPath, err)
+			}
+		}
+	}
+}
+
+func (lock *heartbeatLock) Release() error {
+	close(lock.stop)
+	<-lock.done
+
+	return lock.target.RemoveAll(lock.absPath)
+}
+
+// readLockInfo reads the holder's info written by a heartbeatLock to ownerPath, returning nil
+// if there is none
+func readLockInfo(target Target, ownerPath string) (*LockInfo, error) {
+	data, err := target.ReadFile(ownerPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	holder := &LockInfo{}
+	if err := json.Unmarshal(data, holder); err != nil {
+		return nil, fmt.Errorf("could not parse %s: %v", ownerPath, err)
+	}
+
+	return holder, nil
+}
+
+// lockHolder returns the holder of the lock folder at absPath. If its info has not been
+// written yet or cannot be read, the holder is unknown, with the time the lock folder last
+// changed as heartbeat: holders write their info and heartbeats by replacing the file.
+func lockHolder(target Target, absPath string, ownerPath string) *LockInfo {
+	holder, err := readLockInfo(target, ownerPath)
+	if err == nil && holder != nil {
+		return holder
+	}
+
+	holder = &LockInfo{err: err}
+	if stat, statErr := target.Stat(absPath); statErr == nil {
+		holder.Heartbeat = stat.ModTime
+	}
+
+	return holder
+}
+
+// TryLockFolder tries to acquire the lock folder at absPath on the target once, recording info
+// as the holder. Creating a folder is atomic (see Target.Mkdir), so only one of several runs
+// creating it at once succeeds. If the lock is held by someone else, a nil lock and the holder
+// are returned. Locks whose holder evidently went away (see LockInfo.IsStale) are broken, as
+// are locks of holders on this host that held the flock on the lock file if info holds it now:
+// the flock is released by the OS when its holder ends, however it ended.
+func TryLockFolder(options *Options, target Target, absPath string, info LockInfo, staleAfter time.Duration) (TargetLock, *LockInfo, error) {
+	ownerPath := filepath.Join(absPath, lockOwnerFileName)
+
+	for attempt := 0; attempt < 2; attempt++ {
+		err := target.Mkdir(absPath)
+		if err == nil {
+			lock := newHeartbeatLock(options, target, absPath, ownerPath, info)
+			if err := lock.writeInfo(); err != nil {
+				target.RemoveAll(absPath)
+				return nil, nil, err
+			}
+			go lock.heartbeat()
+
+			return lock, nil, nil
+		} else if !os.IsExist(err) {
+			return nil, nil, err
+		}
+
+		holder := lockHolder(target, absPath, ownerPath)
+		stale := holder.IsStale(staleAfter, time.Now()) || (info.Flock && holder.Flock && holder.Host == info.Host)
+
+		if attempt > 0 || !stale {
+			return nil, holder, nil
+		}
+
+		options.log.Warn.Printf("Breaking stale lock %s (%s)", absPath, holder.Describe())
+
+		// Move the stale lock out of the way first, so only one of several runs breaking it at
+		// the same time succeeds
+		stalePath := fmt.Sprintf("%s.stale.%d", absPath, time.Now().UnixNano())
+		if err := target.Rename(absPath, stalePath); err != nil {
+			return nil, holder, nil
+		}
+		if err := target.RemoveAll(stalePath); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return nil, nil, fmt.Errorf("could not acquire lock %s", absPath)
+}
+
+// LockFolderPath returns the full path to the lock folder in the target folder
+func (options *Options) LockFolderPath() string {
+	return filepath.Join(options.TargetPath(), LockFolderName)
+}
+
+// LockFilePath returns the full path to the lock file of local target folders, see TryFlock
+func (options *Options) LockFilePath() string {
+	return filepath.Join(options.TargetPath(), LockFileName)
+}
+
+// flockLock is an flock held on a lock file, see TryFlock
+type flockLock struct {
+	file *os.File
+}
+
+func (lock *flockLock) Release() error {
+	syscall.Flock(int(lock.file.Fd()), syscall.LOCK_UN)
+	return lock.file.Close()
+}
+
+// TryFlock tries to acquire an exclusive flock on the local file at absPath once, creating the
+// file if necessary. Returns a nil lock if another process holds it. The OS releases the lock
+// when the holding process ends, so it never goes stale.
+func TryFlock(absPath string) (*flockLock, error) {
+	file, err := os.OpenFile(absPath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		file.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return &flockLock{file: file}, nil
+}
+
+// targetLocks are several locks held on a target, released in reverse order
+type targetLocks []TargetLock
+
+func (locks targetLocks) Release() error {
+	var firstErr error
+	for i := len(locks) - 1; i >= 0; i-- {
+		if err := locks[i].Release(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+// tryLockTarget tries to acquire the lock on the target folder once, see TryLockFolder. Local
+// target folders are locked using TryFlock first, so runs on this host exclude each other even
+// if a lock folder is left behind by a run that was killed; the lock folder is still created,
+// since runs accessing the same folder over ssh or from other hosts (e.g. on an NFS mount)
+// only see that.
+func tryLockTarget(options *Options) (TargetLock, *LockInfo, error) {
+	info := NewLockInfo(options)
+
+	var fileLock *flockLock
+	if _, ok := options.Target().(*LocalTarget); ok {
+		var err error
+		if fileLock, err = TryFlock(options.LockFilePath()); err != nil {
+			return nil, nil, err
+		} else if fileLock == nil {
+			return nil, lockHolder(options.Target(), options.LockFolderPath(), filepath.Join(options.LockFolderPath(), lockOwnerFileName)), nil
+		}
+		info.Flock = true
+	}
+
+	lock, holder, err := TryLockFolder(options, options.Target(), options.LockFolderPath(), info, options.lockStaleAfter)
+	if fileLock == nil {
+		return lock, holder, err
+	}
+	if lock == nil {
+		fileLock.Release()
+		return nil, holder, err
+	}
+
+	return targetLocks{fileLock, lock}, nil, nil
+}
+
+// AcquireTargetLock acquires the lock on the target folder, waiting up to the configured
+// lock timeout if it is held by another run. The lock is released by ReleaseTargetLock.
+// Targets that cannot create folders atomically (see Target.Mkdir) are not locked, with a
+// warning.
+func AcquireTargetLock(options *Options) {
+	if options.targetLock != nil {
+		return
+	}
+
+	deadline := time.Now().Add(options.lockTimeout)
+	waiting := false
+
+	for {
+		lock, holder, err := tryLockTarget(options)
+		if err == errNotSupported {
+			options.log.Warn.Printf("Target %s cannot be locked, so other runs on the same target folder are not kept apart", options.Target())
+			return
+		} else if err != nil {
+			panic(fmt.Sprintf("AcquireTargetLock: could not lock target folder %s: %v", options.TargetPath(), err))
+		}
+
+		if lock != nil {
+			options.log.Debug.Printf("AcquireTargetLock: acquired lock %s", options.LockFolderPath())
+			options.targetLock = lock
+			return
+		}
+
+		if !time.Now().Before(deadline) {
+			if options.lockTimeout == 0 {
+				panic(fmt.Sprintf("Target folder %s is locked by another run (%s). Use --lock-timeout to wait for it.", options.TargetPath(), holder.Describe()))
+			}
+			panic(fmt.Sprintf("Target folder %s is locked by another run (%s). Gave up after waiting %s.", options.TargetPath(), holder.Describe(), FormatDuration(options.lockTimeout)))
+		}
+
+		if !waiting {
+			options.log.Info.Printf("Target folder is locked by another run (%s), waiting up to %s", holder.Describe(), FormatDuration(options.lockTimeout))
+			waiting = true
+		}
+
+		wait := lockPollInterval
+		if remaining := time.Until(deadline); remaining < wait {
+			wait = remaining
+		}
+		time.Sleep(wait)
+	}
+}
+
+// ReleaseTargetLock releases the lock acquired by AcquireTargetLock, if any
+func (options *Options) ReleaseTargetLock() {
+	if options.targetLock == nil {
+		return
+	}
+
+	if err := options.targetLock.Release(); err != nil {
+		options.log.Warn.Printf("Could not release lock %s: %v", options.LockFolderPath(), err)
+	} else {
+		options.log.Debug.Printf("ReleaseTargetLock: released lock %s", options.LockFolderPath())
+	}
+	options.targetLock = nil
+}
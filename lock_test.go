@@ -0,0 +1,161 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newLocalOptions returns Options for a new local target folder, removed when the test ends
+func newLocalOptions(t *testing.T) *Options {
+	folder, err := ioutil.TempDir("", "target")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(folder) })
+
+	return &Options{
+		profileName:    "test",
+		target:         folder,
+		log:            NewLogger(ioutil.Discard, false, ""),
+		lockStaleAfter: 15 * time.Minute,
+	}
+}
+
+// writeLockFolder creates the lock folder of options' target with the passed owner file content
+func writeLockFolder(t *testing.T, options *Options, owner string) {
+	if err := options.Target().Mkdir(options.LockFolderPath()); err != nil {
+		t.Fatal(err)
+	}
+	if err := options.Target().WriteFile(filepath.Join(options.LockFolderPath(), lockOwnerFileName), []byte(owner)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLockInfoIsStale(t *testing.T) {
+	now := time.Now()
+	hostname, _ := os.Hostname()
+
+	tests := []struct {
+		name  string
+		info  LockInfo
+		stale bool
+	}{
+		{"recent heartbeat", LockInfo{PID: 1, Host: "other", Heartbeat: now.Add(-time.Minute)}, false},
+		{"old heartbeat", LockInfo{PID: 1, Host: "other", Heartbeat: now.Add(-time.Hour)}, true},
+		{"process alive on this host", LockInfo{PID: os.Getpid(), Host: hostname, Heartbeat: now}, false},
+		{"unknown holder", LockInfo{}, false},
+		{"unknown holder, recently changed", LockInfo{Heartbeat: now.Add(-time.Minute)}, false},
+		{"unknown holder, long unchanged", LockInfo{Heartbeat: now.Add(-time.Hour)}, true},
+	}
+
+	for _, test := range tests {
+		if stale := test.info.IsStale(15*time.Minute, now); stale != test.stale {
+			t.Errorf("%s: IsStale = %t, expected %t", test.name, stale, test.stale)
+		}
+	}
+}
+
+func TestTryLockFolder(t *testing.T) {
+	options := newMemoryOptions(t)
+	info := NewLockInfo(options)
+
+	lock, holder, err := TryLockFolder(options, options.Target(), options.LockFolderPath(), info, time.Minute)
+	if err != nil || lock == nil {
+		t.Fatalf("TryLockFolder = %v, %v, %v, expected a lock", lock, holder, err)
+	}
+
+	other := info
+	other.PID++
+	if otherLock, holder, err := TryLockFolder(options, options.Target(), options.LockFolderPath(), other, time.Minute); err != nil || otherLock != nil {
+		t.Errorf("second TryLockFolder = %v, %v, expected no lock", otherLock, err)
+	} else if holder == nil || holder.PID != info.PID {
+		t.Errorf("second TryLockFolder returned holder %+v, expected %+v", holder, info)
+	}
+
+	if err := lock.Release(); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	if lock, _, err := TryLockFolder(options, options.Target(), options.LockFolderPath(), other, time.Minute); err != nil || lock == nil {
+		t.Errorf("TryLockFolder after Release = %v, %v, expected a lock", lock, err)
+	} else {
+		lock.Release()
+	}
+}
+
+func TestTryLockFolderStaleHolders(t *testing.T) {
+	hostname, _ := os.Hostname()
+
+	tests := []struct {
+		name  string
+		owner string
+		// age is how long ago the lock folder last changed
+		age    time.Duration
+		broken bool
+		holder string
+	}{
+		{"old heartbeat", `{"pid": 1, "host": "other", "heartbeat": "2000-01-01T00:00:00Z"}`, 0, true, ""},
+		{"recent heartbeat", `{"pid": 1, "host": "other", "heartbeat": "` + time.Now().Format(time.RFC3339) + `"}`, 0, false, "pid 1"},
+		{"flock holder on this host", `{"pid": 1, "host": "` + hostname + `", "heartbeat": "` + time.Now().Format(time.RFC3339) + `", "flock": true}`, 0, true, ""},
+		{"corrupt owner, recently changed", `{"pid": 1, "ho`, 0, false, "unknown holder: could not parse"},
+		{"corrupt owner, long unchanged", `{"pid": 1, "ho`, time.Hour, true, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			options := newLocalOptions(t)
+			writeLockFolder(t, options, test.owner)
+			if test.age > 0 {
+				changed := time.Now().Add(-test.age)
+				if err := os.Chtimes(options.LockFolderPath(), changed, changed); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			lock, holder, err := tryLockTarget(options)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if lock != nil {
+				defer lock.Release()
+			}
+
+			if broken := lock != nil; broken != test.broken {
+				t.Errorf("lock broken: %t, expected %t (holder %+v)", broken, test.broken, holder)
+			}
+			if !test.broken && (holder == nil || !strings.Contains(holder.Describe(), test.holder)) {
+				t.Errorf("got holder %+v, expected it to contain %q", holder, test.holder)
+			}
+		})
+	}
+}
+
+func TestTryLockTargetFlock(t *testing.T) {
+	options := newLocalOptions(t)
+
+	lock, _, err := tryLockTarget(options)
+	if err != nil || lock == nil {
+		t.Fatalf("tryLockTarget = %v, %v, expected a lock", lock, err)
+	}
+
+	// A second run on this host is kept out by the flock alone, even if the lock folder is
+	// gone
+	if err := os.RemoveAll(options.LockFolderPath()); err != nil {
+		t.Fatal(err)
+	}
+	if otherLock, _, err := tryLockTarget(options); err != nil || otherLock != nil {
+		t.Errorf("second tryLockTarget = %v, %v, expected no lock", otherLock, err)
+	}
+
+	if err := lock.Release(); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	if lock, _, err := tryLockTarget(options); err != nil || lock == nil {
+		t.Errorf("tryLockTarget after Release = %v, %v, expected a lock", lock, err)
+	} else {
+		lock.Release()
+	}
+}
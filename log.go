@@ -2,69 +2,134 @@ package main
 
 import (
 	"bytes"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"os"
+	"strings"
+	"sync"
+	"time"
 )
 
-// logger is the logger struct
+// logTimeFormat is the format of the time at the start of each log line, see log.LstdFlags
+const logTimeFormat = "2006/01/02 15:04:05"
+
+// LogMessage is a message logged with a level of WARN or above, see Problems
+type LogMessage struct {
+	Time    time.Time `json:"time"`
+	Level   string    `json:"level"`
+	Message string    `json:"message"`
+}
+
+// logger is the logger struct. Apart from printing to stdout, it keeps the full log as well
+// as one buffer per log level, used to build reports.
 type logger struct {
 	Debug *log.Logger
 	Info  *log.Logger
 	Warn  *log.Logger
 	Error *log.Logger
 	Fatal *log.Logger
-}
 
-// Log is the global logger
-var Log logger
+	// out, debug and tag are the arguments the logger was created with, see Child
+	out   io.Writer
+	debug bool
+	tag   string
+	// parent is the logger this logger was created from by Child, if any
+	parent *logger
+
+	// mutex guards all buffers, which are written to from several loggers (and possibly
+	// goroutines) at once
+	mutex    sync.Mutex
+	logBuf   bytes.Buffer
+	debugBuf bytes.Buffer
+	infoBuf  bytes.Buffer
+	warnBuf  bytes.Buffer
+	errorBuf bytes.Buffer
+	fatalBuf bytes.Buffer
+	// problems are the messages logged with a level of WARN or above, see Problems
+	problems []LogMessage
+}
 
-var logBuf bytes.Buffer
-var debugBuf bytes.Buffer
-var infoBuf bytes.Buffer
-var warnBuf bytes.Buffer
-var errorBuf bytes.Buffer
-var fatalBuf bytes.Buffer
+// Log is the global logger, used for everything that happens outside of profile runs. Each
+// profile run uses its own logger, see Options.log.
+var Log = NewLogger(os.Stdout, false, "")
 
 // InitLogger must be called once to initialize the global logger
 func InitLogger(debug bool) {
-	mw := io.MultiWriter(os.Stdout, &logBuf)
+	Log = NewLogger(os.Stdout, debug, "")
+}
+
+// NewLogger creates a new logger printing to out. If tag is not empty, it is included in every
+// line; this is used to tell apart the output of profiles running concurrently.
+func NewLogger(out io.Writer, debug bool, tag string) *logger {
+	_log := &logger{out: out, debug: debug, tag: tag}
+
+	prefix := func(level string) string {
+		if tag == "" {
+			return level + " "
+		}
+		return fmt.Sprintf("%s [%s] ", level, tag)
+	}
+
+	mw := io.MultiWriter(out, &lockedWriter{&_log.mutex, &_log.logBuf})
 
 	if debug {
-		Log.Debug = log.New(io.MultiWriter(mw, &debugBuf), "DEBUG ", log.LstdFlags|log.Lmsgprefix)
+		_log.Debug = log.New(io.MultiWriter(mw, &lockedWriter{&_log.mutex, &_log.debugBuf}), prefix("DEBUG"), log.LstdFlags|log.Lmsgprefix)
 	} else {
-		Log.Debug = log.New(ioutil.Discard, "DEBUG ", log.LstdFlags|log.Lmsgprefix)
+		_log.Debug = log.New(ioutil.Discard, prefix("DEBUG"), log.LstdFlags|log.Lmsgprefix)
 	}
-	Log.Info = log.New(io.MultiWriter(mw, &infoBuf), " INFO ", log.LstdFlags|log.Lmsgprefix)
-	Log.Warn = log.New(io.MultiWriter(mw, &warnBuf), " WARN ", log.LstdFlags|log.Lmsgprefix)
-	Log.Error = log.New(io.MultiWriter(mw, &warnBuf), "ERROR ", log.LstdFlags|log.Lmsgprefix)
-	Log.Fatal = log.New(io.MultiWriter(mw, &fatalBuf), "FATAL ", log.LstdFlags|log.Lmsgprefix)
+	_log.Info = log.New(io.MultiWriter(mw, &lockedWriter{&_log.mutex, &_log.infoBuf}), prefix(" INFO"), log.LstdFlags|log.Lmsgprefix)
+	_log.Warn = log.New(io.MultiWriter(mw, &lockedWriter{&_log.mutex, &_log.warnBuf}, &problemWriter{_log, " WARN", prefix(" WARN")}), prefix(" WARN"), log.LstdFlags|log.Lmsgprefix)
+	_log.Error = log.New(io.MultiWriter(mw, &lockedWriter{&_log.mutex, &_log.errorBuf}, &problemWriter{_log, "ERROR", prefix("ERROR")}), prefix("ERROR"), log.LstdFlags|log.Lmsgprefix)
+	_log.Fatal = log.New(io.MultiWriter(mw, &lockedWriter{&_log.mutex, &_log.fatalBuf}, &problemWriter{_log, "FATAL", prefix("FATAL")}), prefix("FATAL"), log.LstdFlags|log.Lmsgprefix)
+
+	return _log
+}
+
+// Child returns a logger for a part of the run, such as one of several targets, tagged with
+// tag in addition to this logger's tag. Its lines are part of this logger's full log and its
+// Problems, but do not count towards its MaxLogLevel.
+func (_log *logger) Child(tag string) *logger {
+	if _log.tag != "" {
+		tag = _log.tag + "/" + tag
+	}
+
+	child := NewLogger(io.MultiWriter(_log.out, &lockedWriter{&_log.mutex, &_log.logBuf}), _log.debug, tag)
+	child.parent = _log
+	return child
 }
 
 func (_log *logger) String() string {
-	// Reading the log as string will set its offset - to prepare for "someone else"
-	// reading it, we reset it and write the string again
-	// Log content for a typical run will be at most a few MB, should be pretty fast.
-	// There's probably a better way to do this. Once it is known, we can switch.
-	logContent := logBuf.String()
-	logBuf.Reset()
-	logBuf.WriteString(logContent)
-
-	return logContent
+	_log.mutex.Lock()
+	defer _log.mutex.Unlock()
+
+	return _log.logBuf.String()
 }
 
 func (_log *logger) Reset() {
-	logBuf.Reset()
+	_log.mutex.Lock()
+	defer _log.mutex.Unlock()
+
+	_log.logBuf.Reset()
+	_log.debugBuf.Reset()
+	_log.infoBuf.Reset()
+	_log.warnBuf.Reset()
+	_log.errorBuf.Reset()
+	_log.fatalBuf.Reset()
+	_log.problems = nil
 }
 
 func (_log *logger) MaxLogLevel() string {
+	_log.mutex.Lock()
+	defer _log.mutex.Unlock()
+
 	var logLevel string
-	if fatalBuf.Len() > 0 {
+	if _log.fatalBuf.Len() > 0 {
 		logLevel = "FATAL"
-	} else if errorBuf.Len() > 0 {
+	} else if _log.errorBuf.Len() > 0 {
 		logLevel = "ERROR"
-	} else if warnBuf.Len() > 0 {
+	} else if _log.warnBuf.Len() > 0 {
 		logLevel = "WARN"
 	} else {
 		logLevel = "INFO"
@@ -72,3 +137,55 @@ func (_log *logger) MaxLogLevel() string {
 
 	return logLevel
 }
+
+// Problems returns the warnings and errors logged, including those of child loggers, in the
+// order they were logged
+func (_log *logger) Problems() []LogMessage {
+	_log.mutex.Lock()
+	defer _log.mutex.Unlock()
+
+	return append([]LogMessage{}, _log.problems...)
+}
+
+// addProblem records message for Problems of this logger and its parents
+func (_log *logger) addProblem(message LogMessage) {
+	_log.mutex.Lock()
+	_log.problems = append(_log.problems, message)
+	_log.mutex.Unlock()
+
+	if _log.parent != nil {
+		_log.parent.addProblem(message)
+	}
+}
+
+// problemWriter records each message written by the logger of level as a LogMessage of
+// logger. log.Logger writes each message at once, starting with the time, a space and prefix
+// (the level and the tag, if any), which are left out of the LogMessage.
+type problemWriter struct {
+	logger *logger
+	level  string
+	prefix string
+}
+
+func (w *problemWriter) Write(p []byte) (int, error) {
+	message := strings.TrimSuffix(string(p), "\n")
+	if prefixLength := len(logTimeFormat) + 1 + len(w.prefix); len(message) >= prefixLength {
+		message = message[prefixLength:]
+	}
+
+	w.logger.addProblem(LogMessage{Time: time.Now(), Level: strings.TrimSpace(w.level), Message: message})
+	return len(p), nil
+}
+
+// lockedWriter serializes writes to an underlying writer using a shared mutex
+type lockedWriter struct {
+	mutex  *sync.Mutex
+	writer io.Writer
+}
+
+func (w *lockedWriter) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	return w.writer.Write(p)
+}
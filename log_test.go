@@ -0,0 +1,58 @@
+package main
+
+import (
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+func TestLoggerProblems(t *testing.T) {
+	tests := []struct {
+		name string
+		tag  string
+	}{
+		{"untagged", ""},
+		{"tagged", "www"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_log := NewLogger(ioutil.Discard, false, test.tag)
+			child := _log.Child("offsite")
+
+			_log.Info.Printf("not a problem")
+			_log.Warn.Printf("disk almost full")
+			child.Error.Printf("could not connect:\nconnection refused")
+			// Problems of children do not count towards the level of their parent
+			if level := _log.MaxLogLevel(); level != "WARN" {
+				t.Errorf("got level %s, expected WARN", level)
+			}
+			_log.Fatal.Printf("giving up")
+
+			expected := []LogMessage{
+				{Level: "WARN", Message: "disk almost full"},
+				{Level: "ERROR", Message: "could not connect:\nconnection refused"},
+				{Level: "FATAL", Message: "giving up"},
+			}
+			problems := _log.Problems()
+			for i := range problems {
+				if problems[i].Time.IsZero() {
+					t.Errorf("problem %d has no time", i)
+				}
+				problems[i].Time = expected[0].Time
+			}
+			if !reflect.DeepEqual(problems, expected) {
+				t.Errorf("got problems %+v, expected %+v", problems, expected)
+			}
+
+			if childProblems := child.Problems(); len(childProblems) != 1 || childProblems[0].Message != expected[1].Message {
+				t.Errorf("got child problems %+v", childProblems)
+			}
+
+			_log.Reset()
+			if problems := _log.Problems(); len(problems) != 0 {
+				t.Errorf("got problems %+v after Reset", problems)
+			}
+		})
+	}
+}
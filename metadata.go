@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+// backupMetadataVersion is the version of the format of MetadataFileName. Readers ignore
+// fields they do not know, so it only needs to change if the meaning of a field changes.
+const backupMetadataVersion = 1
+
+// rsyncVersionRegex matches the version in the first line of "rsync --version"
+var rsyncVersionRegex = regexp.MustCompile(`version\s+(\S+)`)
+
+// BackupMetadata records how a backup was created. It is stored next to the backup folder,
+// see WriteBackupMetadata, and moved along with it to other tiers.
+type BackupMetadata struct {
+	Version     int    `json:"version"`
+	ToolVersion string `json:"toolVersion"`
+	Profile     string `json:"profile"`
+	// Target is the name of the target, for profiles with several targets
+	Target  string   `json:"target,omitempty"`
+	Sources []string `json:"sources"`
+	// RsyncOptions are all options rsync was called with, without the sources and target
+	RsyncOptions []string `json:"rsyncOptions"`
+	// LinkDest are the backups rsync hard linked unchanged files to, relative to the target
+	// folder
+	LinkDest        []string    `json:"linkDest"`
+	RsyncVersion    string      `json:"rsyncVersion"`
+	Host            string      `json:"host"`
+	User            string      `json:"user"`
+	Started         time.Time   `json:"started"`
+	Finished        time.Time   `json:"finished"`
+	DurationSeconds float64     `json:"durationSeconds"`
+	ExitCode        int         `json:"exitCode"`
+	Stats           *RsyncStats `json:"stats,omitempty"`
+}
+
+// NewBackupMetadata returns the metadata for a backup of the profile started at the passed
+// time and created by calling rsync with rsyncOptions
+func NewBackupMetadata(options *Options, started time.Time, rsyncOptions []string) *BackupMetadata {
+	metadata := &BackupMetadata{
+		Version:      backupMetadataVersion,
+		ToolVersion:  appVersion,
+		Profile:      options.profileName,
+		Target:       options.targetName,
+		Sources:      []string{},
+		LinkDest:     []string{},
+		RsyncOptions: rsyncOptions,
+		RsyncVersion: rsyncVersion(options),
+		Started:      started,
+	}
+
+	for _, source := range options.sources {
+		metadata.Sources = append(metadata.Sources, source.String())
+	}
+	if currentUser, err := user.Current(); err == nil {
+		metadata.User = currentUser.Username
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		metadata.Host = hostname
+	}
+
+	return metadata
+}
+
+// Finish records the outcome of the rsync call
+func (metadata *BackupMetadata) Finish(exitCode int, stats *RsyncStats) {
+	metadata.Finished = time.Now()
+	metadata.DurationSeconds = metadata.Finished.Sub(metadata.Started).Seconds()
+	metadata.ExitCode = exitCode
+	metadata.Stats = stats
+}
+
+// Describe returns a one-line description of how the backup was created for logs and reports
+func (metadata BackupMetadata) Describe() string {
+	return fmt.Sprintf(
+		"created by %s@%s for profile %s, rsync %s exited with %d after %s",
+		metadata.User,
+		metadata.Host,
+		metadata.Profile,
+		metadata.RsyncVersion,
+		metadata.ExitCode,
+		time.Duration(metadata.DurationSeconds*float64(time.Second)).Round(100*time.Millisecond),
+	)
+}
+
+// rsyncVersion returns the version of the local rsync, or an empty string if it cannot be
+// determined
+func rsyncVersion(options *Options) string {
+	stdout, _, _, err := call(options, "rsync", []string{"--version"}, "rsync", options.log.Debug)
+	if err != nil || len(stdout) == 0 {
+		return ""
+	}
+
+	if matches := rsyncVersionRegex.FindStringSubmatch(stdout[0]); matches != nil {
+		return matches[1]
+	}
+	return ""
+}
+
+// BackupInfoFilePath returns the path of the file fileName holding information this tool
+// keeps about the backup at backupPath, e.g. "_daily/2026-10-16_22-00-00.metadata.json". The
+// files are kept next to the backup folder rather than inside it, so they neither clash with
+// nor add to the backed up data. MoveBackup and RemoveBackup take them along.
+func BackupInfoFilePath(backupPath string, fileName string) string {
+	return filepath.Clean(backupPath) + "." + fileName
+}
+
+// writeBackupInfoFile stores value as JSON in the file fileName next to the backup at
+// backupPath
+func writeBackupInfoFile(options *Options, backupPath string, fileName string, value interface{}) error {
+	data, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return options.Target().WriteFile(BackupInfoFilePath(backupPath, fileName), data)
+}
+
+// readBackupInfoFile reads the JSON file written by writeBackupInfoFile into value, returning
+// false if the backup has no such file, e.g. as it was created by an older version
+func readBackupInfoFile(options *Options, backupPath string, fileName string, value interface{}) (bool, error) {
+	data, err := options.Target().ReadFile(BackupInfoFilePath(backupPath, fileName))
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return true, json.Unmarshal(data, value)
+}
+
+// WriteBackupMetadata stores the metadata next to the backup at backupPath
+func WriteBackupMetadata(options *Options, backupPath string, metadata *BackupMetadata) error {
+	return writeBackupInfoFile(options, backupPath, MetadataFileName, metadata)
+}
+
+// ReadBackupMetadata reads the metadata stored next to the backup at backupPath, returning nil
+// if there is none
+func ReadBackupMetadata(options *Options, backupPath string) (*BackupMetadata, error) {
+	metadata := &BackupMetadata{}
+	found, err := readBackupInfoFile(options, backupPath, MetadataFileName, metadata)
+	if err != nil || !found {
+		return nil, err
+	}
+
+	return metadata, nil
+}
@@ -4,24 +4,77 @@ import (
 	"fmt"
 	"path/filepath"
 	"strings"
+	"time"
+
+	"github.com/google/shlex"
+	"github.com/urfave/cli/v2"
 )
 
 // Options is the main options struct
 type Options struct {
-	profileName   string
-	sources       []string
-	target        string
-	targetHost    string
-	targetUser    string
-	targetPort    uint
-	rsyncOptions  []string
-	sshOptions    []string
-	maxMain       uint
-	maxDaily      uint
-	maxWeekly     uint
-	maxMonthly    uint
-	ReportOptions ReportOptions
-	Verbose       bool
+	profileName     string
+	sources         []Source
+	target          string
+	targetHost      string
+	targetUser      string
+	targetPort      uint
+	targetDaemon    bool
+	targets         []TargetDefinition
+	parallelTargets bool
+	passwordFile    string
+	rsyncOptions    []string
+	sshOptions      []string
+	sshClient       string
+	maxMain         uint
+	maxMainAge      time.Duration
+	retentionMode   string
+	tiers           []Tier
+	maxError        uint
+	maxErrorAge     time.Duration
+	linkDestError   bool
+	lockTimeout     time.Duration
+	resumeMaxAge    time.Duration
+	removeLeftover  bool
+	lockStaleAfter  time.Duration
+	hookTimeout     time.Duration
+	hooks           []Hook
+	cron            string
+	timezone        string
+	ReportOptions   ReportOptions
+	WebhookOptions  WebhookOptions
+	Verbose         bool
+
+	// log is the logger for the current run of this profile
+	log *logger
+	// targetBackend is the Target implementation, see Target()
+	targetBackend Target
+	// targetLock is the lock held on the target folder, see AcquireTargetLock
+	targetLock TargetLock
+	// hookState holds the values passed to hooks during the current run, see RunHooks
+	hookState hookState
+	// rsyncStats are the transfer statistics of the backup created by the current run, if any
+	rsyncStats *RsyncStats
+	// changeSummary summarizes the changes in the backup created by the current run, if any
+	changeSummary *ChangeSummary
+	// backupMetadata describes the backup created by the current run, if any
+	backupMetadata *BackupMetadata
+	// rotationActions are the actions performed by the rotation of the current run
+	rotationActions []RotationAction
+	// inventory holds the backups in each tier after the current run, see BackupInventory
+	inventory map[string][]string
+	// freeSpace is the free space on the target after the current run, if known
+	freeSpace *uint64
+	// runID identifies the current run in the JSON report
+	runID string
+	// runStarted is the time the current run started
+	runStarted time.Time
+	// runPhases collects the phases of the current run, see phase
+	runPhases *runPhases
+	// targetName is the name of the target this is a copy of the profile's Options for, if the
+	// profile has several targets, see TargetOptions
+	targetName string
+	// targetStatuses holds the outcome of the current run for each target, see newTargetRuns
+	targetStatuses []*TargetStatus
 }
 
 // ReportOptions is the options struct for report mail-related options
@@ -34,13 +87,255 @@ type ReportOptions struct {
 	smtpUsername string
 	smtpPassword string
 	smtpInsecure bool
+	// policy decides which runs are reported, see SendReport
+	policy string
+	// stateDir is the folder the state for report policies is kept in, see
+	// ReportPolicyStatePath
+	stateDir string
+	// jsonPath is the file the JSON run report is written to, "-" for stdout, see
+	// WriteRunReport
+	jsonPath string
+}
+
+// optionSource is anything options can be read from: the command line or a profile in a
+// config file
+type optionSource interface {
+	String(name string) string
+	StringSlice(name string) []string
+	Uint(name string) uint
+	Bool(name string) bool
+	// Describe returns where the passed option is set, for use in error messages
+	Describe(name string) string
+	// Err returns an error if any of the values read so far were invalid
+	Err() error
+}
+
+// flagSource is an optionSource reading from command line flags
+type flagSource struct {
+	*cli.Context
+}
+
+func (source *flagSource) Describe(name string) string {
+	return "--" + name
+}
+
+func (source *flagSource) Err() error {
+	return nil
+}
+
+// NewOptions builds and validates an Options struct for the profile profileName from the
+// passed source. Sources are only required when creating backups; commands that only
+// operate on the target pass false for requireSources.
+func NewOptions(profileName string, source optionSource, requireSources bool) (*Options, error) {
+	var options Options
+
+	options.profileName = profileName
+	options.Verbose = source.Bool("verbose")
+
+	// Sources are only parsed here; whether they exist is checked at the start of each run,
+	// see ValidateSources
+	sources, err := ParseSources(source.StringSlice("source"))
+	if err != nil {
+		return nil, optionErrorf(source, "source", "%v", err)
+	}
+	options.sources = sources
+
+	// The options point to the first target once its limits are known (see below); see
+	// TargetOptions for the others
+	targets, err := ParseTargets(source.StringSlice("target"), source.String("target-host"), source.String("target-user"), source.Uint("target-port"))
+	if err != nil {
+		return nil, optionErrorf(source, "target", "%v", err)
+	}
+	options.targets = targets
+	if len(options.targets) > 0 {
+		options.useTarget(options.targets[0])
+	}
+	options.parallelTargets = source.Bool("parallel-targets")
+
+	options.passwordFile = strings.TrimSpace(source.String("password-file"))
+
+	rsyncOptionsRaw := source.String("rsync-options")
+	splitRsyncOptions, err := shlex.Split(rsyncOptionsRaw)
+	if err != nil {
+		return nil, optionErrorf(source, "rsync-options", "invalid rsync options: %v", err)
+	}
+	options.rsyncOptions = splitRsyncOptions
+
+	sshOptionsRaw := source.String("ssh-options")
+	splitSSHOptions, err := shlex.Split(sshOptionsRaw)
+	if err != nil {
+		return nil, optionErrorf(source, "ssh-options", "invalid ssh options: %v", err)
+	}
+	options.sshOptions = splitSSHOptions
+
+	options.sshClient = source.String("ssh-client")
+	if options.sshClient != sshClientNative && options.sshClient != sshClientExec {
+		return nil, optionErrorf(source, "ssh-client", "must be one of %s, %s", sshClientNative, sshClientExec)
+	}
+	if options.sshClient == sshClientNative {
+		if _, _, err := parseSSHOptions(options.SSHOptions()); err != nil {
+			return nil, optionErrorf(source, "ssh-options", "%v", err)
+		}
+	}
+
+	if len(options.sources) > 0 && options.sources[0].IsRemote() {
+		for _, target := range options.targets {
+			if target.IsRemote() {
+				return nil, optionErrorf(source, "source", "remote sources require local targets, since rsync cannot copy between two remote hosts")
+			}
+		}
+		if options.sshClient == sshClientNative && !options.sources[0].Daemon {
+			if _, _, err := parseSSHOptions(options.sources[0].ConnectionSSHOptions(&options)); err != nil {
+				return nil, optionErrorf(source, "source", "%v", err)
+			}
+		}
+	}
+
+	options.cron = strings.TrimSpace(source.String("cron"))
+	options.timezone = strings.TrimSpace(source.String("timezone"))
+	if options.timezone != "" {
+		if _, err := time.LoadLocation(options.timezone); err != nil {
+			return nil, optionErrorf(source, "timezone", "invalid timezone: %v", err)
+		}
+	}
+	if options.cron != "" {
+		if _, err := cronParser.Parse(options.CronSpec()); err != nil {
+			return nil, optionErrorf(source, "cron", "invalid cron expression: %v", err)
+		}
+	}
+
+	maxAges := map[string]time.Duration{}
+	for _, name := range []string{"main", "hourly", "daily", "weekly", "monthly", "yearly", "error"} {
+		flagName := fmt.Sprintf("max-%s-age", name)
+		if value := strings.TrimSpace(source.String(flagName)); value != "" {
+			maxAge, err := ParseDuration(value)
+			if err != nil {
+				return nil, optionErrorf(source, flagName, "%v", err)
+			}
+			maxAges[name] = maxAge
+		}
+	}
+
+	options.maxMain = source.Uint("max-main")
+	options.maxMainAge = maxAges["main"]
+
+	options.maxError = source.Uint("max-error")
+	options.maxErrorAge = maxAges["error"]
+	options.linkDestError = source.Bool("link-dest-error")
+	options.removeLeftover = source.Bool("remove-interrupted")
+
+	options.retentionMode = source.String("retention-mode")
+	if options.retentionMode != retentionModePermissive && options.retentionMode != retentionModeStrict {
+		return nil, optionErrorf(source, "retention-mode", "must be one of %s, %s", retentionModePermissive, retentionModeStrict)
+	}
+
+	profileLimits := func(name string) (uint, time.Duration) {
+		return source.Uint("max-" + name), maxAges[name]
+	}
+
+	tierDefinitions := source.StringSlice("tier")
+	if len(tierDefinitions) > 0 {
+		tiers, err := ParseTiers(tierDefinitions)
+		if err != nil {
+			return nil, optionErrorf(source, "tier", "%v", err)
+		}
+		options.tiers = tiers
+	} else {
+		options.tiers = DefaultTiers(profileLimits)
+	}
+
+	for i := range options.targets {
+		if err := options.targets[i].resolveLimits(&options, len(tierDefinitions) > 0, profileLimits); err != nil {
+			return nil, optionErrorf(source, "target", "%v", err)
+		}
+	}
+	if len(options.targets) > 0 {
+		options.useTarget(options.targets[0])
+	}
+
+	for flagName, value := range map[string]*time.Duration{
+		"lock-timeout":     &options.lockTimeout,
+		"lock-stale-after": &options.lockStaleAfter,
+		"resume-max-age":   &options.resumeMaxAge,
+		"hook-timeout":     &options.hookTimeout,
+		"webhook-timeout":  &options.WebhookOptions.timeout,
+	} {
+		duration, err := ParseDuration(source.String(flagName))
+		if err != nil {
+			return nil, optionErrorf(source, flagName, "%v", err)
+		}
+		*value = duration
+	}
+
+	hooks, err := ParseHooks(source.StringSlice("hook"), options.hookTimeout)
+	if err != nil {
+		return nil, optionErrorf(source, "hook", "%v", err)
+	}
+	options.hooks = hooks
+
+	options.ReportOptions.enabled = !source.Bool("report-disabled")
+	options.ReportOptions.recipients = source.StringSlice("report-recipient")
+	options.ReportOptions.from = source.String("report-from")
+	options.ReportOptions.smtpHost = source.String("report-smtp-host")
+	options.ReportOptions.smtpPort = source.Uint("report-smtp-port")
+	options.ReportOptions.smtpUsername = source.String("report-smtp-username")
+	options.ReportOptions.smtpPassword = source.String("report-smtp-password")
+	options.ReportOptions.smtpInsecure = source.Bool("report-smtp-insecure")
+	options.ReportOptions.jsonPath = source.String("report-json")
+	options.ReportOptions.policy = source.String("report-policy")
+	options.ReportOptions.stateDir = source.String("state-dir")
+	if !isValidReportPolicy(options.ReportOptions.policy) {
+		return nil, optionErrorf(source, "report-policy", "must be one of %s", strings.Join(reportPolicies, ", "))
+	}
+
+	options.WebhookOptions.urls = source.StringSlice("webhook-url")
+	if err := ValidateWebhookURLs(options.WebhookOptions.urls); err != nil {
+		return nil, optionErrorf(source, "webhook-url", "%v", err)
+	}
+	webhookSecret, err := ReadWebhookSecret(source.String("webhook-secret"), source.String("webhook-secret-file"))
+	if err != nil {
+		return nil, optionErrorf(source, "webhook-secret-file", "%v", err)
+	}
+	options.WebhookOptions.secret = webhookSecret
+	options.WebhookOptions.retries = source.Uint("webhook-retries")
+	webhookHeaders, err := ParseWebhookHeaders(source.StringSlice("webhook-header"))
+	if err != nil {
+		return nil, optionErrorf(source, "webhook-header", "%v", err)
+	}
+	options.WebhookOptions.headers = webhookHeaders
+
+	if err := source.Err(); err != nil {
+		return nil, err
+	}
+
+	if requireSources && len(options.sources) == 0 {
+		return nil, optionErrorf(source, "source", "no sources specified")
+	}
+	if len(options.targets) == 0 {
+		return nil, optionErrorf(source, "target", "no target specified")
+	}
+
+	// TODO Validate user/port
+
+	return &options, nil
+}
+
+// optionErrorf returns an error for the option name read from source. If any value read
+// from source had the wrong type, that error is returned instead: such values are read as
+// empty, which is likely what made the option invalid.
+func optionErrorf(source optionSource, name string, format string, args ...interface{}) error {
+	if err := source.Err(); err != nil {
+		return err
+	}
+
+	return fmt.Errorf("%s: %s", source.Describe(name), fmt.Sprintf(format, args...))
 }
 
 // SSHOptions constructs and returns a string slice containing all SSH options, including
-// the target user as -l and the port as -p
+// the target user as -l and the port as -p for targets accessed over ssh
 func (options *Options) SSHOptions() []string {
-	sshOptions := append(options.sshOptions)
-	if options.IsRemoteTarget() {
+	sshOptions := append([]string{}, options.sshOptions...)
+	if options.IsRemoteTarget() && !options.targetDaemon {
 		if strings.TrimSpace(options.targetUser) != "" {
 			sshOptions = append(sshOptions, "-l", strings.TrimSpace(options.targetUser))
 		}
@@ -53,39 +348,18 @@ func (options *Options) SSHOptions() []string {
 	return sshOptions
 }
 
-// TargetPath returns a well-formed target path with trailing slash
-func (options *Options) TargetPath() string {
-	return NormalizeFolderPath(options.target)
-}
-
-// DailyFolderPath Returns the full path to the "daily" folder based on the target path
-func (options *Options) DailyFolderPath() string {
-	return NormalizeFolderPath(filepath.Join(options.target, DailyFolderName))
-}
-
-// DailyRelativeFolderPath Returns the relative path to the "daily" folder (relative to target folder)
-func (options *Options) DailyRelativeFolderPath() string {
-	return options.TargetRelativePath(options.DailyFolderPath())
-}
-
-// WeeklyFolderPath Returns the full path to the "weekly" folder based on the target path
-func (options *Options) WeeklyFolderPath() string {
-	return NormalizeFolderPath(filepath.Join(options.target, WeeklyFolderName))
-}
-
-// WeeklyRelativeFolderPath Returns the relative path to the "weekly" folder (relative to target folder)
-func (options *Options) WeeklyRelativeFolderPath() string {
-	return options.TargetRelativePath(options.WeeklyFolderPath())
-}
+// CronSpec returns the cron expression including the configured timezone, if any
+func (options *Options) CronSpec() string {
+	if options.timezone == "" {
+		return options.cron
+	}
 
-// MonthlyFolderPath Returns the full path to the "monthly" folder based on the target path
-func (options *Options) MonthlyFolderPath() string {
-	return NormalizeFolderPath(filepath.Join(options.target, MonthlyFolderName))
+	return fmt.Sprintf("CRON_TZ=%s %s", options.timezone, options.cron)
 }
 
-// MonthlyRelativeFolderPath Returns the relative path to the "monthly" folder (relative to target folder)
-func (options *Options) MonthlyRelativeFolderPath() string {
-	return options.TargetRelativePath(options.MonthlyFolderPath())
+// TargetPath returns a well-formed target path with trailing slash
+func (options *Options) TargetPath() string {
+	return NormalizeFolderPath(options.target)
 }
 
 // TargetRelativePath Returns the relative path from the target path to the passed path
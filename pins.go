@@ -0,0 +1,296 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+// pinRegistryVersion is the version of the pin registry file format
+const pinRegistryVersion = 1
+
+// Pin protects a backup from being moved or deleted by rotation
+type Pin struct {
+	PinnedAt time.Time `json:"pinnedAt"`
+	PinnedBy string    `json:"pinnedBy,omitempty"`
+	// Until is the time after which the pin expires; nil for pins that never expire
+	Until  *time.Time `json:"until,omitempty"`
+	Reason string     `json:"reason,omitempty"`
+}
+
+// Active returns true if the pin has not expired at the passed time
+func (pin Pin) Active(now time.Time) bool {
+	return pin.Until == nil || now.Before(*pin.Until)
+}
+
+// Describe returns a short description of the pin for log messages, e.g.
+// "pinned until 2027-01-01 00:00 (pre-migration)"
+func (pin Pin) Describe() string {
+	description := "pinned"
+	if pin.Until != nil {
+		description += " until " + pin.Until.Local().Format("2006-01-02 15:04")
+	}
+	if pin.Reason != "" {
+		description += fmt.Sprintf(" (%s)", pin.Reason)
+	}
+
+	return description
+}
+
+// pinRegistry is the content of the pin registry file in the target folder
+type pinRegistry struct {
+	Version int `json:"version"`
+	// Pins maps backup names to their pin
+	Pins map[string]Pin `json:"pins"`
+}
+
+// PinsFilePath returns the full path to the pin registry file
+func (options *Options) PinsFilePath() string {
+	return filepath.Join(options.TargetPath(), PinsFileName)
+}
+
+// LoadPins reads all pins, including expired ones, from the pin registry in the target folder
+func LoadPins(options *Options) (map[string]Pin, error) {
+	data, err := options.Target().ReadFile(options.PinsFilePath())
+	if os.IsNotExist(err) {
+		return map[string]Pin{}, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("could not read pin registry %s: %v", options.PinsFilePath(), err)
+	}
+
+	registry := pinRegistry{}
+	if err := json.Unmarshal(data, &registry); err != nil {
+		return nil, fmt.Errorf("could not parse pin registry %s: %v", options.PinsFilePath(), err)
+	}
+	if registry.Version > pinRegistryVersion {
+		return nil, fmt.Errorf("pin registry %s has unsupported version %d", options.PinsFilePath(), registry.Version)
+	}
+	if registry.Pins == nil {
+		registry.Pins = map[string]Pin{}
+	}
+
+	return registry.Pins, nil
+}
+
+// SavePins replaces the pin registry in the target folder with the passed pins
+func SavePins(options *Options, pins map[string]Pin) error {
+	data, err := json.MarshalIndent(pinRegistry{Version: pinRegistryVersion, Pins: pins}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := options.Target().WriteFile(options.PinsFilePath(), append(data, '\n')); err != nil {
+		return fmt.Errorf("could not write pin registry %s: %v", options.PinsFilePath(), err)
+	}
+
+	return nil
+}
+
+// ActivePins returns the pins in the target folder that have not expired at the passed time
+func ActivePins(options *Options, now time.Time) (map[string]Pin, error) {
+	pins, err := LoadPins(options)
+	if err != nil {
+		return nil, err
+	}
+
+	active := map[string]Pin{}
+	for name, pin := range pins {
+		if pin.Active(now) {
+			active[name] = pin
+		}
+	}
+
+	return active, nil
+}
+
+// updatePins applies update to the pins of the target while holding the target lock, so
+// concurrent updates and rotations do not get lost. Returns false if update made no changes.
+func updatePins(options *Options, update func(pins map[string]Pin) bool) (bool, error) {
+	AcquireTargetLock(options)
+	defer options.ReleaseTargetLock()
+
+	pins, err := LoadPins(options)
+	if err != nil {
+		return false, err
+	}
+	if !update(pins) {
+		return false, nil
+	}
+
+	return true, SavePins(options, pins)
+}
+
+// ParsePinUntil parses the expiry time of a pin: a date (2006-01-02), a date and time
+// (2006-01-02 15:04) in the local timezone, or an RFC 3339 timestamp
+func ParsePinUntil(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+
+	for _, layout := range []string{"2006-01-02", "2006-01-02 15:04", "2006-01-02T15:04"} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+
+	return time.Time{}, fmt.Errorf("invalid time %q: expected 2006-01-02, 2006-01-02 15:04 or an RFC 3339 timestamp", value)
+}
+
+// logPins logs all passed pins, ordered by backup name
+func logPins(options *Options, pins map[string]Pin) {
+	names := []string{}
+	for name := range pins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		options.log.Info.Printf("  %s: %s", name, pins[name].Describe())
+	}
+}
+
+// pinCommand implements the "pin" command
+func pinCommand(c *cli.Context) (err error) {
+	defer recoverError(&err)
+
+	if c.NArg() != 1 {
+		return fmt.Errorf("pin: expected exactly one backup (options such as --until must come before it)")
+	}
+
+	optionsList, err := commandProfiles(c)
+	if err != nil {
+		return err
+	}
+	defer closeTargets(optionsList)
+	if len(optionsList) != 1 {
+		return fmt.Errorf("pin: select exactly one profile using --profile")
+	}
+	options := optionsList[0]
+
+	pin := Pin{
+		PinnedAt: time.Now(),
+		Reason:   c.String("reason"),
+	}
+
+	if c.String("until") != "" {
+		until, err := ParsePinUntil(c.String("until"))
+		if err != nil {
+			return fmt.Errorf("--until: %v", err)
+		}
+		if !until.After(pin.PinnedAt) {
+			return fmt.Errorf("--until: %s is in the past", c.String("until"))
+		}
+		pin.Until = &until
+	}
+
+	if currentUser, err := user.Current(); err == nil {
+		pin.PinnedBy = currentUser.Username
+		if hostname, err := os.Hostname(); err == nil {
+			pin.PinnedBy += "@" + hostname
+		}
+	}
+
+	// For profiles with several targets, the reference is resolved on the first target, and
+	// the backup of that name is pinned on every target it exists on
+	targetOptionsList := options.TargetOptions()
+	defer closeTargets(targetOptionsList)
+
+	backupRelativePath, err := ResolveBackup(targetOptionsList[0], c.Args().First())
+	if err != nil {
+		return err
+	}
+	name := filepath.Base(backupRelativePath)
+
+	for i, targetOptions := range targetOptionsList {
+		if i > 0 {
+			backupRelativePath, err = ResolveBackup(targetOptions, name)
+			if err != nil {
+				targetOptions.log.Warn.Printf("Not pinning backup on target %s: %v", targetOptions.targetName, err)
+				continue
+			}
+		}
+
+		if _, err := updatePins(targetOptions, func(pins map[string]Pin) bool {
+			pins[name] = pin
+			return true
+		}); err != nil {
+			return err
+		}
+
+		targetOptions.log.Info.Printf("Backup %s is now %s", filepath.Clean(backupRelativePath), pin.Describe())
+	}
+
+	return nil
+}
+
+// unpinCommand implements the "unpin" command
+func unpinCommand(c *cli.Context) (err error) {
+	defer recoverError(&err)
+
+	if c.NArg() != 1 {
+		return fmt.Errorf("unpin: expected exactly one backup")
+	}
+
+	optionsList, err := commandProfiles(c)
+	if err != nil {
+		return err
+	}
+	defer closeTargets(optionsList)
+	if len(optionsList) != 1 {
+		return fmt.Errorf("unpin: select exactly one profile using --profile")
+	}
+	options := optionsList[0]
+
+	// For profiles with several targets, the reference is resolved on the first target, and
+	// the pin of that name is removed from every target
+	targetOptionsList := options.TargetOptions()
+	defer closeTargets(targetOptionsList)
+
+	pins, err := LoadPins(targetOptionsList[0])
+	if err != nil {
+		return err
+	}
+
+	// Pins of backups that no longer exist can still be removed by name
+	name := c.Args().First()
+	if _, ok := pins[name]; !ok {
+		backupRelativePath, err := ResolveBackup(targetOptionsList[0], name)
+		if err != nil {
+			return err
+		}
+		name = filepath.Base(backupRelativePath)
+	}
+
+	unpinned := 0
+	for _, targetOptions := range targetOptionsList {
+		changed, err := updatePins(targetOptions, func(pins map[string]Pin) bool {
+			if _, ok := pins[name]; !ok {
+				return false
+			}
+			delete(pins, name)
+			return true
+		})
+		if err != nil {
+			return err
+		} else if !changed {
+			continue
+		}
+
+		targetOptions.log.Info.Printf("Backup %s is no longer pinned", name)
+		unpinned++
+	}
+
+	if unpinned == 0 {
+		return fmt.Errorf("backup %s is not pinned", name)
+	}
+
+	return nil
+}
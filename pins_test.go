@@ -0,0 +1,108 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestParsePinUntil(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected time.Time
+		err      bool
+	}{
+		{"2027-01-01", time.Date(2027, 1, 1, 0, 0, 0, 0, time.Local), false},
+		{" 2027-01-01 ", time.Date(2027, 1, 1, 0, 0, 0, 0, time.Local), false},
+		{"2027-01-01 15:04", time.Date(2027, 1, 1, 15, 4, 0, 0, time.Local), false},
+		{"2027-01-01T15:04", time.Date(2027, 1, 1, 15, 4, 0, 0, time.Local), false},
+		{"2027-01-01T15:04:05Z", time.Date(2027, 1, 1, 15, 4, 5, 0, time.UTC), false},
+		{"2027-13-01", time.Time{}, true},
+		{"tomorrow", time.Time{}, true},
+		{"", time.Time{}, true},
+	}
+
+	for _, test := range tests {
+		until, err := ParsePinUntil(test.value)
+		if test.err {
+			if err == nil {
+				t.Errorf("ParsePinUntil(%q) = %s, expected an error", test.value, until)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParsePinUntil(%q): unexpected error: %v", test.value, err)
+		} else if !until.Equal(test.expected) {
+			t.Errorf("ParsePinUntil(%q) = %s, expected %s", test.value, until, test.expected)
+		}
+	}
+}
+
+func TestPins(t *testing.T) {
+	now := time.Now()
+	past := now.Add(-time.Hour)
+	future := now.Add(time.Hour)
+	options := newMemoryOptions(t)
+	options.lockStaleAfter = time.Minute
+
+	if pins, err := LoadPins(options); err != nil || len(pins) != 0 {
+		t.Fatalf("LoadPins without a registry = %v, %v, expected no pins", pins, err)
+	}
+
+	changed, err := updatePins(options, func(pins map[string]Pin) bool {
+		pins["2026-01-01_00-00-00"] = Pin{PinnedAt: now, Reason: "forever"}
+		pins["2026-02-01_00-00-00"] = Pin{PinnedAt: now, Until: &past}
+		pins["2026-03-01_00-00-00"] = Pin{PinnedAt: now, Until: &future}
+		return true
+	})
+	if err != nil || !changed {
+		t.Fatalf("updatePins = %t, %v", changed, err)
+	}
+	if options.targetLock != nil {
+		t.Errorf("updatePins did not release the target lock")
+	}
+
+	active, err := ActivePins(options, now)
+	if err != nil {
+		t.Fatalf("ActivePins: %v", err)
+	}
+	names := []string{}
+	for name := range active {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if expected := []string{"2026-01-01_00-00-00", "2026-03-01_00-00-00"}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("active pins %v, expected %v", names, expected)
+	}
+	if reason := active["2026-01-01_00-00-00"].Reason; reason != "forever" {
+		t.Errorf("got reason %q after loading", reason)
+	}
+
+	for _, content := range []string{"{", `{"version": 2, "pins": {}}`} {
+		if err := options.Target().WriteFile(options.PinsFilePath(), []byte(content)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadPins(options); err == nil {
+			t.Errorf("LoadPins(%s) did not return an error", content)
+		}
+	}
+}
+
+func TestRotationSkipsPinnedBackups(t *testing.T) {
+	now := time.Now()
+	names := []string{backupName(now, time.Hour), backupName(now, 2*time.Hour), backupName(now, 3*time.Hour)}
+	options := newMemoryOptions(t, names...)
+	options.maxMain = 1
+	options.tiers = []Tier{}
+
+	if err := SavePins(options, map[string]Pin{names[2]: {PinnedAt: now}}); err != nil {
+		t.Fatal(err)
+	}
+
+	plan := PlanRotation(options)
+
+	if deletions := plannedBackups(plan, rotationActionDelete); !reflect.DeepEqual(deletions, []string{names[1]}) {
+		t.Errorf("deleted %v, expected %v", deletions, []string{names[1]})
+	}
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"html/template"
+	"strings"
+	"time"
+)
+
+// reportBannerColors are the background colors of the status banner of HTML reports, by log
+// level
+var reportBannerColors = map[string]string{
+	"INFO":  "#2e7d32",
+	"WARN":  "#ef6c00",
+	"ERROR": "#c62828",
+	"FATAL": "#c62828",
+}
+
+// reportHTMLTemplate is the template of the HTML part of report mails, see reportHTMLData
+var reportHTMLTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html>
+<body style="font-family: sans-serif; font-size: 14px; color: #212121;">
+<div style="background: {{.BannerColor}}; color: #ffffff; padding: 12px 16px; font-size: 18px;">
+{{.Profile}}: {{.Status}}
+</div>
+<p>Backup {{.BackupName}}, {{.LogLevel}}{{if .Err}}: {{.Err}}{{end}}</p>
+<table style="border-collapse: collapse;">
+<tr style="text-align: left; border-bottom: 1px solid #9e9e9e;">
+<th style="padding: 4px 12px 4px 0;">Target</th>
+<th style="padding: 4px 12px 4px 0;">Result</th>
+<th style="padding: 4px 12px 4px 0;">Duration</th>
+<th style="padding: 4px 12px 4px 0;">Transferred</th>
+<th style="padding: 4px 12px 4px 0;">Files changed</th>
+<th style="padding: 4px 12px 4px 0;">Backups per tier</th>
+<th style="padding: 4px 12px 4px 0;">Free space</th>
+</tr>
+{{range .Targets}}<tr>
+<td style="padding: 4px 12px 4px 0;">{{.Name}}</td>
+<td style="padding: 4px 12px 4px 0;">{{.Result}}</td>
+<td style="padding: 4px 12px 4px 0;">{{.Duration}}</td>
+<td style="padding: 4px 12px 4px 0;">{{.Transferred}}</td>
+<td style="padding: 4px 12px 4px 0;">{{.FilesChanged}}</td>
+<td style="padding: 4px 12px 4px 0;">{{.Tiers}}</td>
+<td style="padding: 4px 12px 4px 0;">{{.FreeSpace}}</td>
+</tr>
+{{end}}</table>
+{{if .Messages}}<h3>Warnings and errors</h3>
+<ul>
+{{range .Messages}}<li><b>{{.Level}}</b> {{.Time.Format "15:04:05"}} {{.Message}}</li>
+{{end}}</ul>
+{{end}}<p style="color: #757575;">The full log is attached as {{.LogFileName}}.</p>
+</body>
+</html>
+`))
+
+// reportHTMLTarget is a row of the summary table of HTML reports
+type reportHTMLTarget struct {
+	Name         string
+	Result       string
+	Duration     string
+	Transferred  string
+	FilesChanged string
+	Tiers        string
+	FreeSpace    string
+}
+
+// reportHTMLData holds the values shown in HTML reports
+type reportHTMLData struct {
+	Profile     string
+	Status      string
+	BannerColor string
+	BackupName  string
+	LogLevel    string
+	Err         string
+	Targets     []reportHTMLTarget
+	Messages    []LogMessage
+	LogFileName string
+}
+
+// reportStatus returns the status of the run shown in reports
+func reportStatus(options *Options, logLevel string) string {
+	if options.hookState.err != "" {
+		return "backup failed"
+	} else if logLevel != "INFO" {
+		return "backup completed with warnings"
+	}
+
+	return "backup completed"
+}
+
+// tierCounts describes the number of backups in each tier of inventory, in the order of tiers
+func tierCounts(inventory map[string][]string, tiers []Tier) string {
+	if inventory == nil {
+		return "-"
+	}
+
+	counts := []string{fmt.Sprintf("main %d", len(inventory["main"]))}
+	for _, tier := range tiers {
+		counts = append(counts, fmt.Sprintf("%s %d", tier.Name(), len(inventory[tier.Name()])))
+	}
+
+	return strings.Join(counts, ", ")
+}
+
+// reportLogFileName returns the name of the compressed log attached to report mails
+func reportLogFileName(options *Options) string {
+	return fmt.Sprintf("%s_%s.log.gz", options.profileName, options.hookState.backupName)
+}
+
+// ReportHTML returns the HTML part of report mails: a status banner, a summary table with a
+// row per target, and the warnings and errors of the run
+func ReportHTML(options *Options) (string, error) {
+	logLevel := options.ReportLogLevel()
+	data := reportHTMLData{
+		Profile:     options.profileName,
+		Status:      reportStatus(options, logLevel),
+		BannerColor: reportBannerColors[logLevel],
+		BackupName:  options.hookState.backupName,
+		LogLevel:    logLevel,
+		Err:         options.hookState.err,
+		Messages:    options.log.Problems(),
+		LogFileName: reportLogFileName(options),
+	}
+
+	for i, status := range options.targetStatuses {
+		target := reportHTMLTarget{
+			Name:         status.Name,
+			Result:       status.Result,
+			Duration:     status.Duration.Round(time.Second).String(),
+			Transferred:  "-",
+			FilesChanged: "-",
+			FreeSpace:    "-",
+		}
+		if status.Stats != nil {
+			target.Transferred = FormatBytes(status.Stats.TransferredSize)
+		}
+		if status.Changes != nil {
+			target.FilesChanged = fmt.Sprintf("%d", status.Changes.Total())
+		}
+		if status.FreeSpace != nil {
+			target.FreeSpace = FormatBytes(*status.FreeSpace)
+		}
+		tiers := options.tiers
+		if i < len(options.targets) && len(options.targets) > 1 {
+			tiers = options.targets[i].tiers
+		}
+		target.Tiers = tierCounts(status.Inventory, tiers)
+
+		data.Targets = append(data.Targets, target)
+	}
+
+	var html bytes.Buffer
+	if err := reportHTMLTemplate.Execute(&html, data); err != nil {
+		return "", err
+	}
+
+	return html.String(), nil
+}
+
+// ReportText returns the plain text part of report mails, with the same information as
+// ReportHTML
+func ReportText(options *Options) string {
+	logLevel := options.ReportLogLevel()
+	text := fmt.Sprintf("%s: %s (%s)\n", options.profileName, reportStatus(options, logLevel), logLevel)
+	if options.hookState.err != "" {
+		text += fmt.Sprintf("Error: %s\n", options.hookState.err)
+	}
+
+	if summary := reportSummary(options); summary != "" {
+		text += "\n" + summary
+	}
+
+	if messages := options.log.Problems(); len(messages) > 0 {
+		text += "\nWarnings and errors:\n"
+		for _, message := range messages {
+			text += fmt.Sprintf("  %s %s %s\n", message.Level, message.Time.Format("15:04:05"), message.Message)
+		}
+	}
+
+	return text + fmt.Sprintf("\nThe full log is attached as %s.\n", reportLogFileName(options))
+}
+
+// compressedLog returns the full log of the run, gzip-compressed
+func compressedLog(options *Options) ([]byte, error) {
+	var compressed bytes.Buffer
+
+	writer := gzip.NewWriter(&compressed)
+	if _, err := writer.Write([]byte(options.log.String())); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+
+	return compressed.Bytes(), nil
+}
+
+// digestHTMLTemplate is the template of the HTML part of digest mails, see digestHTMLData
+var digestHTMLTemplate = template.Must(template.New("digest").Parse(`<!DOCTYPE html>
+<html>
+<body style="font-family: sans-serif; font-size: 14px; color: #212121;">
+<div style="background: {{.BannerColor}}; color: #ffffff; padding: 12px 16px; font-size: 18px;">
+{{.Profile}}: {{.Summary}}
+</div>
+<p>Runs since {{.Since.Format "2006-01-02 15:04"}}</p>
+<table style="border-collapse: collapse;">
+<tr style="text-align: left; border-bottom: 1px solid #9e9e9e;">
+<th style="padding: 4px 12px 4px 0;">Time</th>
+<th style="padding: 4px 12px 4px 0;">Backup</th>
+<th style="padding: 4px 12px 4px 0;">Result</th>
+<th style="padding: 4px 12px 4px 0;">Level</th>
+<th style="padding: 4px 12px 4px 0;">Duration</th>
+<th style="padding: 4px 12px 4px 0;">Transferred</th>
+<th style="padding: 4px 12px 4px 0;">Files changed</th>
+<th style="padding: 4px 12px 4px 0;">Error</th>
+</tr>
+{{range .Runs}}<tr>
+<td style="padding: 4px 12px 4px 0;">{{.Time}}</td>
+<td style="padding: 4px 12px 4px 0;">{{.BackupName}}</td>
+<td style="padding: 4px 12px 4px 0;">{{.Result}}</td>
+<td style="padding: 4px 12px 4px 0;">{{.LogLevel}}</td>
+<td style="padding: 4px 12px 4px 0;">{{.Duration}}</td>
+<td style="padding: 4px 12px 4px 0;">{{.Transferred}}</td>
+<td style="padding: 4px 12px 4px 0;">{{.FilesChanged}}</td>
+<td style="padding: 4px 12px 4px 0;">{{.Err}}</td>
+</tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// digestHTMLRun is a row of the table of digests
+type digestHTMLRun struct {
+	Time         string
+	BackupName   string
+	Result       string
+	LogLevel     string
+	Duration     string
+	Transferred  string
+	FilesChanged uint64
+	Err          string
+}
+
+// digestHTMLData holds the values shown in digests
+type digestHTMLData struct {
+	Profile     string
+	Summary     string
+	BannerColor string
+	Since       time.Time
+	Runs        []digestHTMLRun
+}
+
+// digestLogLevel returns the highest log level of runs
+func digestLogLevel(runs []DigestRun) string {
+	levels := []string{"INFO", "WARN", "ERROR", "FATAL"}
+
+	highest := 0
+	for _, run := range runs {
+		for i, level := range levels {
+			if level == run.LogLevel && i > highest {
+				highest = i
+			}
+		}
+	}
+
+	return levels[highest]
+}
+
+// digestSummary returns the number of runs and failed runs for digests
+func digestSummary(runs []DigestRun) string {
+	failed := 0
+	for _, run := range runs {
+		if run.Result == runResultFailed {
+			failed++
+		}
+	}
+
+	return fmt.Sprintf("%d runs, %d failed", len(runs), failed)
+}
+
+// SendDigestMail sends a digest of the passed runs since the last digest to the report
+// recipients. Returns false if the SMTP configuration is incomplete.
+func SendDigestMail(options *Options, runs []DigestRun, since time.Time) bool {
+	logLevel := digestLogLevel(runs)
+	data := digestHTMLData{
+		Profile:     options.profileName,
+		Summary:     digestSummary(runs),
+		BannerColor: reportBannerColors[logLevel],
+		Since:       since.Local(),
+	}
+
+	text := fmt.Sprintf("%s: %s since %s\n\n", options.profileName, data.Summary, data.Since.Format("2006-01-02 15:04"))
+	for _, run := range runs {
+		row := digestHTMLRun{
+			Time:         run.Time.Local().Format("2006-01-02 15:04"),
+			BackupName:   run.BackupName,
+			Result:       run.Result,
+			LogLevel:     run.LogLevel,
+			Duration:     time.Duration(run.DurationSeconds * float64(time.Second)).Round(time.Second).String(),
+			Transferred:  FormatBytes(run.Transferred),
+			FilesChanged: run.FilesChanged,
+			Err:          run.Err,
+		}
+		data.Runs = append(data.Runs, row)
+
+		text += fmt.Sprintf("%s  %s  %-6s  %-5s  %8s  %10s  %6d files changed", row.Time, row.BackupName, row.Result, row.LogLevel, row.Duration, row.Transferred, row.FilesChanged)
+		if row.Err != "" {
+			text += "  " + row.Err
+		}
+		text += "\n"
+	}
+
+	var html bytes.Buffer
+	if err := digestHTMLTemplate.Execute(&html, data); err != nil {
+		panic(fmt.Sprintf("Error while rendering digest mail: %v", err))
+	}
+
+	subject := fmt.Sprintf("rotating-rsync-backup digest [%s]: %s (%s)", logLevel, options.profileName, data.Summary)
+
+	return sendMail(options, subject, text, html.String(), nil)
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// runReportVersion is the version of the format of the JSON run report
+const runReportVersion = 1
+
+// Phase results, see RunPhase
+const (
+	phaseResultOK     = "ok"
+	phaseResultFailed = "failed"
+)
+
+// RunPhase is a step of a run, see Options.phase
+type RunPhase struct {
+	Name string `json:"name"`
+	// Target is the name of the target the phase ran for, for profiles with several targets
+	Target          string    `json:"target,omitempty"`
+	Started         time.Time `json:"started"`
+	Finished        time.Time `json:"finished"`
+	DurationSeconds float64   `json:"durationSeconds"`
+	Result          string    `json:"result"`
+	Err             string    `json:"error,omitempty"`
+}
+
+// runPhases collects the phases of a run. It is shared by the Options of all targets of the
+// profile, which may run in parallel.
+type runPhases struct {
+	mutex  sync.Mutex
+	phases []RunPhase
+}
+
+// phase runs step as the phase called name of the current run, recording its duration and
+// outcome for the JSON report. Panics are passed on.
+func (options *Options) phase(name string, step func()) {
+	phase := RunPhase{Name: name, Target: options.targetName, Started: time.Now(), Result: phaseResultOK}
+
+	defer func() {
+		recoveryMessage := recover()
+		if recoveryMessage != nil {
+			phase.Result = phaseResultFailed
+			phase.Err = fmt.Sprintf("%v", recoveryMessage)
+		}
+
+		phase.Finished = time.Now()
+		phase.DurationSeconds = phase.Finished.Sub(phase.Started).Seconds()
+		if options.runPhases != nil {
+			options.runPhases.mutex.Lock()
+			options.runPhases.phases = append(options.runPhases.phases, phase)
+			options.runPhases.mutex.Unlock()
+		}
+
+		if recoveryMessage != nil {
+			panic(recoveryMessage)
+		}
+	}()
+
+	step()
+}
+
+// TargetReport is the outcome of a run for one target in the JSON run report
+type TargetReport struct {
+	Name            string   `json:"name"`
+	Location        string   `json:"location"`
+	Result          string   `json:"result"`
+	Err             string   `json:"error,omitempty"`
+	LogLevel        string   `json:"logLevel"`
+	DurationSeconds float64  `json:"durationSeconds"`
+	LinkDest        []string `json:"linkDest"`
+	// RsyncExitCode is rsync's exit code, if rsync ran
+	RsyncExitCode *int                `json:"rsyncExitCode"`
+	Stats         *RsyncStats         `json:"stats"`
+	Changes       *ChangeSummary      `json:"changes"`
+	Rotation      []RotationAction    `json:"rotation"`
+	Inventory     map[string][]string `json:"inventory"`
+	FreeSpace     *uint64             `json:"freeSpace"`
+}
+
+// RunReport is the JSON run report, see WriteRunReport
+type RunReport struct {
+	Version         int            `json:"version"`
+	RunID           string         `json:"runId"`
+	Profile         string         `json:"profile"`
+	Started         time.Time      `json:"started"`
+	Finished        time.Time      `json:"finished"`
+	DurationSeconds float64        `json:"durationSeconds"`
+	Result          string         `json:"result"`
+	Err             string         `json:"error,omitempty"`
+	LogLevel        string         `json:"logLevel"`
+	BackupName      string         `json:"backupName"`
+	Phases          []RunPhase     `json:"phases"`
+	Targets         []TargetReport `json:"targets"`
+	// Messages are the warnings and errors logged during the run
+	Messages []LogMessage `json:"messages"`
+}
+
+// BackupInventory returns the names of the complete backups in each tier of the target,
+// most recent first
+func BackupInventory(options *Options) (map[string][]string, error) {
+	entries, err := ListBackups(options)
+	if err != nil {
+		return nil, err
+	}
+
+	inventory := map[string][]string{"main": {}}
+	for _, tier := range options.tiers {
+		inventory[tier.Name()] = []string{}
+	}
+	for _, entry := range entries {
+		if entry.State == backupStateComplete {
+			inventory[entry.Tier] = append(inventory[entry.Tier], entry.Name)
+		}
+	}
+
+	return inventory, nil
+}
+
+// NewRunReport returns the JSON run report for the run that just ended
+func NewRunReport(options *Options) *RunReport {
+	finished := time.Now()
+	report := &RunReport{
+		Version:         runReportVersion,
+		RunID:           options.runID,
+		Profile:         options.profileName,
+		Started:         options.runStarted,
+		Finished:        finished,
+		DurationSeconds: finished.Sub(options.runStarted).Seconds(),
+		Result:          phaseResultOK,
+		Err:             options.hookState.err,
+		LogLevel:        options.ReportLogLevel(),
+		BackupName:      options.hookState.backupName,
+		Phases:          []RunPhase{},
+		Targets:         []TargetReport{},
+		Messages:        options.log.Problems(),
+	}
+	if report.Err != "" {
+		report.Result = phaseResultFailed
+	}
+
+	if options.runPhases != nil {
+		options.runPhases.mutex.Lock()
+		report.Phases = append(report.Phases, options.runPhases.phases...)
+		options.runPhases.mutex.Unlock()
+	}
+
+	for i, status := range options.targetStatuses {
+		target := TargetReport{
+			Name:            status.Name,
+			Result:          status.Result,
+			Err:             status.Err,
+			LogLevel:        status.LogLevel,
+			DurationSeconds: status.Duration.Seconds(),
+			LinkDest:        []string{},
+			Stats:           status.Stats,
+			Changes:         status.Changes,
+			Rotation:        status.Rotation,
+			Inventory:       status.Inventory,
+			FreeSpace:       status.FreeSpace,
+		}
+		if i < len(options.targets) {
+			target.Location = options.targets[i].Location()
+		}
+		if status.Metadata != nil {
+			target.LinkDest = status.Metadata.LinkDest
+			exitCode := status.Metadata.ExitCode
+			target.RsyncExitCode = &exitCode
+		}
+		if target.Rotation == nil {
+			target.Rotation = []RotationAction{}
+		}
+
+		report.Targets = append(report.Targets, target)
+	}
+
+	return report
+}
+
+// LogOutput returns where the log of runs is printed: stdout, unless the JSON report is
+// written there
+func (options *Options) LogOutput() io.Writer {
+	if options.ReportOptions.jsonPath == "-" {
+		return os.Stderr
+	}
+
+	return os.Stdout
+}
+
+// WriteRunReport writes the JSON run report to the configured path, or to stdout for "-". The
+// file is replaced atomically, so readers never see a partially written report.
+func WriteRunReport(options *Options) {
+	data, err := json.MarshalIndent(NewRunReport(options), "", "  ")
+	if err != nil {
+		panic(fmt.Sprintf("Error while encoding JSON report: %v", err))
+	}
+	data = append(data, '\n')
+
+	path := options.ReportOptions.jsonPath
+	if path == "-" {
+		os.Stdout.Write(data)
+		return
+	}
+
+	file, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		panic(fmt.Sprintf("Error while writing JSON report: %v", err))
+	}
+	defer os.Remove(file.Name())
+
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		// TempFile creates files only readable by the owner
+		err = os.Chmod(file.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), path)
+	}
+	if err != nil {
+		panic(fmt.Sprintf("Error while writing JSON report to %s: %v", path, err))
+	}
+
+	options.log.Debug.Printf("Wrote JSON report to %s", path)
+}
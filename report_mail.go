@@ -3,6 +3,7 @@ package main
 import (
 	"crypto/tls"
 	"fmt"
+	"io"
 	"os/user"
 
 	"github.com/Showmax/go-fqdn"
@@ -10,19 +11,58 @@ import (
 )
 
 // SendReportMail sends a report mail to the recipients configured in the options using the
-// configured SMTP server, containing the full log output up until the function call
-func SendReportMail(options *Options) {
-	logContent := Log.String()
+// configured SMTP server. It contains a summary as HTML with a plain text alternative, see
+// ReportHTML and ReportText, and the full log output up until the function call as a
+// compressed attachment. Returns false if the SMTP configuration is incomplete.
+func SendReportMail(options *Options) bool {
+	text := ReportText(options)
+	html, err := ReportHTML(options)
+	if err != nil {
+		panic(fmt.Sprintf("Error while rendering report mail: %v", err))
+	}
+	compressed, err := compressedLog(options)
+	if err != nil {
+		panic(fmt.Sprintf("Error while compressing log for report mail: %v", err))
+	}
+
+	subjectSuffix := ""
+	if len(options.targetStatuses) > 1 {
+		ok := 0
+		for _, status := range options.targetStatuses {
+			if status.Result == targetResultOK {
+				ok++
+			}
+		}
+		subjectSuffix = fmt.Sprintf(" (%d of %d targets ok)", ok, len(options.targetStatuses))
+	}
 
+	subject := fmt.Sprintf("rotating-rsync-backup [%s]: %s%s", options.ReportLogLevel(), options.profileName, subjectSuffix)
+
+	return sendMail(options, subject, text, html, func(m *gomail.Message) {
+		m.Attach(
+			reportLogFileName(options),
+			gomail.SetCopyFunc(func(w io.Writer) error {
+				_, err := w.Write(compressed)
+				return err
+			}),
+			gomail.SetHeader(map[string][]string{"Content-Type": {"application/gzip"}}),
+		)
+	})
+}
+
+// sendMail sends a mail with the passed subject and body, as plain text and HTML, to the
+// report recipients. attach, if not nil, can add attachments. Returns false if the SMTP
+// configuration is incomplete.
+func sendMail(options *Options, subject string, text string, html string, attach func(m *gomail.Message)) bool {
 	if options.ReportOptions.smtpHost == "" ||
 		options.ReportOptions.smtpPort == 0 {
 		if len(options.ReportOptions.recipients) > 0 {
-			Log.Warn.Println("Status mail recipients given, but SMTP configuration is incomplete (host/port missing/invalid).")
+			options.log.Warn.Println("Status mail recipients given, but SMTP configuration is incomplete (host/port missing/invalid).")
 		} else {
-			Log.Debug.Println("No SMTP configuration given.")
+			options.log.Debug.Println("No SMTP configuration given.")
 		}
 
-		return
+		return false
 	}
 
 	var from string
@@ -40,15 +80,17 @@ func SendReportMail(options *Options) {
 		from = options.ReportOptions.from
 	}
 
-	Log.Info.Printf("Sending report mail to: %v", options.ReportOptions.recipients)
-
-	logLevel := Log.MaxLogLevel()
+	options.log.Info.Printf("Sending report mail to: %v", options.ReportOptions.recipients)
 
 	m := gomail.NewMessage()
 	m.SetHeader("From", from)
 	m.SetHeader("To", options.ReportOptions.recipients...)
-	m.SetHeader("Subject", fmt.Sprintf("rotating-rsync-backup [%s]: %s", logLevel, options.profileName))
-	m.SetBody("text/plain", logContent)
+	m.SetHeader("Subject", subject)
+	m.SetBody("text/plain", text)
+	m.AddAlternative("text/html", html)
+	if attach != nil {
+		attach(m)
+	}
 
 	d := gomail.NewDialer(
 		options.ReportOptions.smtpHost,
@@ -63,4 +105,37 @@ func SendReportMail(options *Options) {
 	if err := d.DialAndSend(m); err != nil {
 		panic(fmt.Sprintf("Error while sending report mail: %v", err))
 	}
+
+	return true
+}
+
+// reportSummary returns the summary shown above the log in reports: the outcome of the run
+// for each target of profiles with several targets, how the backup was created, the transfer
+// statistics and the changes including the largest changed files
+func reportSummary(options *Options) string {
+	summary := ""
+	for _, status := range options.targetStatuses {
+		indent := ""
+		if len(options.targetStatuses) > 1 {
+			summary += fmt.Sprintf("%s\n", status)
+			indent = "  "
+		}
+		if status.Metadata != nil {
+			summary += fmt.Sprintf("%sBackup: %s\n", indent, status.Metadata.Describe())
+		}
+		if status.Stats != nil {
+			summary += fmt.Sprintf("%sTransferred: %s\n", indent, status.Stats.Summary())
+		}
+		if status.Changes != nil {
+			summary += fmt.Sprintf("%sChanges: %s\n", indent, status.Changes.Counts())
+			for i, changed := range status.Changes.Top {
+				if i == reportTopChanges {
+					break
+				}
+				summary += fmt.Sprintf("%s  %9s  %-8s  %s\n", indent, FormatBytes(changed.Size), changed.Change, changed.Path)
+			}
+		}
+	}
+
+	return summary
 }
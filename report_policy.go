@@ -0,0 +1,273 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Report policies, see --report-policy
+const (
+	reportPolicyAlways = "always"
+	reportPolicyWarn   = "warn"
+	reportPolicyChange = "change"
+	reportPolicyDaily  = "daily"
+	reportPolicyWeekly = "weekly"
+)
+
+// reportPolicies are all valid report policies
+var reportPolicies = []string{reportPolicyAlways, reportPolicyWarn, reportPolicyChange, reportPolicyDaily, reportPolicyWeekly}
+
+// isValidReportPolicy returns true if policy is one of reportPolicies
+func isValidReportPolicy(policy string) bool {
+	for _, valid := range reportPolicies {
+		if policy == valid {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Run results as recorded in the report state
+const (
+	runResultOK     = "ok"
+	runResultFailed = "failed"
+)
+
+// reportStateVersion is the version of the format of the report state file
+const reportStateVersion = 1
+
+// unsafeFileNameRegex matches the characters replaced in profile names used in file names
+var unsafeFileNameRegex = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// maxDigestRuns is the number of runs kept for the next digest; older runs are dropped
+const maxDigestRuns = 1000
+
+// DigestRun is a run of the profile as listed in a digest
+type DigestRun struct {
+	Time            time.Time `json:"time"`
+	BackupName      string    `json:"backupName"`
+	Result          string    `json:"result"`
+	LogLevel        string    `json:"logLevel"`
+	Err             string    `json:"error,omitempty"`
+	DurationSeconds float64   `json:"durationSeconds"`
+	Transferred     uint64    `json:"transferred"`
+	FilesChanged    uint64    `json:"filesChanged"`
+}
+
+// reportState is persisted between runs of a profile for report policies that depend on
+// earlier runs, see ReportPolicyStatePath
+type reportState struct {
+	Version int `json:"version"`
+	// Reported is the result of the run last reported, for the change policy
+	Reported string `json:"reported"`
+	// LastDigest is the time the last digest was sent, or the first run was recorded
+	LastDigest time.Time `json:"lastDigest"`
+	// Runs are the runs since the last digest
+	Runs []DigestRun `json:"runs"`
+}
+
+// DefaultStateDir returns the folder state is kept in if --state-dir is not set:
+// $XDG_STATE_HOME/rotating-rsync-backup, or ~/.local/state/rotating-rsync-backup
+func DefaultStateDir() (string, error) {
+	if stateHome := os.Getenv("XDG_STATE_HOME"); stateHome != "" {
+		return filepath.Join(stateHome, "rotating-rsync-backup"), nil
+	}
+
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("could not determine the default state folder, set --state-dir: %v", err)
+	}
+	return filepath.Join(homeDir, ".local", "state", "rotating-rsync-backup"), nil
+}
+
+// jobKey returns a short hash of the sources and targets of the profile, which tells apart
+// profiles of the same name, such as the default name on the command line
+func (options *Options) jobKey() string {
+	parts := []string{}
+	for _, source := range options.sources {
+		parts = append(parts, source.String())
+	}
+	for _, target := range options.targets {
+		parts = append(parts, fmt.Sprintf("%s@%s:%d:%t:%s", target.User, target.Host, target.Port, target.Daemon, target.Path))
+	}
+
+	sum := sha256.Sum256([]byte(strings.Join(parts, "\x00")))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// ReportPolicyStatePath returns the path of the file the report state of the profile is kept
+// in, named after the profile (with characters other than letters, digits, ".", "_" and "-"
+// replaced) and its jobKey
+func (options *Options) ReportPolicyStatePath() (string, error) {
+	stateDir := options.ReportOptions.stateDir
+	if stateDir == "" {
+		var err error
+		if stateDir, err = DefaultStateDir(); err != nil {
+			return "", err
+		}
+	}
+
+	name := unsafeFileNameRegex.ReplaceAllString(options.profileName, "_")
+	return filepath.Join(stateDir, fmt.Sprintf("%s-%s.report.json", name, options.jobKey())), nil
+}
+
+func loadReportState(path string) (*reportState, error) {
+	state := &reportState{Version: reportStateVersion, Reported: runResultOK}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return state, nil
+}
+
+// save writes the state to path, replacing it atomically
+func (state *reportState) save(path string) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, data, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, path)
+}
+
+// runResult returns whether the run failed, see runResultOK and runResultFailed
+func runResult(options *Options) string {
+	if options.hookState.err != "" {
+		return runResultFailed
+	}
+
+	return runResultOK
+}
+
+// newDigestRun describes the run that just ended for digests
+func newDigestRun(options *Options) DigestRun {
+	run := DigestRun{
+		Time:            options.runStarted,
+		BackupName:      options.hookState.backupName,
+		Result:          runResult(options),
+		LogLevel:        options.ReportLogLevel(),
+		Err:             options.hookState.err,
+		DurationSeconds: time.Since(options.runStarted).Seconds(),
+	}
+
+	for _, status := range options.targetStatuses {
+		if status.Stats != nil {
+			run.Transferred += status.Stats.TransferredSize
+		}
+		if status.Changes != nil {
+			run.FilesChanged += status.Changes.Total()
+		}
+	}
+
+	return run
+}
+
+// digestInterval returns the time between digests for the passed policy, or 0 if it does not
+// send digests
+func digestInterval(policy string) time.Duration {
+	switch policy {
+	case reportPolicyDaily:
+		return 24 * time.Hour
+	case reportPolicyWeekly:
+		return 7 * 24 * time.Hour
+	}
+
+	return 0
+}
+
+// SendReport sends the report of the run that just ended, if the configured report policy
+// calls for it: after every run, after runs with warnings or errors, when the run's result
+// differs from the last reported one (the first failure and the recovery), or a digest of
+// all runs once a day or week. Digests are only sent at the end of a run, so a digest falls
+// due with the first run after the interval has passed.
+func SendReport(options *Options) {
+	policy := options.ReportOptions.policy
+	logLevel := options.ReportLogLevel()
+
+	switch policy {
+	case reportPolicyAlways:
+		SendReportMail(options)
+		return
+	case reportPolicyWarn:
+		if logLevel == "INFO" {
+			options.log.Info.Printf("Not sending report mail: no warnings or errors (report policy %s)", policy)
+			return
+		}
+		SendReportMail(options)
+		return
+	}
+
+	statePath, err := options.ReportPolicyStatePath()
+	if err != nil {
+		panic(fmt.Sprintf("Error while reading report state: %v", err))
+	}
+	state, err := loadReportState(statePath)
+	if err != nil {
+		panic(fmt.Sprintf("Error while reading report state: %v", err))
+	}
+
+	result := runResult(options)
+	now := time.Now()
+
+	if interval := digestInterval(policy); interval > 0 {
+		state.Runs = append(state.Runs, newDigestRun(options))
+		if len(state.Runs) > maxDigestRuns {
+			state.Runs = state.Runs[len(state.Runs)-maxDigestRuns:]
+		}
+		if state.LastDigest.IsZero() {
+			state.LastDigest = now
+		}
+
+		// Saved first, so the run is not lost if sending fails
+		if err := state.save(statePath); err != nil {
+			panic(fmt.Sprintf("Error while writing report state: %v", err))
+		}
+
+		if now.Sub(state.LastDigest) < interval {
+			options.log.Info.Printf("Not sending report mail: next %s digest due at %s", policy, state.LastDigest.Add(interval).Format("2006-01-02 15:04"))
+			return
+		}
+
+		if SendDigestMail(options, state.Runs, state.LastDigest) {
+			state.Runs = []DigestRun{}
+			state.LastDigest = now
+		}
+	} else {
+		if result == state.Reported {
+			options.log.Info.Printf("Not sending report mail: result %s unchanged (report policy %s)", result, policy)
+			return
+		}
+
+		if SendReportMail(options) {
+			state.Reported = result
+		}
+	}
+
+	if err := state.save(statePath); err != nil {
+		panic(fmt.Sprintf("Error while writing report state: %v", err))
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newReportOptions returns Options with the passed report policy and a new state folder,
+// removed when the test ends. No SMTP server is configured, so sending mails fails.
+func newReportOptions(t *testing.T, policy string) *Options {
+	folder, err := ioutil.TempDir("", "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(folder) })
+
+	sources, err := ParseSources([]string{"/srv/www/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	targets, err := ParseTargets([]string{"/backups/www"}, "", "", 22)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	options := &Options{
+		profileName: "www",
+		sources:     sources,
+		targets:     targets,
+		log:         NewLogger(ioutil.Discard, false, ""),
+		runStarted:  time.Now(),
+	}
+	options.ReportOptions.policy = policy
+	options.ReportOptions.stateDir = folder
+	return options
+}
+
+// readReportState reads the report state of options, failing the test if there is none
+func readReportState(t *testing.T, options *Options) *reportState {
+	path, err := options.ReportPolicyStatePath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("no report state: %v", err)
+	}
+
+	state, err := loadReportState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return state
+}
+
+func TestDefaultStateDir(t *testing.T) {
+	defer os.Setenv("XDG_STATE_HOME", os.Getenv("XDG_STATE_HOME"))
+
+	os.Setenv("XDG_STATE_HOME", "/var/state")
+	if dir, err := DefaultStateDir(); err != nil || dir != "/var/state/rotating-rsync-backup" {
+		t.Errorf("got %q, %v with XDG_STATE_HOME", dir, err)
+	}
+
+	os.Setenv("XDG_STATE_HOME", "")
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		t.Skip("no home folder")
+	}
+	if dir, err := DefaultStateDir(); err != nil || dir != filepath.Join(homeDir, ".local", "state", "rotating-rsync-backup") {
+		t.Errorf("got %q, %v without XDG_STATE_HOME", dir, err)
+	}
+}
+
+func TestReportPolicyStatePath(t *testing.T) {
+	options := newReportOptions(t, reportPolicyChange)
+	options.profileName = "web/site a"
+
+	path, err := options.ReportPolicyStatePath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(options.ReportOptions.stateDir, "web_site_a-"+options.jobKey()+".report.json"); path != want {
+		t.Errorf("got %s, want %s", path, want)
+	}
+
+	other := newReportOptions(t, reportPolicyChange)
+	if other.jobKey() != options.jobKey() {
+		t.Errorf("same sources and targets got different job keys %s and %s", options.jobKey(), other.jobKey())
+	}
+	if other.targets[0].Path = "/backups/other"; other.jobKey() == options.jobKey() {
+		t.Errorf("different targets got the same job key %s", options.jobKey())
+	}
+}
+
+func TestReportStateSaveAndLoad(t *testing.T) {
+	options := newReportOptions(t, reportPolicyDaily)
+	path, _ := options.ReportPolicyStatePath()
+
+	state, err := loadReportState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Reported != runResultOK || len(state.Runs) != 0 || !state.LastDigest.IsZero() {
+		t.Errorf("got initial state %+v", state)
+	}
+
+	state.Reported = runResultFailed
+	state.Runs = append(state.Runs, DigestRun{BackupName: "2020-01-01_00-00-00", Result: runResultFailed})
+	if err := state.save(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary state file left behind: %v", err)
+	}
+
+	loaded, err := loadReportState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Reported != runResultFailed || len(loaded.Runs) != 1 || loaded.Runs[0].BackupName != "2020-01-01_00-00-00" {
+		t.Errorf("got loaded state %+v", loaded)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadReportState(path); err == nil || !strings.Contains(err.Error(), path) {
+		t.Errorf("got error %v for a corrupt state file", err)
+	}
+}
+
+func TestSendReportChange(t *testing.T) {
+	options := newReportOptions(t, reportPolicyChange)
+
+	// An unchanged result is not reported and leaves no state
+	SendReport(options)
+	path, _ := options.ReportPolicyStatePath()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("got state for an unchanged result: %v", err)
+	}
+
+	// A failure is reported, but remains unreported while the mail cannot be sent
+	options.hookState.err = "rsync failed"
+	SendReport(options)
+	if state := readReportState(t, options); state.Reported != runResultOK {
+		t.Errorf("got reported result %s, although no mail was sent", state.Reported)
+	}
+}
+
+func TestSendReportDigest(t *testing.T) {
+	options := newReportOptions(t, reportPolicyDaily)
+
+	SendReport(options)
+	state := readReportState(t, options)
+	if len(state.Runs) != 1 || state.LastDigest.IsZero() {
+		t.Fatalf("got state %+v after the first run", state)
+	}
+
+	// The digest is due, but is kept along with its runs while the mail cannot be sent
+	path, _ := options.ReportPolicyStatePath()
+	lastDigest := time.Now().Add(-25 * time.Hour).Truncate(time.Second)
+	state.LastDigest = lastDigest
+	if err := state.save(path); err != nil {
+		t.Fatal(err)
+	}
+	SendReport(options)
+	state = readReportState(t, options)
+	if len(state.Runs) != 2 || !state.LastDigest.Equal(lastDigest) {
+		t.Errorf("got state %+v after an unsent digest", state)
+	}
+
+	// At most maxDigestRuns runs are kept
+	state.LastDigest = time.Now()
+	state.Runs = make([]DigestRun, maxDigestRuns)
+	if err := state.save(path); err != nil {
+		t.Fatal(err)
+	}
+	options.hookState.backupName = "latest"
+	SendReport(options)
+	state = readReportState(t, options)
+	if len(state.Runs) != maxDigestRuns || state.Runs[maxDigestRuns-1].BackupName != "latest" {
+		t.Errorf("got %d runs, last %+v", len(state.Runs), state.Runs[len(state.Runs)-1])
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+)
+
+// ResolveBackup resolves a backup reference to the backup's path relative to the target
+// folder, with a trailing slash. A reference is either the name of a backup, "latest" for the most recent backup
+// across all tiers, or "<tier>:<n>" for the n-th most recent backup in a tier (starting
+// at 1), e.g. "weekly:2".
+func ResolveBackup(options *Options, reference string) (string, error) {
+	if reference == "latest" {
+		lastBackup := DetermineLastBackup(options)
+		if lastBackup == "" {
+			return "", fmt.Errorf("no backups found")
+		}
+		return NormalizeFolderPath(lastBackup), nil
+	}
+
+	entries, err := ListBackups(options)
+	if err != nil {
+		return "", err
+	}
+
+	if parts := strings.SplitN(reference, ":", 2); len(parts) == 2 {
+		tier := parts[0]
+		n, err := strconv.Atoi(parts[1])
+		if err != nil || n < 1 {
+			return "", fmt.Errorf("invalid backup reference %q: expected <tier>:<n> with n >= 1", reference)
+		}
+
+		// Entries are sorted most recent first within each tier
+		tierFound := false
+		i := 0
+		for _, entry := range entries {
+			if entry.Tier != tier {
+				continue
+			}
+			tierFound = true
+			if entry.State != backupStateComplete {
+				continue
+			}
+			i++
+			if i == n {
+				return entry.Path, nil
+			}
+		}
+
+		if !tierFound {
+			return "", fmt.Errorf("no backups found in tier %q", tier)
+		}
+		return "", fmt.Errorf("tier %q only contains %d backup(s)", tier, i)
+	}
+
+	for _, entry := range entries {
+		if entry.Name == reference && entry.State == backupStateComplete {
+			return entry.Path, nil
+		}
+	}
+
+	return "", fmt.Errorf("no backup named %q found", reference)
+}
+
+// CleanRestorePath cleans a path inside a backup as passed to --path, keeping a trailing
+// slash. Returns an error if the path leads out of the backup.
+func CleanRestorePath(subPath string) (string, error) {
+	cleaned := filepath.Clean(strings.TrimLeft(subPath, "/"))
+	if cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", fmt.Errorf("path %q leads out of the backup", subPath)
+	}
+
+	if cleaned == "." {
+		return "", nil
+	} else if strings.HasSuffix(subPath, "/") {
+		return cleaned + "/", nil
+	}
+
+	return cleaned, nil
+}
+
+// RestoreBackup copies subPath of the backup at backupRelativePath (relative to the target
+// folder) to the local folder destination using rsync. As with rsync, a trailing slash on
+// subPath restores the contents of a folder rather than the folder itself; an empty subPath
+// restores the contents of the whole backup.
+func RestoreBackup(options *Options, backupRelativePath string, subPath string, destination string, dryRun bool) error {
+	sourcePath := filepath.Join(options.TargetPath(), backupRelativePath, subPath)
+	if subPath == "" || strings.HasSuffix(subPath, "/") {
+		sourcePath = NormalizeFolderPath(sourcePath)
+	}
+
+	args := []string{"-a"}
+	if dryRun {
+		args = append(args, "--dry-run", "-v")
+	}
+	args = append(args, options.Target().RsyncOptions()...)
+
+	args = append(args, options.Target().RsyncPath(sourcePath))
+	args = append(args, NormalizeFolderPath(destination))
+
+	options.log.Info.Printf("Restoring %s to %s", filepath.Join(backupRelativePath, subPath), destination)
+
+	_, _, exitCode, err := call(options, "rsync", args, "rsync", options.log.Info)
+	if err != nil {
+		return fmt.Errorf("rsync exited with exit code %d: %v", exitCode, err)
+	}
+
+	return nil
+}
+
+// isEmptyFolder returns true if the local folder at absPath does not exist or is empty
+func isEmptyFolder(absPath string) (bool, error) {
+	folder, err := os.Open(absPath)
+	if os.IsNotExist(err) {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+	defer folder.Close()
+
+	_, err = folder.Readdirnames(1)
+	if err == io.EOF {
+		return true, nil
+	}
+
+	return false, err
+}
+
+// restoreCommand implements the "restore" command
+func restoreCommand(c *cli.Context) (err error) {
+	defer recoverError(&err)
+
+	optionsList, err := commandProfiles(c)
+	if err != nil {
+		return err
+	}
+	defer closeTargets(optionsList)
+	if len(optionsList) != 1 {
+		return fmt.Errorf("restore: select exactly one profile using --profile")
+	}
+	// For profiles with several targets, backups are restored from the first target
+	options := optionsList[0]
+
+	destination := c.String("to")
+	dryRun := c.Bool("dry-run")
+
+	subPath, err := CleanRestorePath(c.String("path"))
+	if err != nil {
+		return fmt.Errorf("--path: %v", err)
+	}
+
+	if !c.Bool("force") {
+		empty, err := isEmptyFolder(destination)
+		if err != nil {
+			return fmt.Errorf("--to: %v", err)
+		}
+		if !empty {
+			return fmt.Errorf("--to: destination %s is not empty; use --force to restore into it anyway", destination)
+		}
+	}
+
+	backupRelativePath, err := ResolveBackup(options, c.String("from"))
+	if err != nil {
+		return fmt.Errorf("--from: %v", err)
+	}
+	options.log.Info.Printf("Resolved %s to backup %s", c.String("from"), backupRelativePath)
+	if metadata, err := ReadBackupMetadata(options, filepath.Join(options.TargetPath(), backupRelativePath)); err != nil {
+		options.log.Warn.Printf("Could not read metadata of backup %s: %v", backupRelativePath, err)
+	} else if metadata != nil {
+		options.log.Info.Printf("Backup %s", metadata.Describe())
+	}
+
+	if !dryRun {
+		EnsureFolderExists(options, &LocalTarget{}, destination)
+	}
+
+	return RestoreBackup(options, backupRelativePath, subPath, destination, dryRun)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCleanRestorePath(t *testing.T) {
+	tests := []struct {
+		subPath  string
+		expected string
+		err      bool
+	}{
+		{"", "", false},
+		{"/", "", false},
+		{".", "", false},
+		{"html", "html", false},
+		{"html/", "html/", false},
+		{"/srv/www/html/", "srv/www/html/", false},
+		{"html//css/../js", "html/js", false},
+		{"html/../..", "", true},
+		{"../etc/passwd", "", true},
+		{"/../etc/", "", true},
+		{"..", "", true},
+		{"..foo", "..foo", false},
+	}
+
+	for _, test := range tests {
+		cleaned, err := CleanRestorePath(test.subPath)
+		if test.err {
+			if err == nil {
+				t.Errorf("CleanRestorePath(%q) = %q, expected an error", test.subPath, cleaned)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("CleanRestorePath(%q): unexpected error: %v", test.subPath, err)
+		} else if cleaned != test.expected {
+			t.Errorf("CleanRestorePath(%q) = %q, expected %q", test.subPath, cleaned, test.expected)
+		}
+	}
+}
+
+func TestResolveBackup(t *testing.T) {
+	now := time.Now()
+	main := []string{backupName(now, time.Hour), backupName(now, 2*time.Hour)}
+	daily := []string{backupName(now, 72*time.Hour), backupName(now, 96*time.Hour)}
+	interrupted := backupName(now, 30*time.Minute) + "_progress"
+
+	options := newMemoryOptions(t, main[0], main[1], interrupted, "_daily", "_daily/"+daily[0], "_daily/"+daily[1])
+	period, _ := ParseTierPeriod("day")
+	options.tiers = []Tier{{FolderName: "_daily", Period: period, Max: 7}}
+
+	tests := []struct {
+		reference string
+		expected  string
+		err       bool
+	}{
+		{"latest", main[0] + "/", false},
+		{"main:1", main[0] + "/", false},
+		{"main:2", main[1] + "/", false},
+		{"daily:2", "_daily/" + daily[1] + "/", false},
+		{daily[0], "_daily/" + daily[0] + "/", false},
+		{"daily:3", "", true},
+		{"weekly:1", "", true},
+		{"daily:0", "", true},
+		{"daily:x", "", true},
+		{interrupted, "", true},
+		{"2000-01-01_00-00-00", "", true},
+	}
+
+	for _, test := range tests {
+		path, err := ResolveBackup(options, test.reference)
+		if test.err {
+			if err == nil {
+				t.Errorf("ResolveBackup(%q) = %q, expected an error", test.reference, path)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ResolveBackup(%q): unexpected error: %v", test.reference, err)
+		} else if path != test.expected {
+			t.Errorf("ResolveBackup(%q) = %q, expected %q", test.reference, path, test.expected)
+		}
+	}
+}
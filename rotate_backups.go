@@ -2,159 +2,329 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"text/tabwriter"
+	"time"
 
-	"github.com/alessio/shellescape"
+	"github.com/urfave/cli/v2"
 )
 
-// RotateBackups is the main entry point to perform backup rotating/grouping on the target folder
-func RotateBackups(options *Options) {
-	// Move excess from main to daily according to MAIN_MAX
-	HandleExcessBackups(options, options.target, options.DailyFolderPath(), options.maxMain)
+// Rotation action types
+const (
+	rotationActionMove   = "move"
+	rotationActionDelete = "delete"
+)
 
-	// Create __latest symlink in main
-	CreateLatestSymlink(options, options.target)
+// Retention modes, see --retention-mode
+const (
+	retentionModePermissive = "permissive"
+	retentionModeStrict     = "strict"
+)
 
-	// Delete excess in daily (keep oldest from each day), needs no limit
-	GroupBackups(options, options.DailyFolderPath(), backupGroupTypeDay)
+// RotationAction is a single move or deletion performed during rotation. Folder paths are
+// relative to the target folder.
+type RotationAction struct {
+	Action string `json:"action"`
+	Backup string `json:"backup"`
+	From   string `json:"from"`
+	To     string `json:"to,omitempty"`
+	Reason string `json:"reason"`
+}
 
-	// Move excess from daily to weekly according to DAILY_MAX
-	HandleExcessBackups(options, options.DailyFolderPath(), options.WeeklyFolderPath(), options.maxDaily)
+// RotationPlan holds all actions a rotation will perform, in order. While being built, it
+// keeps track of the simulated contents of each folder, so later steps see the effects of
+// earlier ones without anything being touched on the target.
+type RotationPlan struct {
+	Actions []RotationAction
+
+	backups map[string][]string
+	// now is the time backup ages are computed from
+	now time.Time
+	// pins holds the active pins by backup name; pinned backups are never moved or deleted
+	pins map[string]Pin
+}
 
-	// Create __latest symlink in daily
-	CreateLatestSymlink(options, options.DailyFolderPath())
+// folderBackups returns the (simulated) backups in the folder at absPath, listing the folder
+// on the target the first time it is accessed. A folder that does not exist yet, such as a
+// newly enabled tier, contains no backups.
+func (plan *RotationPlan) folderBackups(options *Options, absPath string) []string {
+	absPath = NormalizeFolderPath(absPath)
 
-	// Delete excess in weekly (keep oldest from each week), needs no limit
-	GroupBackups(options, options.WeeklyFolderPath(), backupGroupTypeWeek)
+	if _, ok := plan.backups[absPath]; !ok {
+		stat, err := options.Target().Stat(absPath)
+		if err != nil {
+			panic(fmt.Sprintf("folderBackups: unexpected error while checking for %s existence: %v", absPath, err))
+		}
 
-	// Move excess from weekly to monthly according to WEEKLY_MAX
-	HandleExcessBackups(options, options.WeeklyFolderPath(), options.MonthlyFolderPath(), options.maxWeekly)
+		if stat.Exists {
+			plan.backups[absPath] = ListBackupsInPath(options, absPath, absPath)
+		} else {
+			plan.backups[absPath] = []string{}
+		}
+	}
 
-	// Create __latest symlink in weekly
-	CreateLatestSymlink(options, options.WeeklyFolderPath())
+	return plan.backups[absPath]
+}
 
-	// Delete excess in monthly (keep oldest from each month), needs no limit
-	GroupBackups(options, options.MonthlyFolderPath(), backupGroupTypeMonth)
+// unpinned returns the passed backups without the pinned ones
+func (plan *RotationPlan) unpinned(options *Options, backups []string) []string {
+	unpinned := []string{}
+	for _, backup := range backups {
+		if pin, ok := plan.pins[filepath.Base(backup)]; ok {
+			options.log.Debug.Printf("skipping %s: %s", backup, pin.Describe())
+			continue
+		}
+		unpinned = append(unpinned, backup)
+	}
+
+	return unpinned
+}
+
+// remove records the removal of backup from the folder at fromPath, moving it to toPath
+// unless toPath is empty
+func (plan *RotationPlan) remove(options *Options, backup string, fromPath string, toPath string, reason string) {
+	fromPath = NormalizeFolderPath(fromPath)
+
+	remaining := []string{}
+	for _, b := range plan.backups[fromPath] {
+		if b != backup {
+			remaining = append(remaining, b)
+		}
+	}
+	plan.backups[fromPath] = remaining
+
+	action := RotationAction{
+		Action: rotationActionDelete,
+		Backup: backup,
+		From:   options.TargetRelativePath(fromPath),
+		Reason: reason,
+	}
 
-	// Delete excess from monthly according to MONTHLY_MAX
-	HandleExcessBackups(options, options.MonthlyFolderPath(), "", options.maxMonthly)
+	if toPath != "" {
+		toPath = NormalizeFolderPath(toPath)
+		plan.backups[toPath] = append(plan.folderBackups(options, toPath), backup)
 
-	// Create __latest symlink in monthly
-	CreateLatestSymlink(options, options.MonthlyFolderPath())
+		action.Action = rotationActionMove
+		action.To = options.TargetRelativePath(toPath)
+	}
+
+	plan.Actions = append(plan.Actions, action)
 }
 
-// HandleExcessBackups moves excess - as defined by the "maxFrom" parameter - backups from fromPath
-// to toPath, if toPath is not empty, and deletes them if toPath is empty.
-func HandleExcessBackups(options *Options, fromPath string, toPath string, maxFrom uint) {
-	Log.Info.Printf("> Handling excess backups (> %d) in %s", maxFrom, options.TargetRelativePath(fromPath))
+// Print writes the plan as a table to w
+func (plan *RotationPlan) Print(w io.Writer) {
+	if len(plan.Actions) == 0 {
+		fmt.Fprintln(w, "Nothing to do.")
+		return
+	}
 
-	backupList := ListBackupsInPath(options, fromPath, fromPath)
-	SortBackupList(&backupList, false)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ACTION\tBACKUP\tFROM\tTO\tREASON")
+	for _, action := range plan.Actions {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", action.Action, action.Backup, action.From, action.To, action.Reason)
+	}
+	tw.Flush()
+}
 
-	if uint(len(backupList)) > maxFrom {
-		for i := 0; uint(i) < uint(len(backupList))-maxFrom; i++ {
-			currentBackup := backupList[i]
+// PlanRotation computes all moves and deletions a rotation of the target folder would
+// perform, without changing anything
+func PlanRotation(options *Options) *RotationPlan {
+	plan := &RotationPlan{backups: map[string][]string{}, now: time.Now()}
 
-			if toPath == "" {
-				Log.Info.Printf("Removing %s", currentBackup)
-			} else {
-				Log.Info.Printf("Moving %s to %s", currentBackup, options.TargetRelativePath(toPath))
-			}
+	pins, err := ActivePins(options, plan.now)
+	if err != nil {
+		panic(fmt.Sprintf("PlanRotation: %v", err))
+	}
+	plan.pins = pins
+
+	// Move excess backups down the tier chain, starting with the main folder according to
+	// MAX_MAIN/MAX_MAIN_AGE. Within each tier, only the most recent backup of each period is
+	// kept; excess backups of the last tier are deleted. Pinned backups stay where they are
+	// and do not count against any limit.
+	fromPath := options.TargetPath()
+	maxFrom := options.maxMain
+	maxAgeFrom := options.maxMainAge
 
-			currentFrom := filepath.Join(fromPath, currentBackup)
-			currentTo := filepath.Join(toPath, currentBackup)
+	for _, tier := range options.tiers {
+		tierPath := options.TierFolderPath(tier)
 
-			if options.IsRemoteTarget() {
-				fromQuoted := shellescape.Quote(currentFrom)
-				toQuoted := shellescape.Quote(currentTo)
+		HandleExcessBackups(options, plan, fromPath, tierPath, maxFrom, maxAgeFrom)
+		GroupBackups(options, plan, tierPath, tier.Period)
 
-				cmd := ""
-				if toPath == "" {
-					cmd = fmt.Sprintf("rm -rf %s", fromQuoted)
-				} else {
-					cmd = fmt.Sprintf("mv %s %s", fromQuoted, toQuoted)
+		fromPath = tierPath
+		maxFrom = tier.Max
+		maxAgeFrom = tier.MaxAge
+	}
 
-				}
+	HandleExcessBackups(options, plan, fromPath, "", maxFrom, maxAgeFrom)
 
-				_, _, _, err := sshCall(options, cmd, Log.Debug)
-				if err != nil {
-					panic(fmt.Sprintf("HandleExcessBackups(): Remote: could not execute %s", cmd))
-				}
-			} else {
-				if toPath == "" {
-					err := os.RemoveAll(currentFrom)
-					if err != nil {
-						panic(fmt.Sprintf("HandleExcessBackups(): could not remove %s", options.TargetRelativePath(currentFrom)))
-					}
-				} else {
-					err := os.Rename(currentFrom, currentTo)
-					if err != nil {
-						panic(fmt.Sprintf("HandleExcessBackups(): could not rename %s to %s", options.TargetRelativePath(currentFrom), options.TargetRelativePath(currentTo)))
-					}
-				}
+	// The _error folders of failed backups are not part of the tier chain; they are deleted
+	// once they exceed their own limits
+	PlanErrorBackups(options, plan)
+
+	return plan
+}
+
+// RotateBackups is the main entry point to perform backup rotating/grouping on the target folder
+func RotateBackups(options *Options) *RotationPlan {
+	plan := PlanRotation(options)
+
+	if len(plan.pins) > 0 {
+		options.log.Info.Printf("Pinned backups, skipped by rotation: %d", len(plan.pins))
+		logPins(options, plan.pins)
+	}
+
+	options.log.Info.Printf("Rotation plan: %d action(s)", len(plan.Actions))
+	for _, action := range plan.Actions {
+		if action.Action == rotationActionMove {
+			options.log.Info.Printf("  move %s from %s to %s: %s", action.Backup, action.From, action.To, action.Reason)
+		} else {
+			options.log.Info.Printf("  delete %s from %s: %s", action.Backup, action.From, action.Reason)
+		}
+	}
+
+	ExecuteRotationPlan(options, plan)
+	options.rotationActions = plan.Actions
+
+	// Create __latest symlinks
+	CreateLatestSymlink(options, options.target)
+	for _, tier := range options.tiers {
+		CreateLatestSymlink(options, options.TierFolderPath(tier))
+	}
+
+	logErrorBackups(options)
+
+	if err := RunHooks(options, hookPostRotation); err != nil {
+		panic(err.Error())
+	}
+
+	return plan
+}
 
+// ExecuteRotationPlan performs all actions of the passed plan on the target folder
+func ExecuteRotationPlan(options *Options, plan *RotationPlan) {
+	for _, action := range plan.Actions {
+		currentFrom := filepath.Join(options.TargetPath(), action.From, action.Backup)
+		currentTo := filepath.Join(options.TargetPath(), action.To, action.Backup)
+
+		if action.Action == rotationActionDelete {
+			options.log.Info.Printf("Removing %s", options.TargetRelativePath(currentFrom))
+		} else {
+			options.log.Info.Printf("Moving %s to %s", options.TargetRelativePath(currentFrom), action.To)
+		}
+
+		if action.Action == rotationActionDelete {
+			if err := RemoveBackup(options, currentFrom); err != nil {
+				panic(fmt.Sprintf("ExecuteRotationPlan(): could not remove %s: %v", options.TargetRelativePath(currentFrom), err))
+			}
+		} else {
+			if err := MoveBackup(options, currentFrom, currentTo); err != nil {
+				panic(fmt.Sprintf("ExecuteRotationPlan(): could not rename %s to %s: %v", options.TargetRelativePath(currentFrom), options.TargetRelativePath(currentTo), err))
 			}
 		}
-	} else {
-		Log.Info.Printf("no excess backups (<= %d) in %s, nothing to do", maxFrom, options.TargetRelativePath(fromPath))
 	}
 }
 
-type backupGroupType string
+// HandleExcessBackups plans moving excess backups from fromPath to toPath, if toPath is not
+// empty, and deleting them if toPath is empty. Backups are excess if they exceed the count
+// limit maxFrom and/or are older than maxAgeFrom, depending on the retention mode. A
+// maxAgeFrom of 0 disables the age limit; a maxFrom of 0 disables the count limit if an age
+// limit is set.
+func HandleExcessBackups(options *Options, plan *RotationPlan, fromPath string, toPath string, maxFrom uint, maxAgeFrom time.Duration) {
+	options.log.Debug.Printf("> Handling excess backups (> %d, older than %s, %s) in %s", maxFrom, FormatDuration(maxAgeFrom), options.retentionMode, options.TargetRelativePath(fromPath))
 
-const (
-	backupGroupTypeDay   backupGroupType = "Day"
-	backupGroupTypeWeek                  = "Week"
-	backupGroupTypeMonth                 = "Month"
-)
+	backupList := plan.unpinned(options, plan.folderBackups(options, fromPath))
+	SortBackupList(&backupList, false)
+
+	useCount := maxFrom > 0 || maxAgeFrom == 0
+	useAge := maxAgeFrom > 0
 
-// GroupBackups "groups" backups in the passed sourcePath by keeping only the configured amount
-// of most recent backups for the passed backupGroupType
-func GroupBackups(options *Options, sourcePath string, groupBy backupGroupType) {
-	Log.Info.Printf("> Grouping excess backups in %s by %s", options.TargetRelativePath(sourcePath), groupBy)
+	excessCount := 0
+	if useCount && uint(len(backupList)) > maxFrom {
+		excessCount = len(backupList) - int(maxFrom)
+	}
 
-	backupList := ListBackupsInPath(options, sourcePath, sourcePath)
+	found := false
+	for i, backup := range backupList {
+		backupTime, err := BackupNameToTime(filepath.Base(backup))
+		if err != nil {
+			panic(fmt.Sprintf("HandleExcessBackups: error parsing backup folder %s into time: %v", backup, err))
+		}
+
+		exceedsCount := useCount && i < excessCount
+		exceedsAge := useAge && BackupAge(backupTime, plan.now) > maxAgeFrom
+
+		var excess bool
+		var reason string
+		switch {
+		case useCount && useAge && options.retentionMode == retentionModeStrict:
+			excess = exceedsCount || exceedsAge
+		case useCount && useAge:
+			excess = exceedsCount && exceedsAge
+		case useAge:
+			excess = exceedsAge
+		default:
+			excess = exceedsCount
+		}
+
+		if !excess {
+			continue
+		}
+
+		if exceedsCount && exceedsAge {
+			reason = fmt.Sprintf("excess (> %d) and older than %s", maxFrom, FormatDuration(maxAgeFrom))
+		} else if exceedsAge {
+			reason = fmt.Sprintf("older than %s", FormatDuration(maxAgeFrom))
+		} else {
+			reason = fmt.Sprintf("excess (> %d)", maxFrom)
+		}
+
+		plan.remove(options, backup, fromPath, toPath, reason)
+		found = true
+	}
+
+	if !found {
+		options.log.Debug.Printf("no excess backups in %s, nothing to do", options.TargetRelativePath(fromPath))
+	}
+}
+
+// GroupBackups "groups" backups in the passed sourcePath by planning the deletion of all but
+// the most recent backup for each period of the passed TierPeriod
+func GroupBackups(options *Options, plan *RotationPlan, sourcePath string, groupBy TierPeriod) {
+	options.log.Debug.Printf("> Grouping excess backups in %s by %s", options.TargetRelativePath(sourcePath), groupBy)
+
+	backupList := plan.unpinned(options, plan.folderBackups(options, sourcePath))
 	SortBackupList(&backupList, true)
 
-	currentOverallGroup := 0
+	var currentOverallGroup int64
 
 	for _, currentBackup := range backupList {
-		Log.Debug.Printf("groupBackups: current backup: %s", currentBackup)
+		options.log.Debug.Printf("groupBackups: current backup: %s", currentBackup)
 
 		backupTime, err := BackupNameToTime(currentBackup)
 		if err != nil {
 			panic(fmt.Sprintf("groupBackups: error parsing backup folder %s into time: %v", currentBackup, err))
 		}
 
-		thisBackupGroup := 0
+		thisBackupGroup := groupBy.Group(backupTime)
 
-		if groupBy == backupGroupTypeDay {
-			thisBackupGroup = backupTime.Year()*10000 + int(backupTime.Month())*100 + backupTime.Day()
-		} else if groupBy == backupGroupTypeWeek {
-			year, week := backupTime.ISOWeek()
-			thisBackupGroup = year*10000 + week*100
-		} else if groupBy == backupGroupTypeMonth {
-			thisBackupGroup = backupTime.Year()*10000 + int(backupTime.Month())*100
-		} else {
-			panic(fmt.Sprintf("groupBackups: invalid BackupGroupType %s", groupBy))
-		}
-
-		Log.Debug.Printf("groupBackups: current backup group: %d", thisBackupGroup)
+		options.log.Debug.Printf("groupBackups: current backup group: %d", thisBackupGroup)
 
 		keepBackup := false
 
 		if currentOverallGroup == 0 {
 			// Current backup is first overall and thus by definition first of current
 			// group, since most recent in current group.
-			Log.Debug.Printf("groupBackups: first backup in list, keeping")
+			options.log.Debug.Printf("groupBackups: first backup in list, keeping")
 
 			keepBackup = true
 			currentOverallGroup = thisBackupGroup
 		} else if thisBackupGroup == currentOverallGroup {
 			// Current backup's "group" has already occured; the first occurence was kept (by definition),
 			// so we can discard this one
-			Log.Debug.Printf("groupBackups: group reoccurence, discarding")
+			options.log.Debug.Printf("groupBackups: group reoccurence, discarding")
 
 			keepBackup = false
 		} else if thisBackupGroup > currentOverallGroup {
@@ -162,7 +332,7 @@ func GroupBackups(options *Options, sourcePath string, groupBy backupGroupType)
 			// and the case for currentOverallGroup == 0 was handled first
 			panic(fmt.Sprintf("groupBackups: unexpected case of thisBackupGroup > currentOverallGroup on backup %s, list: %v", currentBackup, backupList))
 		} else if thisBackupGroup < currentOverallGroup {
-			Log.Debug.Printf("groupBackups: new group, keeping")
+			options.log.Debug.Printf("groupBackups: new group, keeping")
 
 			keepBackup = true
 			currentOverallGroup = thisBackupGroup
@@ -170,79 +340,38 @@ func GroupBackups(options *Options, sourcePath string, groupBy backupGroupType)
 			panic(fmt.Sprintf("groupBackups: unexpected fallthrough to edge case, current backup: %s, list: %v", currentBackup, backupList))
 		}
 
-		if keepBackup {
-			continue
-		} else {
-			fullPath := filepath.Join(sourcePath, currentBackup)
-			Log.Info.Printf("discarding: %s", currentBackup)
-
-			if options.IsRemoteTarget() {
-				pathQuoted := shellescape.Quote(fullPath)
-				cmd := fmt.Sprintf("rm -rf %s", pathQuoted)
-
-				_, _, _, err := sshCall(options, cmd, Log.Debug)
-				if err != nil {
-					panic(fmt.Sprintf("groupBackups(): Remote: could not execute %s", cmd))
-				}
-			} else {
-				err := os.RemoveAll(fullPath)
-				if err != nil {
-					panic(fmt.Sprintf("groupBackups(): could not remove folder %s", options.TargetRelativePath(fullPath)))
-				}
-			}
+		if !keepBackup {
+			plan.remove(options, currentBackup, sourcePath, "", fmt.Sprintf("not the most recent of its %s", groupBy.Describe()))
 		}
 	}
 }
 
 func CreateLatestSymlink(options *Options, targetPath string) {
-	Log.Info.Printf("Creating symlink to latest backup in %s\n", targetPath)
+	options.log.Info.Printf("Creating symlink to latest backup in %s\n", targetPath)
 
 	latestBackupFolder := DetermineNewestBackupInFolder(options, targetPath)
 
 	targetPath = NormalizeFolderPath(targetPath)
 
 	// Path to new symlink
-	symlinkPath := filepath.Join(targetPath, "__latest")
+	symlinkPath := filepath.Join(targetPath, LatestSymlinkName)
 
 	// Delete the existing symlink or dummy directory if it exists
-	if options.IsRemoteTarget() {
-		_, _, _, err := sshCall(
-			options,
-			fmt.Sprintf("if [ -L %s ] || [ -d %s ]; then rm -rf %s; fi", shellescape.Quote(symlinkPath), shellescape.Quote(symlinkPath), shellescape.Quote(symlinkPath)),
-			Log.Debug,
-		)
-		if err != nil {
-			Log.Error.Printf("Failed to remove symlink or directory at %s: %v\n", symlinkPath, err)
+	if stat, err := options.Target().Stat(symlinkPath); err != nil {
+		options.log.Error.Printf("Failed to check for symlink or directory at %s: %v\n", symlinkPath, err)
+		return
+	} else if stat.Exists {
+		if err := options.Target().RemoveAll(symlinkPath); err != nil {
+			options.log.Error.Printf("Failed to remove symlink or directory at %s: %v\n", symlinkPath, err)
 			return
 		}
-	} else {
-		if _, err := os.Lstat(symlinkPath); err == nil {
-			if err := os.RemoveAll(symlinkPath); err != nil {
-				Log.Error.Printf("Failed to remove symlink or directory at %s: %v\n", symlinkPath, err)
-				return
-			}
-		}
 	}
 
 	// If no backups were found
 	if latestBackupFolder == "" {
-		Log.Info.Println("No backups found. Creating directory instead of symlink.")
-		if options.IsRemoteTarget() {
-			_, _, _, err := sshCall(
-				options,
-				fmt.Sprintf("mkdir -p %s", shellescape.Quote(symlinkPath)),
-				Log.Debug,
-			)
-			if err != nil {
-				Log.Error.Printf("Failed to create directory at %s: %v\n", symlinkPath, err)
-				return
-			}
-		} else {
-			err := os.MkdirAll(symlinkPath, 0755)
-			if err != nil {
-				Log.Error.Printf("Could not create directory at %s: %v\n", symlinkPath, err)
-				return
-			}
+		options.log.Info.Println("No backups found. Creating directory instead of symlink.")
+		if err := options.Target().MkdirAll(symlinkPath, 0755); err != nil {
+			options.log.Error.Printf("Could not create directory at %s: %v\n", symlinkPath, err)
 		}
 		return
 	}
@@ -250,21 +379,37 @@ func CreateLatestSymlink(options *Options, targetPath string) {
 	latestBackupFolder = NormalizeFolderPath(latestBackupFolder)
 
 	// Create a new symlink
-	if options.IsRemoteTarget() {
-		_, _, _, err := sshCall(
-			options,
-			fmt.Sprintf("ln -s %s %s", shellescape.Quote(latestBackupFolder), shellescape.Quote(symlinkPath)),
-			Log.Debug,
-		)
-		if err != nil {
-			Log.Error.Printf("Failed to create symlink at %s: %v\n", symlinkPath, err)
-			return
-		}
-	} else {
-		err := os.Symlink(latestBackupFolder, symlinkPath)
-		if err != nil {
-			Log.Error.Printf("Could not create symlink at %s: %v\n", symlinkPath, err)
-			return
+	if err := options.Target().Symlink(latestBackupFolder, symlinkPath); err != nil {
+		options.log.Error.Printf("Could not create symlink at %s: %v\n", symlinkPath, err)
+	}
+}
+
+// rotateCommand implements the "rotate" command
+func rotateCommand(c *cli.Context) (err error) {
+	defer recoverError(&err)
+
+	optionsList, err := commandProfiles(c)
+	if err != nil {
+		return err
+	}
+	defer closeTargets(optionsList)
+
+	for _, profileOptions := range optionsList {
+		targetOptionsList := profileOptions.TargetOptions()
+		defer closeTargets(targetOptionsList)
+
+		for _, options := range targetOptionsList {
+			if c.Bool("dry-run") {
+				ValidateTargetFolder(options)
+				fmt.Printf("Profile %s (%s):\n", options.ProfileDescription(), options.TargetPath())
+				PlanRotation(options).Print(os.Stdout)
+				fmt.Println()
+			} else {
+				PrepareTargetFolder(options)
+				RotateBackups(options)
+			}
 		}
 	}
+
+	return nil
 }
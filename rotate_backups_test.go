@@ -0,0 +1,139 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// newMemoryOptions returns Options for the target folder /backups on a MemoryTarget
+// containing the passed folders, relative to the target folder
+func newMemoryOptions(t *testing.T, folders ...string) *Options {
+	target := NewMemoryTarget()
+	options := &Options{
+		target:        "/backups",
+		log:           NewLogger(ioutil.Discard, false, ""),
+		targetBackend: target,
+	}
+
+	for _, folder := range append([]string{""}, folders...) {
+		if err := target.MkdirAll(filepath.Join("/backups", folder), 0700); err != nil {
+			t.Fatalf("MkdirAll(%s): %v", folder, err)
+		}
+	}
+
+	return options
+}
+
+// backupName returns the name of a backup created age ago
+func backupName(now time.Time, age time.Duration) string {
+	return now.Add(-age).Format(BackupFolderTimeFormat)
+}
+
+// plannedBackups returns the backups the plan performs action on, sorted
+func plannedBackups(plan *RotationPlan, action string) []string {
+	backups := []string{}
+	for _, planned := range plan.Actions {
+		if planned.Action == action {
+			backups = append(backups, planned.Backup)
+		}
+	}
+	sort.Strings(backups)
+
+	return backups
+}
+
+func TestHandleExcessBackups(t *testing.T) {
+	now := time.Now()
+	ages := []time.Duration{1 * time.Hour, 2 * time.Hour, 3 * time.Hour, 4 * time.Hour, 5 * time.Hour}
+	names := []string{}
+	for _, age := range ages {
+		names = append(names, backupName(now, age))
+	}
+
+	tests := []struct {
+		name          string
+		max           uint
+		maxAge        time.Duration
+		retentionMode string
+		toPath        string
+		// excess are the indices into names of the backups expected to be moved or deleted
+		excess []int
+	}{
+		{"count", 3, 0, retentionModePermissive, "/backups/_daily", []int{3, 4}},
+		{"count within limit", 5, 0, retentionModePermissive, "/backups/_daily", []int{}},
+		{"age", 0, 150 * time.Minute, retentionModePermissive, "/backups/_daily", []int{2, 3, 4}},
+		{"permissive", 4, 150 * time.Minute, retentionModePermissive, "/backups/_daily", []int{4}},
+		{"strict", 4, 150 * time.Minute, retentionModeStrict, "/backups/_daily", []int{2, 3, 4}},
+		{"delete", 3, 0, retentionModePermissive, "", []int{3, 4}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			options := newMemoryOptions(t, names...)
+			options.retentionMode = test.retentionMode
+			plan := &RotationPlan{backups: map[string][]string{}, now: now}
+
+			HandleExcessBackups(options, plan, options.TargetPath(), test.toPath, test.max, test.maxAge)
+
+			expected := []string{}
+			for _, i := range test.excess {
+				expected = append(expected, names[i])
+			}
+			sort.Strings(expected)
+
+			action := rotationActionMove
+			if test.toPath == "" {
+				action = rotationActionDelete
+			}
+			if len(plan.Actions) != len(expected) {
+				t.Fatalf("got %d actions, expected %d: %v", len(plan.Actions), len(expected), plan.Actions)
+			}
+			if actual := plannedBackups(plan, action); !reflect.DeepEqual(actual, expected) {
+				t.Errorf("%s %v, expected %v", action, actual, expected)
+			}
+		})
+	}
+}
+
+func TestPlanRotation(t *testing.T) {
+	now := time.Now()
+	recent := []string{backupName(now, time.Hour), backupName(now, 2*time.Hour)}
+	old := []string{backupName(now, 72*time.Hour), backupName(now, 96*time.Hour), backupName(now, 120*time.Hour)}
+
+	options := newMemoryOptions(t, append(append([]string{"_daily"}, recent...), old...)...)
+	options.maxMain = 2
+	period, _ := ParseTierPeriod("day")
+	options.tiers = []Tier{{FolderName: "_daily", Period: period, Max: 2}}
+
+	plan := PlanRotation(options)
+
+	expectedMoves := append([]string{}, old...)
+	sort.Strings(expectedMoves)
+	if moves := plannedBackups(plan, rotationActionMove); !reflect.DeepEqual(moves, expectedMoves) {
+		t.Errorf("moved %v, expected %v", moves, expectedMoves)
+	}
+	// The oldest backup exceeds the limit of the last tier
+	if deletions := plannedBackups(plan, rotationActionDelete); !reflect.DeepEqual(deletions, []string{old[2]}) {
+		t.Errorf("deleted %v, expected %v", deletions, []string{old[2]})
+	}
+
+	ExecuteRotationPlan(options, plan)
+
+	for folder, expected := range map[string][]string{
+		"/backups":        {"_daily", recent[1], recent[0]},
+		"/backups/_daily": {old[1], old[0]},
+	} {
+		actual, err := options.Target().ListFolders(folder)
+		if err != nil {
+			t.Fatalf("ListFolders(%s): %v", folder, err)
+		}
+		sort.Strings(expected)
+		if !reflect.DeepEqual(actual, expected) {
+			t.Errorf("%s contains %v after rotation, expected %v", folder, actual, expected)
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rsyncOutFormatPrefix starts every line rsync prints for a transferred or deleted file, see
+// rsyncOutFormat. It tells these lines apart from all other output.
+const rsyncOutFormatPrefix = "rrb> "
+
+// rsyncOutFormat is the --out-format rsync is called with: the itemized changes (see rsync's
+// --itemize-changes), the file size, the file name and, for symlinks, their destination
+const rsyncOutFormat = rsyncOutFormatPrefix + "%i %l %n%L"
+
+// rsyncStatsNumberRegex matches the first number on a line of rsync's --stats output, with
+// thousands separators and optionally a unit suffix (with --human-readable)
+var rsyncStatsNumberRegex = regexp.MustCompile(`([\d,.]+)([KMGTP]?)`)
+
+// RsyncStats holds the transfer statistics of a backup, as printed by rsync's --stats
+type RsyncStats struct {
+	FilesTotal       uint64  `json:"filesTotal"`
+	FilesCreated     uint64  `json:"filesCreated"`
+	FilesDeleted     uint64  `json:"filesDeleted"`
+	FilesTransferred uint64  `json:"filesTransferred"`
+	TotalSize        uint64  `json:"totalSize"`
+	TransferredSize  uint64  `json:"transferredSize"`
+	LiteralData      uint64  `json:"literalData"`
+	MatchedData      uint64  `json:"matchedData"`
+	BytesSent        uint64  `json:"bytesSent"`
+	BytesReceived    uint64  `json:"bytesReceived"`
+	Speedup          float64 `json:"speedup"`
+	DurationSeconds  float64 `json:"durationSeconds"`
+
+	// parsed is set once a line with a statistic was parsed
+	parsed bool
+}
+
+// fields maps the labels of rsync's --stats output lines to the fields they set
+func (stats *RsyncStats) fields() map[string]*uint64 {
+	return map[string]*uint64{
+		"Number of files":                     &stats.FilesTotal,
+		"Number of created files":             &stats.FilesCreated,
+		"Number of deleted files":             &stats.FilesDeleted,
+		"Number of regular files transferred": &stats.FilesTransferred,
+		"Total file size":                     &stats.TotalSize,
+		"Total transferred file size":         &stats.TransferredSize,
+		"Literal data":                        &stats.LiteralData,
+		"Matched data":                        &stats.MatchedData,
+		"Total bytes sent":                    &stats.BytesSent,
+		"Total bytes received":                &stats.BytesReceived,
+	}
+}
+
+// parseLine parses a line of rsync's --stats output into the matching field, returning
+// false if the line is not part of the statistics
+func (stats *RsyncStats) parseLine(line string) bool {
+	if strings.HasPrefix(line, "File list ") || (strings.HasPrefix(line, "sent ") && strings.HasSuffix(line, "/sec")) {
+		// Statistics not kept
+		return true
+	}
+
+	if strings.HasPrefix(line, "total size is ") {
+		if index := strings.Index(line, "speedup is "); index >= 0 {
+			value := strings.NewReplacer(",", "").Replace(strings.Fields(line[index+len("speedup is "):])[0])
+			stats.Speedup, _ = strconv.ParseFloat(value, 64)
+		}
+		return true
+	}
+
+	separator := strings.Index(line, ": ")
+	if separator < 0 {
+		return false
+	}
+
+	field, ok := stats.fields()[line[:separator]]
+	if !ok {
+		return false
+	}
+
+	if value, ok := parseRsyncStatsNumber(line[separator+2:]); ok {
+		*field = value
+		stats.parsed = true
+	}
+	return true
+}
+
+// parseRsyncStatsNumber parses the first number in value, e.g. "1,234 bytes" or, with
+// --human-readable, "1.23M bytes"
+func parseRsyncStatsNumber(value string) (uint64, bool) {
+	matches := rsyncStatsNumberRegex.FindStringSubmatch(value)
+	if matches == nil {
+		return 0, false
+	}
+
+	if matches[2] == "" {
+		number, err := strconv.ParseUint(strings.NewReplacer(",", "", ".", "").Replace(matches[1]), 10, 64)
+		return number, err == nil
+	}
+
+	number, err := strconv.ParseFloat(strings.Replace(matches[1], ",", "", -1), 64)
+	if err != nil {
+		return 0, false
+	}
+	for _, unit := range "KMGTP" {
+		number *= 1024
+		if string(unit) == matches[2] {
+			break
+		}
+	}
+
+	return uint64(number), true
+}
+
+// Summary returns a one-line summary of the statistics for logs and reports
+func (stats RsyncStats) Summary() string {
+	return fmt.Sprintf(
+		"%d files (%d created, %d deleted, %d transferred), %s total, %s sent, %s received, %s literal, %s matched, speedup %.2f, took %s",
+		stats.FilesTotal,
+		stats.FilesCreated,
+		stats.FilesDeleted,
+		stats.FilesTransferred,
+		FormatBytes(stats.TotalSize),
+		FormatBytes(stats.BytesSent),
+		FormatBytes(stats.BytesReceived),
+		FormatBytes(stats.LiteralData),
+		FormatBytes(stats.MatchedData),
+		stats.Speedup,
+		time.Duration(stats.DurationSeconds*float64(time.Second)).Round(100*time.Millisecond),
+	)
+}
+
+// rsyncOutput processes the output of the rsync call creating a backup: the statistics and
+// changes are collected, and the lines for each changed file and the statistics are only
+// logged at debug level, unless the configured rsync options ask for them (-v or -i, and
+// --stats), as they did before rsync was always called with --out-format and --stats. All
+// other output is logged as usual.
+type rsyncOutput struct {
+	options *Options
+	log     lineHandler
+	// logChanges and logStats are true if the lines for each changed file and the statistics
+	// are logged at info level
+	logChanges bool
+	logStats   bool
+
+	mutex   sync.Mutex
+	stats   RsyncStats
+	changes *ChangeSummary
+}
+
+func newRsyncOutput(options *Options) *rsyncOutput {
+	return &rsyncOutput{
+		options:    options,
+		log:        logLines("rsync", options.log.Info),
+		logChanges: hasRsyncOption(options.rsyncOptions, 'v', "--verbose") || hasRsyncOption(options.rsyncOptions, 'i', "--itemize-changes"),
+		logStats:   hasRsyncOption(options.rsyncOptions, 0, "--stats"),
+		changes:    NewChangeSummary(),
+	}
+}
+
+// hasRsyncOption returns true if args contain the long option, or the short option on its
+// own or combined with others (e.g. "-av" for 'v')
+func hasRsyncOption(args []string, short rune, long string) bool {
+	for _, arg := range args {
+		if arg == long {
+			return true
+		}
+		if short != 0 && strings.HasPrefix(arg, "-") && !strings.HasPrefix(arg, "--") && strings.ContainsRune(arg[1:], short) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (output *rsyncOutput) handleLine(streamName string, line string) {
+	output.mutex.Lock()
+	defer output.mutex.Unlock()
+
+	if streamName == "stdout" {
+		if line == "" {
+			return
+		}
+
+		if strings.HasPrefix(line, rsyncOutFormatPrefix) {
+			change := strings.TrimPrefix(line, rsyncOutFormatPrefix)
+			if output.logChanges {
+				output.log(streamName, change)
+			} else {
+				output.options.log.Debug.Printf("[ rsync ] %s", change)
+			}
+			output.changes.Add(change)
+			return
+		}
+
+		if output.stats.parseLine(line) {
+			if output.logStats {
+				output.log(streamName, line)
+			} else {
+				output.options.log.Debug.Printf("[ rsync stats ] %s", line)
+			}
+			return
+		}
+	}
+
+	output.log(streamName, line)
+}
+
+// Stats returns the collected statistics, or nil if rsync did not print any
+func (output *rsyncOutput) Stats() *RsyncStats {
+	output.mutex.Lock()
+	defer output.mutex.Unlock()
+
+	if !output.stats.parsed {
+		return nil
+	}
+
+	stats := output.stats
+	return &stats
+}
+
+// Changes returns the summary of the changes rsync made
+func (output *rsyncOutput) Changes() *ChangeSummary {
+	output.mutex.Lock()
+	defer output.mutex.Unlock()
+
+	output.changes.trimTop()
+	changes := *output.changes
+	changes.Top = append([]ChangedPath{}, output.changes.Top...)
+	return &changes
+}
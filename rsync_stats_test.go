@@ -0,0 +1,27 @@
+package main
+
+import "testing"
+
+func TestParseRsyncStatsNumber(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected uint64
+		ok       bool
+	}{
+		{"1,234 bytes", 1234, true},
+		{"12,345,678 (reg: 1,000, dir: 234)", 12345678, true},
+		{"0", 0, true},
+		{"2K bytes", 2048, true},
+		{"1.5M bytes", 1572864, true},
+		{"1.00G", 1073741824, true},
+		{"bytes", 0, false},
+		{"", 0, false},
+	}
+
+	for _, test := range tests {
+		number, ok := parseRsyncStatsNumber(test.value)
+		if ok != test.ok || number != test.expected {
+			t.Errorf("parseRsyncStatsNumber(%q) = %d, %t, expected %d, %t", test.value, number, ok, test.expected, test.ok)
+		}
+	}
+}
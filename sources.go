@@ -0,0 +1,283 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/google/shlex"
+)
+
+// remoteShellSourceRegex matches sources in rsync's remote shell syntax, [user@]host:path.
+// Daemon sources (host::module) are excluded by requiring the path not to start with a colon.
+var remoteShellSourceRegex = regexp.MustCompile("^(?:([^@/:]+)@)?([^@/:]+):([^:].*)$")
+
+// Source is a folder backed up by rsync: either a local folder, or a folder pulled from a
+// remote host over ssh or from an rsync daemon
+type Source struct {
+	// Host is the remote host to pull from; empty for local sources
+	Host string
+	User string
+	// Port is the ssh or rsync daemon port of the remote host; 0 means the default
+	Port uint
+	// Daemon is set for sources pulled from an rsync daemon
+	Daemon bool
+	// Path is the folder's path, passed to rsync as is. As with rsync, a trailing slash
+	// transfers the folder's contents rather than the folder itself. For daemon sources, it
+	// starts with the module name.
+	Path string
+	// SSHOptions are ssh options for the remote host, added to --ssh-options
+	SSHOptions []string
+	// RsyncPath is the rsync command on the remote host, see rsync's --rsync-path
+	RsyncPath string
+}
+
+// ParseSource parses a source definition: a local path, a remote path in rsync's remote
+// shell syntax ([user@]host:path), an ssh URL of the form
+// ssh://[user@]host[:port]/path[?ssh-options=<options>&rsync-path=<command>], or a path on an
+// rsync daemon as rsync://[user@]host[:port]/module/path or [user@]host::module/path
+func ParseSource(definition string) (Source, error) {
+	definition = strings.TrimSpace(definition)
+	if definition == "" {
+		return Source{}, fmt.Errorf("empty source")
+	}
+
+	if strings.HasPrefix(definition, "rsync://") || strings.Contains(definition, "::") {
+		host, user, port, absPath, err := parseDaemonURL(definition)
+		if err != nil {
+			return Source{}, fmt.Errorf("invalid source %q: %v", definition, err)
+		}
+		if port == rsyncDaemonDefaultPort {
+			port = 0
+		}
+
+		return Source{Host: host, User: user, Port: port, Daemon: true, Path: absPath}, nil
+	}
+
+	if strings.HasPrefix(definition, "ssh://") {
+		return parseSSHSourceURL(definition)
+	}
+
+	if matches := remoteShellSourceRegex.FindStringSubmatch(definition); matches != nil {
+		return Source{User: matches[1], Host: matches[2], Path: matches[3]}, nil
+	}
+
+	return Source{Path: definition}, nil
+}
+
+// parseSSHSourceURL parses a source of the form ssh://[user@]host[:port]/path[?query]
+func parseSSHSourceURL(definition string) (Source, error) {
+	sourceURL, err := url.Parse(definition)
+	if err != nil {
+		return Source{}, fmt.Errorf("invalid source %q: %v", definition, err)
+	}
+
+	source := Source{
+		Host: sourceURL.Hostname(),
+		Path: sourceURL.Path,
+	}
+	if source.Host == "" {
+		return Source{}, fmt.Errorf("invalid source %q: missing host", definition)
+	}
+	if source.Path == "" || source.Path == "/" {
+		return Source{}, fmt.Errorf("invalid source %q: missing path", definition)
+	}
+	if sourceURL.User != nil {
+		source.User = sourceURL.User.Username()
+	}
+	if sourceURL.Port() != "" {
+		port, err := strconv.ParseUint(sourceURL.Port(), 10, 16)
+		if err != nil || port == 0 {
+			return Source{}, fmt.Errorf("invalid source %q: invalid port %q", definition, sourceURL.Port())
+		}
+		source.Port = uint(port)
+	}
+
+	for key, values := range sourceURL.Query() {
+		value := values[len(values)-1]
+
+		switch key {
+		case "ssh-options":
+			sshOptions, err := shlex.Split(value)
+			if err != nil {
+				return Source{}, fmt.Errorf("invalid source %q: invalid ssh options: %v", definition, err)
+			}
+			source.SSHOptions = sshOptions
+		case "rsync-path":
+			source.RsyncPath = value
+		default:
+			return Source{}, fmt.Errorf("invalid source %q: unknown parameter %q, expected ssh-options or rsync-path", definition, key)
+		}
+	}
+
+	return source, nil
+}
+
+// ParseSources parses a list of source definitions, see ParseSource. All remote sources must
+// share the same connection settings, since all sources are transferred by a single rsync
+// call, and local and remote sources cannot be mixed.
+func ParseSources(definitions []string) ([]Source, error) {
+	sources := []Source{}
+
+	for _, definition := range definitions {
+		source, err := ParseSource(definition)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(sources) > 0 && source.connection() != sources[0].connection() {
+			return nil, fmt.Errorf("sources %s and %s: all sources must be local or on the same remote host with the same settings; use one profile per host", sources[0], source)
+		}
+
+		sources = append(sources, source)
+	}
+
+	return sources, nil
+}
+
+// IsRemote returns true if the source is pulled from a remote host
+func (source Source) IsRemote() bool {
+	return source.Host != ""
+}
+
+func (source Source) String() string {
+	if !source.IsRemote() {
+		return source.Path
+	} else if source.Daemon {
+		return daemonURL(source.Host, source.User, source.Port, source.Path)
+	}
+
+	sourceURL := url.URL{Scheme: "ssh", Host: source.Host, Path: source.Path}
+	if source.User != "" {
+		sourceURL.User = url.User(source.User)
+	}
+	if source.Port != 0 {
+		sourceURL.Host = fmt.Sprintf("%s:%d", source.Host, source.Port)
+	}
+
+	return sourceURL.String()
+}
+
+// connection returns a string identifying the settings used to connect to the source's host
+func (source Source) connection() string {
+	return strings.Join(append([]string{source.Host, source.User, strconv.Itoa(int(source.Port)), strconv.FormatBool(source.Daemon), source.RsyncPath}, source.SSHOptions...), "\x00")
+}
+
+// ConnectionSSHOptions returns the ssh options used to connect to the source's host: the
+// configured ssh options followed by the source's own ones, its user as -l and its port as -p
+func (source Source) ConnectionSSHOptions(options *Options) []string {
+	sshOptions := append(options.SSHOptions(), source.SSHOptions...)
+	if source.User != "" {
+		sshOptions = append(sshOptions, "-l", source.User)
+	}
+	if source.Port != 0 {
+		sshOptions = append(sshOptions, "-p", strconv.Itoa(int(source.Port)))
+	}
+
+	return sshOptions
+}
+
+// RsyncOptions returns the options rsync needs to pull from the source's host: the remote
+// shell and remote rsync command for ssh sources, the password file for daemon sources
+func (source Source) RsyncOptions(options *Options) []string {
+	if !source.IsRemote() {
+		return []string{}
+	} else if source.Daemon {
+		return daemonRsyncOptions(options)
+	}
+
+	rsyncOptions := []string{}
+	if source.RsyncPath != "" {
+		rsyncOptions = append(rsyncOptions, "--rsync-path", source.RsyncPath)
+	}
+
+	return append(rsyncOptions, "-e", fmt.Sprintf("ssh %s", strings.Join(source.ConnectionSSHOptions(options), " ")))
+}
+
+// RsyncArg returns the source in the form rsync expects it as source argument. For ssh
+// sources, the user and port are passed to ssh, see ConnectionSSHOptions.
+func (source Source) RsyncArg() string {
+	if !source.IsRemote() {
+		return source.Path
+	} else if source.Daemon {
+		return source.String()
+	}
+
+	return fmt.Sprintf("%s:%s", source.Host, source.Path)
+}
+
+// ValidateSources checks that all sources exist and are folders before anything is
+// transferred, connecting to the source host for remote sources. The result for each source
+// is logged; if any source is unavailable, the run fails.
+func ValidateSources(options *Options) {
+	options.log.Info.Printf("Checking sources")
+
+	var remote Target
+	if len(options.sources) > 0 && options.sources[0].IsRemote() {
+		// All remote sources share the same connection, see ParseSources
+		if options.sources[0].Daemon {
+			remote = NewDaemonTarget(options, options.sources[0].Host, options.sources[0].User, options.sources[0].Port)
+		} else {
+			remote = NewSSHTarget(options, options.sources[0].Host, options.sources[0].ConnectionSSHOptions(options))
+		}
+		defer remote.Close()
+	}
+
+	failed := 0
+	for _, source := range options.sources {
+		var err error
+		if remote != nil {
+			err = validateRemoteSource(remote, source.Path)
+		} else {
+			err = validateLocalSource(source.Path)
+		}
+
+		if err != nil {
+			options.log.Error.Printf("  %s: %v", source, err)
+			failed++
+		} else {
+			options.log.Info.Printf("  %s: ok", source)
+		}
+	}
+
+	if failed > 0 {
+		panic(fmt.Sprintf("%d of %d source(s) unavailable", failed, len(options.sources)))
+	}
+}
+
+// validateLocalSource checks that the folder at sourcePath exists
+func validateLocalSource(sourcePath string) error {
+	stat, err := os.Stat(sourcePath)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("does not exist")
+	} else if err != nil {
+		return err
+	} else if !stat.IsDir() {
+		return fmt.Errorf("not a folder")
+	}
+
+	return nil
+}
+
+// validateRemoteSource checks that the folder at sourcePath exists on the remote host
+func validateRemoteSource(remote Target, sourcePath string) error {
+	stat, err := remote.Stat(sourcePath)
+	if err != nil {
+		return fmt.Errorf("unreachable: %v", err)
+	} else if !stat.Exists {
+		return fmt.Errorf("does not exist")
+	}
+
+	// Stat does not follow symlinks; "<path>/." does
+	stat, err = remote.Stat(strings.TrimSuffix(sourcePath, "/") + "/.")
+	if err != nil {
+		return fmt.Errorf("unreachable: %v", err)
+	} else if !stat.IsDir {
+		return fmt.Errorf("not a folder")
+	}
+
+	return nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSource(t *testing.T) {
+	tests := []struct {
+		definition string
+		expected   Source
+		err        bool
+	}{
+		{"/srv/data/", Source{Path: "/srv/data/"}, false},
+		{" relative/path ", Source{Path: "relative/path"}, false},
+		{"web1:/var/www/", Source{Host: "web1", Path: "/var/www/"}, false},
+		{"backup@web1:/var/www", Source{User: "backup", Host: "web1", Path: "/var/www"}, false},
+		{
+			"ssh://backup@web1:2222/var/www/?ssh-options=-i%20%2Froot%2Fkey&rsync-path=sudo%20rsync",
+			Source{User: "backup", Host: "web1", Port: 2222, Path: "/var/www/", SSHOptions: []string{"-i", "/root/key"}, RsyncPath: "sudo rsync"},
+			false,
+		},
+		{"rsync://nas/backups/srv", Source{Host: "nas", Daemon: true, Path: "/backups/srv"}, false},
+		{"rsync://user@nas:8873/backups", Source{User: "user", Host: "nas", Port: 8873, Daemon: true, Path: "/backups"}, false},
+		{"user@nas::backups/srv", Source{User: "user", Host: "nas", Daemon: true, Path: "/backups/srv"}, false},
+		{"", Source{}, true},
+		{"ssh:///var/www", Source{}, true},
+		{"ssh://web1", Source{}, true},
+		{"ssh://web1:0/var/www", Source{}, true},
+		{"ssh://web1/var/www?compress=1", Source{}, true},
+		{"rsync://nas", Source{}, true},
+	}
+
+	for _, test := range tests {
+		source, err := ParseSource(test.definition)
+		if test.err {
+			if err == nil {
+				t.Errorf("ParseSource(%q) = %+v, expected an error", test.definition, source)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseSource(%q): unexpected error: %v", test.definition, err)
+		} else if !reflect.DeepEqual(source, test.expected) {
+			t.Errorf("ParseSource(%q) = %+v, expected %+v", test.definition, source, test.expected)
+		}
+	}
+}
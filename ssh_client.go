@@ -0,0 +1,331 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// SSH client modes, see --ssh-client
+const (
+	sshClientNative = "native"
+	sshClientExec   = "exec"
+)
+
+// sshKeepaliveInterval is the interval in which keepalive requests are sent on open
+// connections, so they survive long rsync runs during which they are idle
+const sshKeepaliveInterval = 30 * time.Second
+
+// sshClientConfig holds the settings for the built-in SSH client, as parsed from the ssh
+// options (see Options.SSHOptions)
+type sshClientConfig struct {
+	user                  string
+	port                  uint
+	identityFiles         []string
+	knownHostsFiles       []string
+	strictHostKeyChecking string
+	connectTimeout        time.Duration
+}
+
+// sshRouteOptions are the ssh options (lower case, see ssh_config(5)) that change which host
+// is connected to, or how, and are not supported by the built-in SSH client. Ignoring them
+// would connect by a different route than rsync, so they are rejected instead.
+var sshRouteOptions = map[string]bool{
+	"proxyjump":       true,
+	"proxycommand":    true,
+	"hostname":        true,
+	"hostkeyalias":    true,
+	"bindaddress":     true,
+	"bindinterface":   true,
+	"certificatefile": true,
+}
+
+// sshOptionsWithValue are the ssh command line flags taking a value, see ssh(1)
+const sshOptionsWithValue = "BbcDEeFIiJLlmOopQRSWw"
+
+// parseSSHOptions extracts the settings the built-in SSH client understands from the passed
+// ssh command line options. Options that are not understood are returned separately; they
+// are still passed to the ssh command used by rsync. Options changing the route to the host
+// (see sshRouteOptions), as well as -J, -F, -b and -B, result in an error.
+func parseSSHOptions(sshOptions []string) (*sshClientConfig, []string, error) {
+	config := &sshClientConfig{
+		port:                  22,
+		strictHostKeyChecking: "yes",
+	}
+	ignored := []string{}
+
+	setOption := func(key string, value string) error {
+		switch strings.ToLower(key) {
+		case "user":
+			config.user = value
+		case "port":
+			port, err := strconv.ParseUint(value, 10, 16)
+			if err != nil {
+				return fmt.Errorf("invalid port %q", value)
+			}
+			config.port = uint(port)
+		case "identityfile":
+			config.identityFiles = append(config.identityFiles, value)
+		case "userknownhostsfile":
+			config.knownHostsFiles = append(config.knownHostsFiles, strings.Fields(value)...)
+		case "stricthostkeychecking":
+			config.strictHostKeyChecking = strings.ToLower(value)
+		case "connecttimeout":
+			seconds, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				return fmt.Errorf("invalid ConnectTimeout %q", value)
+			}
+			config.connectTimeout = time.Duration(seconds) * time.Second
+		default:
+			if sshRouteOptions[strings.ToLower(key)] {
+				return fmt.Errorf("ssh option -o %s=%s is not supported by the built-in SSH client, use --ssh-client %s", key, value, sshClientExec)
+			}
+			ignored = append(ignored, "-o "+key+"="+value)
+		}
+		return nil
+	}
+
+	for i := 0; i < len(sshOptions); i++ {
+		option := sshOptions[i]
+
+		// Options taking a value, either attached ("-p2222") or as the next argument ("-p 2222")
+		if len(option) >= 2 && strings.Contains(sshOptionsWithValue, option[1:2]) && option[0] == '-' {
+			value := option[2:]
+			if value == "" {
+				if i+1 >= len(sshOptions) {
+					return nil, nil, fmt.Errorf("ssh option %s requires a value", option)
+				}
+				i++
+				value = sshOptions[i]
+			}
+
+			var err error
+			switch option[1] {
+			case 'i':
+				err = setOption("IdentityFile", value)
+			case 'l':
+				err = setOption("User", value)
+			case 'p':
+				err = setOption("Port", value)
+			case 'o':
+				parts := strings.SplitN(value, "=", 2)
+				if len(parts) != 2 {
+					parts = strings.SplitN(value, " ", 2)
+				}
+				if len(parts) != 2 {
+					return nil, nil, fmt.Errorf("invalid ssh option -o %s", value)
+				}
+				err = setOption(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+			case 'J', 'F', 'b', 'B':
+				err = fmt.Errorf("ssh option %s %s is not supported by the built-in SSH client, use --ssh-client %s", option[:2], value, sshClientExec)
+			default:
+				ignored = append(ignored, option[:2]+" "+value)
+			}
+			if err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+
+		ignored = append(ignored, option)
+	}
+
+	return config, ignored, nil
+}
+
+// dialSSH opens a connection to host using the passed ssh options. Authentication uses the
+// configured identity files (or the default ones in ~/.ssh if none are configured) and the
+// ssh agent, if SSH_AUTH_SOCK is set. Host keys are verified against the known_hosts files.
+func dialSSH(options *Options, host string, sshOptions []string) (*ssh.Client, error) {
+	config, ignored, err := parseSSHOptions(sshOptions)
+	if err != nil {
+		return nil, err
+	}
+	if len(ignored) > 0 {
+		options.log.Info.Printf("Ignoring ssh options not supported by the built-in SSH client (they are only passed to rsync): %s", strings.Join(ignored, " "))
+	}
+
+	homeDir, _ := os.UserHomeDir()
+
+	if config.user == "" {
+		currentUser, err := user.Current()
+		if err != nil {
+			return nil, fmt.Errorf("could not determine current user: %v", err)
+		}
+		config.user = currentUser.Username
+	}
+
+	// Authentication
+	signers := []ssh.Signer{}
+
+	identityFiles := config.identityFiles
+	explicitIdentities := len(identityFiles) > 0
+	if !explicitIdentities {
+		for _, name := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+			identityFiles = append(identityFiles, filepath.Join(homeDir, ".ssh", name))
+		}
+	}
+	for _, identityFile := range identityFiles {
+		identityFile = expandHomeDir(identityFile, homeDir)
+
+		keyBytes, err := ioutil.ReadFile(identityFile)
+		if err != nil {
+			if explicitIdentities {
+				return nil, fmt.Errorf("could not read identity file %s: %v", identityFile, err)
+			}
+			continue
+		}
+
+		signer, err := ssh.ParsePrivateKey(keyBytes)
+		if err != nil {
+			options.log.Warn.Printf("Skipping identity file %s: %v", identityFile, err)
+			continue
+		}
+		signers = append(signers, signer)
+	}
+
+	authMethods := []ssh.AuthMethod{}
+	if len(signers) > 0 {
+		authMethods = append(authMethods, ssh.PublicKeys(signers...))
+	}
+
+	if socket := os.Getenv("SSH_AUTH_SOCK"); socket != "" {
+		agentConn, err := net.Dial("unix", socket)
+		if err != nil {
+			options.log.Debug.Printf("dialSSH: could not connect to ssh agent at %s: %v", socket, err)
+		} else {
+			defer agentConn.Close()
+			authMethods = append(authMethods, ssh.PublicKeysCallback(agent.NewClient(agentConn).Signers))
+		}
+	}
+
+	if len(authMethods) == 0 {
+		return nil, errors.New("no usable identity files and no ssh agent found")
+	}
+
+	// Host key verification
+	knownHostsFiles := config.knownHostsFiles
+	if len(knownHostsFiles) == 0 {
+		knownHostsFiles = []string{filepath.Join(homeDir, ".ssh", "known_hosts"), "/etc/ssh/ssh_known_hosts"}
+	}
+
+	address := net.JoinHostPort(host, strconv.FormatUint(uint64(config.port), 10))
+
+	hostKeyCallback, hostKeyAlgorithms, err := knownHostsCallback(options, knownHostsFiles, config.strictHostKeyChecking, homeDir, address)
+	if err != nil {
+		return nil, err
+	}
+
+	clientConfig := &ssh.ClientConfig{
+		User:              config.user,
+		Auth:              authMethods,
+		HostKeyCallback:   hostKeyCallback,
+		HostKeyAlgorithms: hostKeyAlgorithms,
+		Timeout:           config.connectTimeout,
+	}
+
+	options.log.Debug.Printf("dialSSH: connecting to %s as %s", address, config.user)
+
+	return ssh.Dial("tcp", address, clientConfig)
+}
+
+// knownHostsCallback returns the host key callback implementing the passed
+// StrictHostKeyChecking mode, as well as the host key algorithms to prefer for address
+// (those of the keys already known for it)
+func knownHostsCallback(options *Options, files []string, strictHostKeyChecking string, homeDir string, address string) (ssh.HostKeyCallback, []string, error) {
+	switch strictHostKeyChecking {
+	case "no", "off":
+		return ssh.InsecureIgnoreHostKey(), nil, nil
+	case "yes", "ask", "accept-new":
+	default:
+		return nil, nil, fmt.Errorf("unsupported StrictHostKeyChecking value %q", strictHostKeyChecking)
+	}
+
+	existingFiles := []string{}
+	for _, file := range files {
+		file = expandHomeDir(file, homeDir)
+		if _, err := os.Stat(file); err == nil {
+			existingFiles = append(existingFiles, file)
+		}
+	}
+
+	callback, err := knownhosts.New(existingFiles...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not read known hosts files %v: %v", existingFiles, err)
+	}
+
+	// Ask the callback which keys it knows for the host by passing a key it cannot know
+	hostKeyAlgorithms := []string{}
+	var keyErr *knownhosts.KeyError
+	if err := callback(address, &net.TCPAddr{}, unknownPublicKey{}); errors.As(err, &keyErr) {
+		for _, known := range keyErr.Want {
+			if known.Key.Type() == ssh.KeyAlgoRSA {
+				hostKeyAlgorithms = append(hostKeyAlgorithms, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256)
+			}
+			hostKeyAlgorithms = append(hostKeyAlgorithms, known.Key.Type())
+		}
+	}
+	if len(hostKeyAlgorithms) == 0 {
+		hostKeyAlgorithms = nil
+	}
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := callback(hostname, remote, key)
+
+		var keyErr *knownhosts.KeyError
+		if err != nil && errors.As(err, &keyErr) && len(keyErr.Want) == 0 {
+			if strictHostKeyChecking != "accept-new" {
+				return fmt.Errorf("host key for %s is not known (add it to %v or set StrictHostKeyChecking=accept-new): %v", hostname, files, err)
+			}
+
+			knownHostsFile := expandHomeDir(files[0], homeDir)
+			options.log.Info.Printf("Adding new host key for %s to %s", hostname, knownHostsFile)
+
+			f, fileErr := os.OpenFile(knownHostsFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+			if fileErr != nil {
+				return fmt.Errorf("could not add host key to %s: %v", knownHostsFile, fileErr)
+			}
+			defer f.Close()
+
+			_, fileErr = fmt.Fprintln(f, knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key))
+			return fileErr
+		}
+
+		return err
+	}, hostKeyAlgorithms, nil
+}
+
+// unknownPublicKey is a public key no known_hosts file can contain
+type unknownPublicKey struct{}
+
+func (key unknownPublicKey) Type() string {
+	return "rotating-rsync-backup-unknown"
+}
+
+func (key unknownPublicKey) Marshal() []byte {
+	return []byte(key.Type())
+}
+
+func (key unknownPublicKey) Verify(data []byte, sig *ssh.Signature) error {
+	return errors.New("not a real key")
+}
+
+// expandHomeDir expands a leading ~/ in path
+func expandHomeDir(path string, homeDir string) string {
+	if strings.HasPrefix(path, "~/") {
+		return filepath.Join(homeDir, path[2:])
+	}
+
+	return path
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseSSHOptions(t *testing.T) {
+	tests := []struct {
+		name     string
+		options  []string
+		expected sshClientConfig
+		ignored  []string
+		err      bool
+	}{
+		{"defaults", []string{}, sshClientConfig{port: 22, strictHostKeyChecking: "yes"}, []string{}, false},
+		{
+			"flags",
+			[]string{"-l", "backup", "-p2222", "-i", "~/.ssh/backup"},
+			sshClientConfig{user: "backup", port: 2222, identityFiles: []string{"~/.ssh/backup"}, strictHostKeyChecking: "yes"},
+			[]string{},
+			false,
+		},
+		{
+			"options",
+			[]string{"-o", "StrictHostKeyChecking=No", "-oConnectTimeout 10", "-o", "UserKnownHostsFile=/a /b"},
+			sshClientConfig{port: 22, knownHostsFiles: []string{"/a", "/b"}, strictHostKeyChecking: "no", connectTimeout: 10 * time.Second},
+			[]string{},
+			false,
+		},
+		{
+			"ignored",
+			[]string{"-C", "-o", "ServerAliveInterval=60", "-c", "aes128-ctr"},
+			sshClientConfig{port: 22, strictHostKeyChecking: "yes"},
+			[]string{"-C", "-o ServerAliveInterval=60", "-c aes128-ctr"},
+			false,
+		},
+		{"jump host", []string{"-J", "bastion"}, sshClientConfig{}, nil, true},
+		{"config file", []string{"-F", "/etc/ssh/backup_config"}, sshClientConfig{}, nil, true},
+		{"proxy jump", []string{"-o", "ProxyJump=bastion"}, sshClientConfig{}, nil, true},
+		{"proxy command", []string{"-oProxyCommand=nc %h %p"}, sshClientConfig{}, nil, true},
+		{"host name", []string{"-o", "HostName 10.0.0.1"}, sshClientConfig{}, nil, true},
+		{"invalid port", []string{"-p", "ssh"}, sshClientConfig{}, nil, true},
+		{"missing value", []string{"-l"}, sshClientConfig{}, nil, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config, ignored, err := parseSSHOptions(test.options)
+			if test.err {
+				if err == nil {
+					t.Errorf("parseSSHOptions(%q) = %+v, expected an error", test.options, config)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseSSHOptions(%q): unexpected error: %v", test.options, err)
+			}
+
+			if !reflect.DeepEqual(*config, test.expected) {
+				t.Errorf("got %+v, expected %+v", *config, test.expected)
+			}
+			if !reflect.DeepEqual(ignored, test.ignored) {
+				t.Errorf("ignored %q, expected %q", ignored, test.ignored)
+			}
+		})
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// Target is the location backups are stored in. All paths passed to a Target are absolute
+// paths on the target.
+type Target interface {
+	// String returns a human-readable description of the target, used in log messages
+	String() string
+	// ListFolders returns the names of all folders directly inside absPath
+	ListFolders(absPath string) ([]string, error)
+	// Stat returns information about the file or folder at absPath, without following symlinks.
+	// A missing file is not an error; see TargetFileInfo.Exists.
+	Stat(absPath string) (TargetFileInfo, error)
+	// MkdirAll creates the folder at absPath, including all missing parents
+	MkdirAll(absPath string, perm os.FileMode) error
+	// Rename renames (moves) fromPath to toPath
+	Rename(fromPath string, toPath string) error
+	// RemoveAll removes absPath and everything it contains; removing a missing path is not an error
+	RemoveAll(absPath string) error
+	// Symlink creates a symlink at linkPath pointing to linkTarget
+	Symlink(linkTarget string, linkPath string) error
+	// Readlink returns the destination of the symlink at linkPath
+	Readlink(linkPath string) (string, error)
+	// ReadFile returns the contents of the file at absPath. If the file does not exist, the
+	// returned error satisfies os.IsNotExist.
+	ReadFile(absPath string) ([]byte, error)
+	// WriteFile atomically replaces the file at absPath with data
+	WriteFile(absPath string, data []byte) error
+	// Mkdir creates the folder at absPath, whose parent must exist. If something already
+	// exists at absPath, the returned error satisfies os.IsExist. Creating the folder must be
+	// atomic, since it is used for locking, see AcquireTargetLock; targets that cannot do so
+	// return errNotSupported.
+	Mkdir(absPath string) error
+	// FreeSpace returns the number of bytes available to the current user on the filesystem
+	// containing absPath
+	FreeSpace(absPath string) (uint64, error)
+	// RsyncPath returns absPath in the form rsync expects it as source or destination argument
+	RsyncPath(absPath string) string
+	// RsyncOptions returns the options rsync needs to transfer to or from the target
+	RsyncOptions() []string
+	// Exec runs the shell command on the target host with the passed additional environment
+	// variables (KEY=value), logging its output lines to logger with logLabel. If timeout is
+	// not 0, the command is killed once it expires. Returns the command's exit code.
+	Exec(command string, env []string, timeout time.Duration, logLabel string, logger *log.Logger) (int, error)
+	// Close releases all resources, such as open connections, held by the target
+	Close() error
+}
+
+// errNotSupported is returned by Target methods that the target can not implement
+var errNotSupported = errors.New("not supported by this target")
+
+// TargetFileInfo holds the information returned by Target.Stat
+type TargetFileInfo struct {
+	Exists    bool
+	IsDir     bool
+	IsSymlink bool
+	// ModTime is the time of the last modification, or zero if the target does not report it
+	ModTime time.Time
+}
+
+// Target returns the Target implementation for the configured target folder
+func (options *Options) Target() Target {
+	if options.targetBackend == nil {
+		if options.targetDaemon {
+			options.targetBackend = NewDaemonTarget(options, options.targetHost, options.targetUser, options.targetPort)
+		} else if options.IsRemoteTarget() {
+			options.targetBackend = NewSSHTarget(options, options.targetHost, options.SSHOptions())
+		} else {
+			options.targetBackend = &LocalTarget{}
+		}
+	}
+
+	return options.targetBackend
+}
+
+// CloseTarget closes the Target returned by Target(), if any. A subsequent call to Target()
+// returns a new instance.
+func (options *Options) CloseTarget() {
+	if options.targetBackend == nil {
+		return
+	}
+
+	options.ReleaseTargetLock()
+
+	if err := options.targetBackend.Close(); err != nil {
+		options.log.Warn.Printf("Error closing connection to target %s: %v", options.targetBackend, err)
+	}
+	options.targetBackend = nil
+}
+
+// LocalTarget is a Target on the local filesystem
+type LocalTarget struct{}
+
+func (target *LocalTarget) String() string {
+	return "local"
+}
+
+func (target *LocalTarget) ListFolders(absPath string) ([]string, error) {
+	files, err := ioutil.ReadDir(absPath)
+	if err != nil {
+		return nil, err
+	}
+
+	folderNames := []string{}
+	for _, f := range files {
+		if f.IsDir() {
+			folderNames = append(folderNames, f.Name())
+		}
+	}
+
+	return folderNames, nil
+}
+
+func (target *LocalTarget) Stat(absPath string) (TargetFileInfo, error) {
+	stat, err := os.Lstat(absPath)
+	if os.IsNotExist(err) {
+		return TargetFileInfo{}, nil
+	} else if err != nil {
+		return TargetFileInfo{}, err
+	}
+
+	return TargetFileInfo{
+		Exists:    true,
+		IsDir:     stat.IsDir(),
+		IsSymlink: stat.Mode()&os.ModeSymlink != 0,
+		ModTime:   stat.ModTime(),
+	}, nil
+}
+
+func (target *LocalTarget) MkdirAll(absPath string, perm os.FileMode) error {
+	return os.MkdirAll(absPath, perm)
+}
+
+func (target *LocalTarget) Mkdir(absPath string) error {
+	return os.Mkdir(absPath, 0700)
+}
+
+func (target *LocalTarget) Rename(fromPath string, toPath string) error {
+	return os.Rename(fromPath, toPath)
+}
+
+func (target *LocalTarget) RemoveAll(absPath string) error {
+	return os.RemoveAll(absPath)
+}
+
+func (target *LocalTarget) Symlink(linkTarget string, linkPath string) error {
+	return os.Symlink(linkTarget, linkPath)
+}
+
+func (target *LocalTarget) Readlink(linkPath string) (string, error) {
+	return os.Readlink(linkPath)
+}
+
+func (target *LocalTarget) ReadFile(absPath string) ([]byte, error) {
+	return ioutil.ReadFile(absPath)
+}
+
+func (target *LocalTarget) WriteFile(absPath string, data []byte) error {
+	tmpFile, err := ioutil.TempFile(filepath.Dir(absPath), "."+filepath.Base(absPath)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	if _, err := tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpFile.Name(), absPath)
+}
+
+func (target *LocalTarget) FreeSpace(absPath string) (uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(absPath, &stat); err != nil {
+		return 0, err
+	}
+
+	return stat.Bavail * uint64(stat.Bsize), nil
+}
+
+func (target *LocalTarget) RsyncPath(absPath string) string {
+	return absPath
+}
+
+func (target *LocalTarget) RsyncOptions() []string {
+	return []string{}
+}
+
+func (target *LocalTarget) Exec(command string, env []string, timeout time.Duration, logLabel string, logger *log.Logger) (int, error) {
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Env = append(os.Environ(), env...)
+
+	exitCode, err := runCmd(cmd, timeout, logLines(logLabel, logger))
+	return exitCode, err
+}
+
+func (target *LocalTarget) Close() error {
+	return nil
+}
@@ -0,0 +1,629 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// rsyncDaemonDefaultPort is the port rsync daemons listen on by default
+const rsyncDaemonDefaultPort = 873
+
+// daemonListEntryRegex matches a line of rsync's --list-only output: mode, size, date, time
+// and name, e.g. "drwxr-xr-x          4,096 2026/10/16 22:00:00 _daily"
+var daemonListEntryRegex = regexp.MustCompile(`^([dlcbps-][rwxsStT-]{9})\s+([\d,.]+)\s+(\d{4}/\d{2}/\d{2} \d{2}:\d{2}:\d{2})\s(.*)$`)
+
+// daemonEscapeRegex matches the escape sequences rsync uses for unprintable characters in
+// names, e.g. "\#012" for a newline
+var daemonEscapeRegex = regexp.MustCompile(`\\#([0-7]{3})`)
+
+// DaemonTarget is a Target in a module of an rsync daemon, for hosts that do not offer a
+// shell. All operations are rsync calls: folders are listed using --list-only, created and
+// files written by pushing them from a temporary local folder, and deleted by pushing an
+// empty folder with --delete. Absolute paths start with the module name.
+type DaemonTarget struct {
+	options *Options
+	host    string
+	user    string
+	port    uint
+}
+
+// NewDaemonTarget returns a DaemonTarget for the rsync daemon on host
+func NewDaemonTarget(options *Options, host string, user string, port uint) *DaemonTarget {
+	return &DaemonTarget{options: options, host: host, user: user, port: port}
+}
+
+// daemonEntry is an entry in the output of rsync --list-only
+type daemonEntry struct {
+	name       string
+	mode       os.FileMode
+	size       int64
+	modTime    time.Time
+	linkTarget string
+	isDir      bool
+	isSymlink  bool
+	isRegular  bool
+}
+
+// parseDaemonURL parses rsync://[user@]host[:port]/module[/path] and rsync's daemon syntax
+// [user@]host::module[/path] into its parts. The returned path starts with the module name.
+func parseDaemonURL(value string) (host string, user string, port uint, absPath string, err error) {
+	if !strings.HasPrefix(value, "rsync://") {
+		separator := strings.Index(value, "::")
+		if separator < 0 {
+			return "", "", 0, "", fmt.Errorf("invalid rsync daemon address %q: expected rsync://[user@]host[:port]/module/path or [user@]host::module/path", value)
+		}
+		value = "rsync://" + value[:separator] + "/" + value[separator+2:]
+	}
+
+	daemonURL, err := url.Parse(value)
+	if err != nil {
+		return "", "", 0, "", fmt.Errorf("invalid rsync daemon address %q: %v", value, err)
+	}
+
+	host = daemonURL.Hostname()
+	if host == "" {
+		return "", "", 0, "", fmt.Errorf("invalid rsync daemon address %q: missing host", value)
+	}
+	if daemonURL.User != nil {
+		user = daemonURL.User.Username()
+	}
+
+	port = rsyncDaemonDefaultPort
+	if daemonURL.Port() != "" {
+		parsedPort, err := strconv.ParseUint(daemonURL.Port(), 10, 16)
+		if err != nil || parsedPort == 0 {
+			return "", "", 0, "", fmt.Errorf("invalid rsync daemon address %q: invalid port %q", value, daemonURL.Port())
+		}
+		port = uint(parsedPort)
+	}
+
+	absPath = daemonURL.Path
+	if strings.Trim(absPath, "/") == "" {
+		return "", "", 0, "", fmt.Errorf("invalid rsync daemon address %q: missing module", value)
+	}
+
+	return host, user, port, absPath, nil
+}
+
+// daemonURL returns the rsync URL for absPath on the rsync daemon on host
+func daemonURL(host string, user string, port uint, absPath string) string {
+	address := host
+	if user != "" {
+		address = user + "@" + host
+	}
+	if port != 0 && port != rsyncDaemonDefaultPort {
+		address = fmt.Sprintf("%s:%d", address, port)
+	}
+
+	return "rsync://" + address + absPath
+}
+
+// daemonRsyncOptions returns the options rsync needs to connect to rsync daemons
+func daemonRsyncOptions(options *Options) []string {
+	if options.passwordFile == "" {
+		return []string{}
+	}
+
+	return []string{"--password-file", options.passwordFile}
+}
+
+func (target *DaemonTarget) String() string {
+	return daemonURL(target.host, target.user, target.port, "")
+}
+
+// rsync runs rsync with the passed arguments, returning an error including rsync's error
+// output if it fails
+func (target *DaemonTarget) rsync(args ...string) ([]string, error) {
+	args = append(append([]string{"--no-motd"}, daemonRsyncOptions(target.options)...), args...)
+
+	stdout, stderr, exitCode, err := call(target.options, "rsync", args, "rsync", target.options.log.Debug)
+	if err != nil {
+		return nil, &daemonError{exitCode: exitCode, stderr: strings.Join(stderr, " "), err: err}
+	}
+
+	return stdout, nil
+}
+
+// daemonError is the error returned for failed rsync calls by a DaemonTarget
+type daemonError struct {
+	exitCode int
+	stderr   string
+	err      error
+}
+
+func (err *daemonError) Error() string {
+	return fmt.Sprintf("rsync exited with exit code %d: %s", err.exitCode, err.stderr)
+}
+
+// isNotExist returns true if err is the error of an rsync call that failed because a path
+// does not exist
+func (err *daemonError) isNotExist() bool {
+	return err.exitCode == 23 && strings.Contains(err.stderr, "No such file or directory")
+}
+
+// module returns the module name and the path inside the module of absPath
+func (target *DaemonTarget) module(absPath string) (string, string) {
+	parts := strings.SplitN(strings.TrimPrefix(path.Clean(absPath), "/"), "/", 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+
+	return parts[0], parts[1]
+}
+
+// list returns the entries of the folder at absPath, including "." for the folder itself,
+// and with recursive, all entries below it with their paths relative to absPath
+func (target *DaemonTarget) list(absPath string, recursive bool) ([]daemonEntry, error) {
+	args := []string{"--list-only"}
+	if recursive {
+		args = append(args, "-r")
+	}
+	args = append(args, target.url(NormalizeFolderPath(absPath)))
+
+	stdout, err := target.rsync(args...)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []daemonEntry{}
+	for _, line := range stdout {
+		matches := daemonListEntryRegex.FindStringSubmatch(line)
+		if matches == nil {
+			continue
+		}
+
+		size, _ := strconv.ParseInt(strings.NewReplacer(",", "", ".", "").Replace(matches[2]), 10, 64)
+		modTime, _ := time.ParseInLocation("2006/01/02 15:04:05", matches[3], time.Local)
+
+		entry := daemonEntry{
+			name:      matches[4],
+			size:      size,
+			modTime:   modTime,
+			isDir:     matches[1][0] == 'd',
+			isSymlink: matches[1][0] == 'l',
+			isRegular: matches[1][0] == '-',
+		}
+		if entry.isSymlink {
+			if separator := strings.Index(entry.name, " -> "); separator >= 0 {
+				entry.linkTarget = unescapeDaemonName(entry.name[separator+4:])
+				entry.name = entry.name[:separator]
+			}
+		}
+		entry.name = unescapeDaemonName(entry.name)
+		entry.mode = parseDaemonPermissions(matches[1])
+
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// unescapeDaemonName reverts the escaping of unprintable characters in names listed by rsync
+func unescapeDaemonName(name string) string {
+	return daemonEscapeRegex.ReplaceAllStringFunc(name, func(escaped string) string {
+		value, _ := strconv.ParseUint(escaped[2:], 8, 8)
+		return string([]byte{byte(value)})
+	})
+}
+
+// parseDaemonPermissions converts permissions as listed by rsync (e.g. "rwsr-xr-x", following
+// the file type) to a FileMode, including setuid, setgid and sticky bits
+func parseDaemonPermissions(permissions string) os.FileMode {
+	var mode os.FileMode
+	for i, char := range permissions[1:] {
+		if char != '-' && char != 'S' && char != 'T' {
+			mode |= 1 << uint(8-i)
+		}
+	}
+
+	special := map[int]os.FileMode{3: os.ModeSetuid, 6: os.ModeSetgid, 9: os.ModeSticky}
+	for i, bit := range special {
+		if char := permissions[i]; char == 's' || char == 'S' || char == 't' || char == 'T' {
+			mode |= bit
+		}
+	}
+
+	return mode
+}
+
+// url returns the rsync URL for absPath on the target
+func (target *DaemonTarget) url(absPath string) string {
+	return daemonURL(target.host, target.user, target.port, absPath)
+}
+
+// entry returns the entry for absPath from the listing of its parent folder, or nil if it
+// does not exist
+func (target *DaemonTarget) entry(absPath string) (*daemonEntry, error) {
+	if _, modulePath := target.module(absPath); modulePath == "" {
+		// Module roots can only be listed themselves
+		entries, err := target.list(absPath, false)
+		if err != nil {
+			if daemonErr, ok := err.(*daemonError); ok && daemonErr.isNotExist() {
+				return nil, nil
+			}
+			return nil, err
+		}
+		for _, entry := range entries {
+			if entry.name == "." {
+				return &entry, nil
+			}
+		}
+		return nil, nil
+	}
+
+	name := path.Base(path.Clean(absPath))
+	parentPath := path.Dir(path.Clean(absPath))
+	if strings.HasSuffix(absPath, "/.") {
+		// The folder itself is listed as "." when listing it
+		name = "."
+		parentPath = path.Clean(absPath)
+	}
+
+	entries, err := target.list(parentPath, false)
+	if err != nil {
+		if daemonErr, ok := err.(*daemonError); ok && daemonErr.isNotExist() {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		if entry.name == name {
+			return &entry, nil
+		}
+	}
+
+	return nil, nil
+}
+
+func (target *DaemonTarget) ListFolders(absPath string) ([]string, error) {
+	entries, err := target.list(absPath, false)
+	if err != nil {
+		return nil, err
+	}
+
+	folderNames := []string{}
+	for _, entry := range entries {
+		if entry.isDir && entry.name != "." {
+			folderNames = append(folderNames, entry.name)
+		}
+	}
+
+	return folderNames, nil
+}
+
+func (target *DaemonTarget) Stat(absPath string) (TargetFileInfo, error) {
+	entry, err := target.entry(absPath)
+	if err != nil {
+		return TargetFileInfo{}, err
+	} else if entry == nil {
+		return TargetFileInfo{}, nil
+	}
+
+	return TargetFileInfo{Exists: true, IsDir: entry.isDir, IsSymlink: entry.isSymlink, ModTime: entry.modTime}, nil
+}
+
+// push transfers the contents of the local folder localPath to the folder at absPath on the
+// target using rsync with the passed extra arguments
+func (target *DaemonTarget) push(localPath string, absPath string, args ...string) error {
+	args = append(args, NormalizeFolderPath(localPath), target.url(NormalizeFolderPath(absPath)))
+
+	_, err := target.rsync(args...)
+	return err
+}
+
+// MkdirAll pushes the missing folders from a temporary local folder into the module
+func (target *DaemonTarget) MkdirAll(absPath string, perm os.FileMode) error {
+	module, modulePath := target.module(absPath)
+	if modulePath == "" {
+		return nil
+	}
+
+	tmpPath, err := ioutil.TempDir("", "rotating-rsync-backup-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpPath)
+
+	if err := os.MkdirAll(filepath.Join(tmpPath, modulePath), perm); err != nil {
+		return err
+	}
+
+	// Without -p and -t, the attributes of existing folders are left alone
+	return target.push(tmpPath, "/"+module, "-r")
+}
+
+// Rename copies fromPath to toPath and deletes fromPath afterwards, since rsync cannot rename.
+// Folders are copied without transferring any data: a skeleton of the folder is built
+// locally from a recursive listing, with sparse files of the same sizes, permissions and
+// modification times, and pushed to toPath with --link-dest pointing to fromPath, so every
+// file is hard linked to (or, if its attributes differ, copied on the target from) its
+// counterpart in fromPath. Listed times only have a precision of seconds, hence
+// --modify-window. Folders
+// containing devices, FIFOs or sockets are not moved, and fromPath is only deleted once a
+// listing of toPath shows that every entry arrived.
+func (target *DaemonTarget) Rename(fromPath string, toPath string) error {
+	entry, err := target.entry(fromPath)
+	if err != nil {
+		return err
+	} else if entry == nil {
+		return &os.LinkError{Op: "rename", Old: fromPath, New: toPath, Err: os.ErrNotExist}
+	}
+
+	if entry.isSymlink {
+		if err := target.Symlink(entry.linkTarget, toPath); err != nil {
+			return err
+		}
+		return target.RemoveAll(fromPath)
+	}
+	if !entry.isDir {
+		data, err := target.ReadFile(fromPath)
+		if err != nil {
+			return err
+		}
+		if err := target.WriteFile(toPath, data); err != nil {
+			return err
+		}
+		return target.RemoveAll(fromPath)
+	}
+
+	entries, err := target.list(fromPath, true)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !entry.isDir && !entry.isSymlink && !entry.isRegular {
+			return fmt.Errorf("cannot move %s: %s is a device, FIFO or socket, which cannot be recreated on an rsync daemon", fromPath, entry.name)
+		}
+	}
+
+	tmpPath, err := ioutil.TempDir("", "rotating-rsync-backup-")
+	if err != nil {
+		return err
+	}
+	defer removeDaemonSkeleton(tmpPath)
+
+	if err := buildDaemonSkeleton(tmpPath, entries); err != nil {
+		return fmt.Errorf("could not build skeleton of %s: %v", fromPath, err)
+	}
+
+	// --link-dest is relative to the destination folder
+	linkDest, err := filepath.Rel(path.Clean(toPath), path.Clean(fromPath))
+	if err != nil {
+		return err
+	}
+
+	if err := target.push(tmpPath, toPath, "-rlpt", "--modify-window=1", "--size-only", "--link-dest", linkDest); err != nil {
+		return err
+	}
+
+	copiedEntries, err := target.list(toPath, true)
+	if err != nil {
+		return err
+	}
+	if err := compareDaemonEntries(entries, copiedEntries); err != nil {
+		return fmt.Errorf("copy of %s at %s is incomplete, keeping both: %v", fromPath, toPath, err)
+	}
+
+	return target.RemoveAll(fromPath)
+}
+
+// compareDaemonEntries returns an error describing the first entry of expected that is
+// missing from actual or differs in type, size or link target
+func compareDaemonEntries(expected []daemonEntry, actual []daemonEntry) error {
+	actualByName := map[string]daemonEntry{}
+	for _, entry := range actual {
+		actualByName[entry.name] = entry
+	}
+
+	for _, entry := range expected {
+		copied, ok := actualByName[entry.name]
+		switch {
+		case !ok:
+			return fmt.Errorf("%s is missing", entry.name)
+		case copied.isDir != entry.isDir || copied.isSymlink != entry.isSymlink || copied.isRegular != entry.isRegular:
+			return fmt.Errorf("%s has a different type", entry.name)
+		case entry.isRegular && copied.size != entry.size:
+			return fmt.Errorf("%s has %d bytes instead of %d", entry.name, copied.size, entry.size)
+		case entry.isSymlink && copied.linkTarget != entry.linkTarget:
+			return fmt.Errorf("%s points to %s instead of %s", entry.name, copied.linkTarget, entry.linkTarget)
+		}
+	}
+
+	return nil
+}
+
+// buildDaemonSkeleton recreates the listed entries below localPath: folders, symlinks and
+// sparse files of the listed sizes, with the listed permissions and modification times.
+// Other entries are skipped; Rename refuses to move folders containing them. Read-only
+// folders stay read-only, so the skeleton must be removed using removeDaemonSkeleton.
+func buildDaemonSkeleton(localPath string, entries []daemonEntry) error {
+	for _, entry := range entries {
+		entryPath := filepath.Join(localPath, entry.name)
+
+		switch {
+		case entry.isDir:
+			if err := os.MkdirAll(entryPath, 0700); err != nil {
+				return err
+			}
+		case entry.isSymlink:
+			if err := os.Symlink(entry.linkTarget, entryPath); err != nil {
+				return err
+			}
+		case entry.isRegular:
+			file, err := os.Create(entryPath)
+			if err != nil {
+				return err
+			}
+			err = file.Truncate(entry.size)
+			file.Close()
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// Folder attributes are set last, since creating their contents changes them
+	for i := len(entries) - 1; i >= 0; i-- {
+		entry := entries[i]
+		if entry.isSymlink || (!entry.isDir && !entry.isRegular) {
+			continue
+		}
+
+		entryPath := filepath.Join(localPath, entry.name)
+		if err := os.Chmod(entryPath, entry.mode); err != nil {
+			return err
+		}
+		if err := os.Chtimes(entryPath, entry.modTime, entry.modTime); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// removeDaemonSkeleton removes the skeleton built by buildDaemonSkeleton at localPath, making
+// its folders writable first
+func removeDaemonSkeleton(localPath string) error {
+	filepath.Walk(localPath, func(entryPath string, info os.FileInfo, err error) error {
+		if err == nil && info.IsDir() {
+			os.Chmod(entryPath, 0700)
+		}
+		return nil
+	})
+
+	return os.RemoveAll(localPath)
+}
+
+// RemoveAll pushes an empty folder to the parent folder of absPath with --delete, with
+// filters limiting the deletion to absPath
+func (target *DaemonTarget) RemoveAll(absPath string) error {
+	tmpPath, err := ioutil.TempDir("", "rotating-rsync-backup-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpPath)
+
+	name := escapeDaemonFilter(path.Base(absPath))
+
+	err = target.push(
+		tmpPath,
+		path.Dir(path.Clean(absPath)),
+		"-r",
+		"--delete",
+		"--include", "/"+name,
+		"--include", "/"+name+"/**",
+		"--exclude", "*",
+	)
+	if daemonErr, ok := err.(*daemonError); ok && daemonErr.isNotExist() {
+		return nil
+	}
+
+	return err
+}
+
+// escapeDaemonFilter escapes the wildcard characters in name for use in an rsync filter rule
+func escapeDaemonFilter(name string) string {
+	return strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`).Replace(name)
+}
+
+func (target *DaemonTarget) Symlink(linkTarget string, linkPath string) error {
+	tmpPath, err := ioutil.TempDir("", "rotating-rsync-backup-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpPath)
+
+	if err := os.Symlink(linkTarget, filepath.Join(tmpPath, path.Base(linkPath))); err != nil {
+		return err
+	}
+
+	return target.push(tmpPath, path.Dir(path.Clean(linkPath)), "-l", "-d", "--include", "/"+escapeDaemonFilter(path.Base(linkPath)), "--exclude", "*")
+}
+
+func (target *DaemonTarget) Readlink(linkPath string) (string, error) {
+	entry, err := target.entry(linkPath)
+	if err != nil {
+		return "", err
+	} else if entry == nil || !entry.isSymlink {
+		return "", fmt.Errorf("%s is not a symlink", linkPath)
+	}
+
+	return entry.linkTarget, nil
+}
+
+func (target *DaemonTarget) ReadFile(absPath string) ([]byte, error) {
+	entry, err := target.entry(absPath)
+	if err != nil {
+		return nil, err
+	} else if entry == nil {
+		return nil, &os.PathError{Op: "open", Path: absPath, Err: os.ErrNotExist}
+	} else if !entry.isRegular {
+		return nil, fmt.Errorf("%s: not a file", absPath)
+	}
+
+	tmpPath, err := ioutil.TempDir("", "rotating-rsync-backup-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpPath)
+
+	localPath := filepath.Join(tmpPath, "file")
+	if _, err := target.rsync(target.url(absPath), localPath); err != nil {
+		return nil, err
+	}
+
+	return ioutil.ReadFile(localPath)
+}
+
+// WriteFile relies on rsync writing files to a temporary file first and renaming it
+func (target *DaemonTarget) WriteFile(absPath string, data []byte) error {
+	tmpPath, err := ioutil.TempDir("", "rotating-rsync-backup-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpPath)
+
+	localPath := filepath.Join(tmpPath, path.Base(absPath))
+	if err := ioutil.WriteFile(localPath, data, 0600); err != nil {
+		return err
+	}
+
+	_, err = target.rsync(localPath, target.url(absPath))
+	return err
+}
+
+// Mkdir is not supported, since rsync offers no operation to create a folder only if it does
+// not exist yet, and a check followed by a push would not be atomic
+func (target *DaemonTarget) Mkdir(absPath string) error {
+	return errNotSupported
+}
+
+func (target *DaemonTarget) FreeSpace(absPath string) (uint64, error) {
+	return 0, errNotSupported
+}
+
+func (target *DaemonTarget) RsyncPath(absPath string) string {
+	return target.url(absPath)
+}
+
+func (target *DaemonTarget) RsyncOptions() []string {
+	return daemonRsyncOptions(target.options)
+}
+
+func (target *DaemonTarget) Exec(command string, env []string, timeout time.Duration, logLabel string, logger *log.Logger) (int, error) {
+	return -1, errNotSupported
+}
+
+func (target *DaemonTarget) Close() error {
+	return nil
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestParseDaemonURL(t *testing.T) {
+	tests := []struct {
+		value   string
+		host    string
+		user    string
+		port    uint
+		absPath string
+		err     bool
+	}{
+		{"rsync://nas/backups/srv", "nas", "", rsyncDaemonDefaultPort, "/backups/srv", false},
+		{"rsync://backup@nas:8873/backups", "nas", "backup", 8873, "/backups", false},
+		{"nas::backups/srv", "nas", "", rsyncDaemonDefaultPort, "/backups/srv", false},
+		{"backup@nas::backups", "nas", "backup", rsyncDaemonDefaultPort, "/backups", false},
+		{"nas:/backups", "", "", 0, "", true},
+		{"rsync://nas", "", "", 0, "", true},
+		{"rsync://nas/", "", "", 0, "", true},
+		{"rsync:///backups", "", "", 0, "", true},
+		{"rsync://nas:0/backups", "", "", 0, "", true},
+		{"::backups", "", "", 0, "", true},
+	}
+
+	for _, test := range tests {
+		host, user, port, absPath, err := parseDaemonURL(test.value)
+		if test.err {
+			if err == nil {
+				t.Errorf("parseDaemonURL(%q) = %s, %s, %d, %s, expected an error", test.value, host, user, port, absPath)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseDaemonURL(%q): unexpected error: %v", test.value, err)
+			continue
+		}
+
+		if host != test.host || user != test.user || port != test.port || absPath != test.absPath {
+			t.Errorf("parseDaemonURL(%q) = %s, %s, %d, %s", test.value, host, user, port, absPath)
+		}
+	}
+}
+
+func TestParseDaemonPermissions(t *testing.T) {
+	tests := []struct {
+		permissions string
+		expected    os.FileMode
+	}{
+		{"-rw-r--r--", 0644},
+		{"-r--r--r--", 0444},
+		{"drwx------", 0700},
+		{"-rwsr-xr-x", 0755 | os.ModeSetuid},
+		{"-rwSr--r--", 0644 | os.ModeSetuid},
+		{"drwxr-sr-x", 0755 | os.ModeSetgid},
+		{"drwxrwxrwt", 0777 | os.ModeSticky},
+		{"drwxrwxrwT", 0776 | os.ModeSticky},
+	}
+
+	for _, test := range tests {
+		if mode := parseDaemonPermissions(test.permissions); mode != test.expected {
+			t.Errorf("parseDaemonPermissions(%q) = %v, expected %v", test.permissions, mode, test.expected)
+		}
+	}
+}
+
+func TestBuildDaemonSkeleton(t *testing.T) {
+	localPath, err := ioutil.TempDir("", "skeleton")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer removeDaemonSkeleton(localPath)
+
+	modTime := time.Date(2026, 10, 16, 22, 0, 0, 0, time.Local)
+	entries := []daemonEntry{
+		{name: ".", mode: 0755, modTime: modTime, isDir: true},
+		{name: "readonly", mode: 0555, modTime: modTime, isDir: true},
+		{name: "readonly/file", mode: 0444, size: 1 << 20, modTime: modTime, isRegular: true},
+		{name: "script", mode: 0755 | os.ModeSetuid, size: 10, modTime: modTime, isRegular: true},
+		{name: "shared", mode: 0777 | os.ModeSticky, modTime: modTime, isDir: true},
+		{name: "link", linkTarget: "script", isSymlink: true},
+	}
+
+	if err := buildDaemonSkeleton(localPath, entries); err != nil {
+		t.Fatalf("buildDaemonSkeleton: %v", err)
+	}
+
+	for _, entry := range entries {
+		info, err := os.Lstat(filepath.Join(localPath, entry.name))
+		if err != nil {
+			t.Errorf("%s: %v", entry.name, err)
+			continue
+		}
+
+		if entry.isSymlink {
+			if linkTarget, _ := os.Readlink(filepath.Join(localPath, entry.name)); linkTarget != entry.linkTarget {
+				t.Errorf("%s points to %s, expected %s", entry.name, linkTarget, entry.linkTarget)
+			}
+			continue
+		}
+		if mode := info.Mode() &^ os.ModeDir; mode != entry.mode {
+			t.Errorf("%s has mode %v, expected %v", entry.name, mode, entry.mode)
+		}
+		if !info.ModTime().Equal(entry.modTime) {
+			t.Errorf("%s was modified at %s, expected %s", entry.name, info.ModTime(), entry.modTime)
+		}
+		if entry.isRegular && info.Size() != entry.size {
+			t.Errorf("%s has %d bytes, expected %d", entry.name, info.Size(), entry.size)
+		}
+	}
+
+	if err := removeDaemonSkeleton(localPath); err != nil {
+		t.Errorf("removeDaemonSkeleton: %v", err)
+	}
+}
+
+// startRsyncDaemon starts an rsync daemon serving the module "backups" from a new local
+// folder, which is returned with the daemon's port. The test is skipped if rsync is missing.
+func startRsyncDaemon(t *testing.T) (string, uint) {
+	if _, err := exec.LookPath("rsync"); err != nil {
+		t.Skip("rsync is not installed")
+	}
+
+	folder, err := ioutil.TempDir("", "daemon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { removeDaemonSkeleton(folder) })
+
+	modulePath := filepath.Join(folder, "backups")
+	if err := os.Mkdir(modulePath, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	config := fmt.Sprintf("use chroot = no\n[backups]\npath = %s\nread only = false\n", modulePath)
+	configPath := filepath.Join(folder, "rsyncd.conf")
+	if err := ioutil.WriteFile(configPath, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	daemon := exec.Command("rsync", "--daemon", "--no-detach", "--config", configPath, "--address", "127.0.0.1", "--port", strconv.Itoa(port))
+	if err := daemon.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		daemon.Process.Kill()
+		daemon.Wait()
+	})
+
+	for attempt := 0; ; attempt++ {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err == nil {
+			conn.Close()
+			break
+		} else if attempt == 50 {
+			t.Fatalf("rsync daemon did not start: %v", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	return modulePath, uint(port)
+}
+
+func TestDaemonRenameHardLinks(t *testing.T) {
+	modulePath, port := startRsyncDaemon(t)
+
+	backupPath := filepath.Join(modulePath, "2026-10-16_22-00-00")
+	if err := os.MkdirAll(filepath.Join(backupPath, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]os.FileMode{"etc/shadow": 0400, "etc/hosts": 0444, "notes.txt": 0644}
+	originals := map[string]os.FileInfo{}
+	for name, mode := range files {
+		filePath := filepath.Join(backupPath, name)
+		if err := ioutil.WriteFile(filePath, []byte(name), 0600); err != nil {
+			t.Fatal(err)
+		}
+		// Sub-second modification times are not listed by rsync
+		modTime := time.Now().Add(-time.Hour).Truncate(time.Second).Add(700 * time.Millisecond)
+		if err := os.Chtimes(filePath, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chmod(filePath, mode); err != nil {
+			t.Fatal(err)
+		}
+		info, err := os.Stat(filePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		originals[name] = info
+	}
+
+	options := &Options{log: NewLogger(ioutil.Discard, false, "")}
+	target := NewDaemonTarget(options, "127.0.0.1", "", port)
+	if err := target.MkdirAll("/backups/_daily", 0755); err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+	if err := target.Rename("/backups/2026-10-16_22-00-00", "/backups/_daily/2026-10-16_22-00-00"); err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+
+	if _, err := os.Stat(backupPath); !os.IsNotExist(err) {
+		t.Errorf("%s still exists after Rename: %v", backupPath, err)
+	}
+	for name, original := range originals {
+		info, err := os.Stat(filepath.Join(modulePath, "_daily", "2026-10-16_22-00-00", name))
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+		} else if !os.SameFile(info, original) {
+			t.Errorf("%s was copied instead of hard linked", name)
+		} else if info.Mode() != files[name] {
+			t.Errorf("%s has mode %v, expected %v", name, info.Mode(), files[name])
+		}
+	}
+}
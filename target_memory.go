@@ -0,0 +1,237 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryTarget is a Target keeping an in-memory file tree. It allows running target
+// operations, such as a rotation, without touching a real filesystem.
+type MemoryTarget struct {
+	// Free is the value returned by FreeSpace
+	Free uint64
+
+	mutex sync.Mutex
+	// entries maps cleaned absolute paths to folders, files and symlinks
+	entries map[string]memoryEntry
+}
+
+type memoryEntry struct {
+	isDir      bool
+	linkTarget string
+	data       []byte
+}
+
+// NewMemoryTarget creates an empty MemoryTarget containing only the root folder
+func NewMemoryTarget() *MemoryTarget {
+	return &MemoryTarget{
+		entries: map[string]memoryEntry{"/": {isDir: true}},
+	}
+}
+
+func (target *MemoryTarget) String() string {
+	return "memory"
+}
+
+// children returns all paths below absPath, including absPath itself
+func (target *MemoryTarget) children(absPath string) []string {
+	paths := []string{}
+	for entryPath := range target.entries {
+		if entryPath == absPath || strings.HasPrefix(entryPath, strings.TrimSuffix(absPath, "/")+"/") {
+			paths = append(paths, entryPath)
+		}
+	}
+
+	return paths
+}
+
+func (target *MemoryTarget) ListFolders(absPath string) ([]string, error) {
+	target.mutex.Lock()
+	defer target.mutex.Unlock()
+
+	absPath = filepath.Clean(absPath)
+	if entry, ok := target.entries[absPath]; !ok || !entry.isDir {
+		return nil, fmt.Errorf("%s: no such folder", absPath)
+	}
+
+	folderNames := []string{}
+	for entryPath, entry := range target.entries {
+		if entry.isDir && entryPath != absPath && filepath.Dir(entryPath) == absPath {
+			folderNames = append(folderNames, filepath.Base(entryPath))
+		}
+	}
+	sort.Strings(folderNames)
+
+	return folderNames, nil
+}
+
+func (target *MemoryTarget) Stat(absPath string) (TargetFileInfo, error) {
+	target.mutex.Lock()
+	defer target.mutex.Unlock()
+
+	entry, ok := target.entries[filepath.Clean(absPath)]
+	if !ok {
+		return TargetFileInfo{}, nil
+	}
+
+	return TargetFileInfo{
+		Exists:    true,
+		IsDir:     entry.isDir,
+		IsSymlink: entry.linkTarget != "",
+	}, nil
+}
+
+func (target *MemoryTarget) MkdirAll(absPath string, perm os.FileMode) error {
+	target.mutex.Lock()
+	defer target.mutex.Unlock()
+
+	for current := filepath.Clean(absPath); ; current = filepath.Dir(current) {
+		if entry, ok := target.entries[current]; ok {
+			if !entry.isDir {
+				return fmt.Errorf("%s: not a folder", current)
+			}
+		} else {
+			target.entries[current] = memoryEntry{isDir: true}
+		}
+
+		if current == "/" {
+			return nil
+		}
+	}
+}
+
+func (target *MemoryTarget) Mkdir(absPath string) error {
+	target.mutex.Lock()
+	defer target.mutex.Unlock()
+
+	absPath = filepath.Clean(absPath)
+	if _, ok := target.entries[absPath]; ok {
+		return &os.PathError{Op: "mkdir", Path: absPath, Err: os.ErrExist}
+	}
+	if parent, ok := target.entries[filepath.Dir(absPath)]; !ok || !parent.isDir {
+		return fmt.Errorf("%s: no such folder", filepath.Dir(absPath))
+	}
+
+	target.entries[absPath] = memoryEntry{isDir: true}
+
+	return nil
+}
+
+func (target *MemoryTarget) Rename(fromPath string, toPath string) error {
+	target.mutex.Lock()
+	defer target.mutex.Unlock()
+
+	fromPath = filepath.Clean(fromPath)
+	toPath = filepath.Clean(toPath)
+
+	if _, ok := target.entries[fromPath]; !ok {
+		return fmt.Errorf("%s: no such file or folder", fromPath)
+	}
+	if _, ok := target.entries[toPath]; ok {
+		return fmt.Errorf("%s: already exists", toPath)
+	}
+	if parent, ok := target.entries[filepath.Dir(toPath)]; !ok || !parent.isDir {
+		return fmt.Errorf("%s: no such folder", filepath.Dir(toPath))
+	}
+
+	for _, entryPath := range target.children(fromPath) {
+		target.entries[toPath+strings.TrimPrefix(entryPath, fromPath)] = target.entries[entryPath]
+		delete(target.entries, entryPath)
+	}
+
+	return nil
+}
+
+func (target *MemoryTarget) RemoveAll(absPath string) error {
+	target.mutex.Lock()
+	defer target.mutex.Unlock()
+
+	for _, entryPath := range target.children(filepath.Clean(absPath)) {
+		delete(target.entries, entryPath)
+	}
+
+	return nil
+}
+
+func (target *MemoryTarget) Symlink(linkTarget string, linkPath string) error {
+	target.mutex.Lock()
+	defer target.mutex.Unlock()
+
+	linkPath = filepath.Clean(linkPath)
+	if _, ok := target.entries[linkPath]; ok {
+		return fmt.Errorf("%s: already exists", linkPath)
+	}
+
+	target.entries[linkPath] = memoryEntry{linkTarget: linkTarget}
+
+	return nil
+}
+
+func (target *MemoryTarget) Readlink(linkPath string) (string, error) {
+	target.mutex.Lock()
+	defer target.mutex.Unlock()
+
+	entry, ok := target.entries[filepath.Clean(linkPath)]
+	if !ok || entry.linkTarget == "" {
+		return "", fmt.Errorf("%s: not a symlink", linkPath)
+	}
+
+	return entry.linkTarget, nil
+}
+
+func (target *MemoryTarget) ReadFile(absPath string) ([]byte, error) {
+	target.mutex.Lock()
+	defer target.mutex.Unlock()
+
+	entry, ok := target.entries[filepath.Clean(absPath)]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: absPath, Err: os.ErrNotExist}
+	} else if entry.isDir || entry.linkTarget != "" {
+		return nil, fmt.Errorf("%s: not a file", absPath)
+	}
+
+	return append([]byte{}, entry.data...), nil
+}
+
+func (target *MemoryTarget) WriteFile(absPath string, data []byte) error {
+	target.mutex.Lock()
+	defer target.mutex.Unlock()
+
+	absPath = filepath.Clean(absPath)
+	if entry, ok := target.entries[absPath]; ok && (entry.isDir || entry.linkTarget != "") {
+		return fmt.Errorf("%s: not a file", absPath)
+	}
+	if parent, ok := target.entries[filepath.Dir(absPath)]; !ok || !parent.isDir {
+		return fmt.Errorf("%s: no such folder", filepath.Dir(absPath))
+	}
+
+	target.entries[absPath] = memoryEntry{data: append([]byte{}, data...)}
+
+	return nil
+}
+
+func (target *MemoryTarget) FreeSpace(absPath string) (uint64, error) {
+	return target.Free, nil
+}
+
+func (target *MemoryTarget) RsyncPath(absPath string) string {
+	return absPath
+}
+
+func (target *MemoryTarget) RsyncOptions() []string {
+	return []string{}
+}
+
+func (target *MemoryTarget) Exec(command string, env []string, timeout time.Duration, logLabel string, logger *log.Logger) (int, error) {
+	return -1, fmt.Errorf("commands can not be run on %s", target)
+}
+
+func (target *MemoryTarget) Close() error {
+	return nil
+}
@@ -0,0 +1,457 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alessio/shellescape"
+	"github.com/google/uuid"
+	"golang.org/x/crypto/ssh"
+)
+
+// SSHTarget is a Target on a remote host, accessed by running shell commands over ssh. By
+// default, a single connection made by the built-in SSH client is reused for all commands of
+// a run; with --ssh-client exec, a new ssh process is spawned for each command instead.
+// Besides the target folder, it is used to access remote sources, see ValidateSources.
+type SSHTarget struct {
+	options    *Options
+	host       string
+	sshOptions []string
+
+	mutex         sync.Mutex
+	client        *ssh.Client
+	stopKeepalive chan struct{}
+}
+
+// NewSSHTarget returns an SSHTarget for host, connecting with the passed ssh options
+func NewSSHTarget(options *Options, host string, sshOptions []string) *SSHTarget {
+	return &SSHTarget{options: options, host: host, sshOptions: sshOptions}
+}
+
+func (target *SSHTarget) String() string {
+	config, _, err := parseSSHOptions(target.sshOptions)
+	if err != nil {
+		return target.host
+	}
+
+	if config.user == "" {
+		return fmt.Sprintf("%s:%d", target.host, config.port)
+	}
+
+	return fmt.Sprintf("%s@%s:%d", config.user, target.host, config.port)
+}
+
+// run executes cmd on the remote host and returns its stdout lines
+func (target *SSHTarget) run(cmd string) ([]string, error) {
+	return target.runWithInput(cmd, nil)
+}
+
+// runWithInput executes cmd on the remote host like run, passing input to its stdin
+func (target *SSHTarget) runWithInput(cmd string, input io.Reader) ([]string, error) {
+	if target.options.sshClient == sshClientExec {
+		stdout, stderr, _, err := sshCallWithInput(target.options, target.host, target.sshOptions, cmd, input, target.options.log.Debug)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v %s", cmd, err, strings.Join(stderr, " "))
+		}
+
+		return stdout, nil
+	}
+
+	target.options.log.Debug.Printf("SSHTarget: running %s", cmd)
+
+	session, err := target.session()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	var stdoutBuf, stderrBuf bytes.Buffer
+	session.Stdin = input
+	session.Stdout = &stdoutBuf
+	session.Stderr = &stderrBuf
+
+	err = session.Run(cmd)
+
+	stdout := splitOutputLines(stdoutBuf.String())
+	stderr := splitOutputLines(stderrBuf.String())
+	for _, line := range stdout {
+		target.options.log.Debug.Printf("[ ssh stdout ] %s", line)
+	}
+	for _, line := range stderr {
+		target.options.log.Debug.Printf("[ ssh stderr ] %s", line)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v %s", cmd, err, strings.Join(stderr, " "))
+	}
+
+	return stdout, nil
+}
+
+// session opens a new session on the connection to the remote host, connecting first if
+// necessary. If the connection was lost (e.g. during a long rsync run), it is reestablished.
+func (target *SSHTarget) session() (*ssh.Session, error) {
+	target.mutex.Lock()
+	defer target.mutex.Unlock()
+
+	if target.client != nil {
+		session, err := target.client.NewSession()
+		if err == nil {
+			return session, nil
+		}
+
+		target.options.log.Debug.Printf("SSHTarget: connection lost (%v), reconnecting", err)
+		target.closeClient()
+	}
+
+	client, err := dialSSH(target.options, target.host, target.sshOptions)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to %s: %v", target, err)
+	}
+	target.client = client
+	target.stopKeepalive = make(chan struct{})
+	go sshKeepalive(client, target.stopKeepalive)
+
+	return client.NewSession()
+}
+
+// Close closes the connection to the remote host, if any
+func (target *SSHTarget) Close() error {
+	target.mutex.Lock()
+	defer target.mutex.Unlock()
+
+	return target.closeClient()
+}
+
+func (target *SSHTarget) closeClient() error {
+	if target.client == nil {
+		return nil
+	}
+
+	close(target.stopKeepalive)
+	err := target.client.Close()
+	target.client = nil
+
+	return err
+}
+
+// sshKeepalive periodically sends keepalive requests on client until stop is closed
+func sshKeepalive(client *ssh.Client, stop chan struct{}) {
+	ticker := time.NewTicker(sshKeepaliveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if _, _, err := client.SendRequest("keepalive@openssh.com", true, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// splitOutputLines splits command output into lines, dropping the trailing newline
+func splitOutputLines(output string) []string {
+	output = strings.TrimSuffix(output, "\n")
+	if output == "" {
+		return []string{}
+	}
+
+	return strings.Split(output, "\n")
+}
+
+// runWithMarker executes the command built by buildCmd on the remote host and returns the
+// rest of the first stdout line starting with the passed marker. The marker is random, so
+// unrelated output such as login banners cannot be mistaken for the command's output.
+func (target *SSHTarget) runWithMarker(buildCmd func(marker string) string) (string, error) {
+	markerUUID, err := uuid.NewRandom()
+	if err != nil {
+		return "", fmt.Errorf("could not generate marker: %v", err)
+	}
+	marker := markerUUID.String() + ":"
+
+	cmd := buildCmd(marker)
+	stdout, err := target.run(cmd)
+	if err != nil {
+		return "", err
+	}
+
+	for _, line := range stdout {
+		if strings.HasPrefix(line, marker) {
+			return strings.TrimPrefix(line, marker), nil
+		}
+	}
+
+	return "", fmt.Errorf("%s: unexpected output %v", cmd, stdout)
+}
+
+func (target *SSHTarget) ListFolders(absPath string) ([]string, error) {
+	stdout, err := target.run(fmt.Sprintf("find %s -mindepth 1 -maxdepth 1 -type d", shellescape.Quote(absPath)))
+	if err != nil {
+		return nil, err
+	}
+
+	folderNames := []string{}
+	for _, folderPath := range stdout {
+		folderNames = append(folderNames, path.Base(folderPath))
+	}
+
+	return folderNames, nil
+}
+
+func (target *SSHTarget) Stat(absPath string) (TargetFileInfo, error) {
+	quotedPath := shellescape.Quote(absPath)
+	// The modification time is printed as Unix time by GNU (-c) or BSD (-f) stat
+	result, err := target.runWithMarker(func(marker string) string {
+		return fmt.Sprintf(
+			"if [ -L %[2]s ]; then t=symlink; elif [ -d %[2]s ]; then t=dir; elif [ -e %[2]s ]; then t=file; else t=missing; fi; "+
+				"m=; [ $t != missing ] && m=$(stat -c %%Y %[2]s 2>/dev/null || stat -f %%m %[2]s 2>/dev/null); echo %[1]s$t $m",
+			marker,
+			quotedPath,
+		)
+	})
+	if err != nil {
+		return TargetFileInfo{}, err
+	}
+
+	fields := strings.Fields(result)
+	if len(fields) == 0 {
+		return TargetFileInfo{}, fmt.Errorf("unexpected output %q for %s", result, absPath)
+	}
+
+	info := TargetFileInfo{Exists: true}
+	if len(fields) > 1 {
+		if seconds, err := strconv.ParseInt(fields[1], 10, 64); err == nil {
+			info.ModTime = time.Unix(seconds, 0)
+		}
+	}
+
+	switch fields[0] {
+	case "symlink":
+		info.IsSymlink = true
+		return info, nil
+	case "dir":
+		info.IsDir = true
+		return info, nil
+	case "file":
+		return info, nil
+	case "missing":
+		return TargetFileInfo{}, nil
+	}
+
+	return TargetFileInfo{}, fmt.Errorf("unexpected file type %q for %s", fields[0], absPath)
+}
+
+func (target *SSHTarget) MkdirAll(absPath string, perm os.FileMode) error {
+	_, err := target.run(fmt.Sprintf("mkdir -p -m %o %s", perm, shellescape.Quote(absPath)))
+	return err
+}
+
+func (target *SSHTarget) Mkdir(absPath string) error {
+	result, err := target.runWithMarker(func(marker string) string {
+		return fmt.Sprintf("if mkdir %[2]s; then echo %[1]screated; elif [ -e %[2]s ]; then echo %[1]sexists; else echo %[1]sfailed; fi", marker, shellescape.Quote(absPath))
+	})
+	if err != nil {
+		return err
+	}
+
+	switch result {
+	case "created":
+		return nil
+	case "exists":
+		return &os.PathError{Op: "mkdir", Path: absPath, Err: os.ErrExist}
+	}
+
+	return fmt.Errorf("%s: could not create folder", absPath)
+}
+
+func (target *SSHTarget) Rename(fromPath string, toPath string) error {
+	_, err := target.run(fmt.Sprintf("mv %s %s", shellescape.Quote(fromPath), shellescape.Quote(toPath)))
+	return err
+}
+
+func (target *SSHTarget) RemoveAll(absPath string) error {
+	_, err := target.run(fmt.Sprintf("rm -rf %s", shellescape.Quote(absPath)))
+	return err
+}
+
+func (target *SSHTarget) Symlink(linkTarget string, linkPath string) error {
+	_, err := target.run(fmt.Sprintf("ln -s %s %s", shellescape.Quote(linkTarget), shellescape.Quote(linkPath)))
+	return err
+}
+
+func (target *SSHTarget) Readlink(linkPath string) (string, error) {
+	linkTarget, err := target.runWithMarker(func(marker string) string {
+		return fmt.Sprintf("echo %s$(readlink %s)", marker, shellescape.Quote(linkPath))
+	})
+	if err != nil {
+		return "", err
+	} else if linkTarget == "" {
+		return "", fmt.Errorf("%s is not a symlink", linkPath)
+	}
+
+	return linkTarget, nil
+}
+
+func (target *SSHTarget) ReadFile(absPath string) ([]byte, error) {
+	quotedPath := shellescape.Quote(absPath)
+
+	markerUUID, err := uuid.NewRandom()
+	if err != nil {
+		return nil, fmt.Errorf("could not generate marker: %v", err)
+	}
+	marker := markerUUID.String() + ":"
+
+	// The contents are base64-encoded, so they survive the line-based output handling
+	stdout, err := target.run(fmt.Sprintf(
+		"if [ -f %[2]s ]; then echo %[1]sfile; base64 %[2]s; elif [ -e %[2]s ]; then echo %[1]sother; else echo %[1]smissing; fi",
+		marker,
+		quotedPath,
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	for i, line := range stdout {
+		switch line {
+		case marker + "missing":
+			return nil, &os.PathError{Op: "open", Path: absPath, Err: os.ErrNotExist}
+		case marker + "other":
+			return nil, fmt.Errorf("%s: not a file", absPath)
+		case marker + "file":
+			data, err := base64.StdEncoding.DecodeString(strings.Join(stdout[i+1:], ""))
+			if err != nil {
+				return nil, fmt.Errorf("%s: could not decode contents: %v", absPath, err)
+			}
+			return data, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%s: unexpected output %v", absPath, stdout)
+}
+
+func (target *SSHTarget) WriteFile(absPath string, data []byte) error {
+	tmpPath := path.Join(path.Dir(absPath), "."+path.Base(absPath)+".tmp")
+
+	// The contents are passed on stdin, since the command line is limited in length
+	_, err := target.runWithInput(fmt.Sprintf(
+		"cat > %s && mv -f %s %s",
+		shellescape.Quote(tmpPath),
+		shellescape.Quote(tmpPath),
+		shellescape.Quote(absPath),
+	), bytes.NewReader(data))
+	return err
+}
+
+func (target *SSHTarget) FreeSpace(absPath string) (uint64, error) {
+	available, err := target.runWithMarker(func(marker string) string {
+		return fmt.Sprintf("echo %s$(df -Pk %s | tail -n 1 | awk '{print $4}')", marker, shellescape.Quote(absPath))
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	kilobytes, err := strconv.ParseUint(strings.TrimSpace(available), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("unexpected df output %q: %v", available, err)
+	}
+
+	return kilobytes * 1024, nil
+}
+
+func (target *SSHTarget) RsyncPath(absPath string) string {
+	return fmt.Sprintf("%s:%s", target.host, absPath)
+}
+
+func (target *SSHTarget) RsyncOptions() []string {
+	return []string{"-e", fmt.Sprintf("ssh %s", strings.Join(target.sshOptions, " "))}
+}
+
+// Exec passes the environment variables using env(1), since SSH servers usually only accept
+// a few variables set on the session. On timeout, the native client sends the remote command
+// SIGKILL and closes the session, though many SSH servers ignore signal requests. The exec
+// client can only kill the local ssh process, leaving the remote command running until it
+// writes to the closed connection or ends.
+func (target *SSHTarget) Exec(command string, env []string, timeout time.Duration, logLabel string, logger *log.Logger) (int, error) {
+	quotedEnv := []string{}
+	for _, variable := range env {
+		quotedEnv = append(quotedEnv, shellescape.Quote(variable))
+	}
+	cmd := fmt.Sprintf("env %s sh -c %s", strings.Join(quotedEnv, " "), shellescape.Quote(command))
+
+	if target.options.sshClient == sshClientExec {
+		args := append(append([]string{}, target.sshOptions...), target.host, cmd)
+		target.options.log.Debug.Printf("call: Full command line: ssh %v", args)
+
+		exitCode, err := runCmd(exec.Command("ssh", args...), timeout, logLines(logLabel, logger))
+		return exitCode, err
+	}
+
+	target.options.log.Debug.Printf("SSHTarget: running %s", cmd)
+
+	session, err := target.session()
+	if err != nil {
+		return -1, err
+	}
+	defer session.Close()
+
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		return -1, err
+	}
+	stderr, err := session.StderrPipe()
+	if err != nil {
+		return -1, err
+	}
+
+	if err := session.Start(cmd); err != nil {
+		return -1, err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		var streams sync.WaitGroup
+		streams.Add(2)
+		go handleCallStream("stdout", ioutil.NopCloser(stdout), logLines(logLabel, logger), &streams)
+		go handleCallStream("stderr", ioutil.NopCloser(stderr), logLines(logLabel, logger), &streams)
+		streams.Wait()
+
+		done <- session.Wait()
+	}()
+
+	var timeoutChannel <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		timeoutChannel = timer.C
+	}
+
+	select {
+	case err = <-done:
+	case <-timeoutChannel:
+		session.Signal(ssh.SIGKILL)
+		session.Close()
+		return -1, fmt.Errorf("timed out after %s", FormatDuration(timeout))
+	}
+
+	if exitError, ok := err.(*ssh.ExitError); ok {
+		return exitError.ExitStatus(), err
+	} else if err != nil {
+		return -1, err
+	}
+
+	return 0, nil
+}
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Results of a target in a run, see TargetStatus
+const (
+	targetResultOK      = "ok"
+	targetResultFailed  = "failed"
+	targetResultSkipped = "skipped"
+)
+
+// TargetDefinition is one of the targets of a profile. Each target receives its own copy of
+// every backup and is rotated using its own limits.
+type TargetDefinition struct {
+	// Name identifies the target in logs and reports
+	Name string
+	Path string
+	// Host is the remote host the target is on; empty for local targets
+	Host   string
+	User   string
+	Port   uint
+	Daemon bool
+
+	// max and maxAge are the limits set for this target by main folder or tier name, which
+	// override the profile's limits, see resolveLimits
+	max    map[string]uint
+	maxAge map[string]time.Duration
+
+	// The resolved limits of the target, see resolveLimits
+	maxMain    uint
+	maxMainAge time.Duration
+	tiers      []Tier
+}
+
+// ParseTarget parses a target definition: either a path, on host (if not empty) using user
+// and port, or a URL with its own host, limits and name of the form
+// <scheme>://...[?name=<name>&max-<tier>=<n>&max-<tier>-age=<duration>...], where the scheme
+// is one of file:///path, ssh://[user@]host[:port]/path or
+// rsync://[user@]host[:port]/module/path. <tier> is main or the name of a tier.
+func ParseTarget(definition string, host string, user string, port uint) (TargetDefinition, error) {
+	definition = strings.TrimSpace(definition)
+	if definition == "" {
+		return TargetDefinition{}, fmt.Errorf("empty target")
+	}
+
+	target := TargetDefinition{
+		max:    map[string]uint{},
+		maxAge: map[string]time.Duration{},
+	}
+
+	schemeEnd := strings.Index(definition, "://")
+	if schemeEnd < 0 {
+		target.Path = definition
+		target.Host = host
+		target.User = user
+		target.Port = port
+		target.Name = target.Location()
+		return target, nil
+	}
+
+	targetURL, err := url.Parse(definition)
+	if err != nil {
+		return TargetDefinition{}, fmt.Errorf("invalid target %q: %v", definition, err)
+	}
+	location := strings.SplitN(definition, "?", 2)[0]
+
+	switch targetURL.Scheme {
+	case "file":
+		if targetURL.Host != "" {
+			return TargetDefinition{}, fmt.Errorf("invalid target %q: file URLs must not have a host, use file:///path", definition)
+		}
+		target.Path = targetURL.Path
+	case "ssh":
+		target.Host = targetURL.Hostname()
+		target.Path = targetURL.Path
+		target.Port = 22
+		if targetURL.User != nil {
+			target.User = targetURL.User.Username()
+		}
+		if targetURL.Port() != "" {
+			parsedPort, err := strconv.ParseUint(targetURL.Port(), 10, 16)
+			if err != nil || parsedPort == 0 {
+				return TargetDefinition{}, fmt.Errorf("invalid target %q: invalid port %q", definition, targetURL.Port())
+			}
+			target.Port = uint(parsedPort)
+		}
+		if target.Host == "" {
+			return TargetDefinition{}, fmt.Errorf("invalid target %q: missing host", definition)
+		}
+	case "rsync":
+		target.Host, target.User, target.Port, target.Path, err = parseDaemonURL(location)
+		if err != nil {
+			return TargetDefinition{}, fmt.Errorf("invalid target %q: %v", definition, err)
+		}
+		target.Daemon = true
+	default:
+		return TargetDefinition{}, fmt.Errorf("invalid target %q: unknown scheme %q, expected file, ssh or rsync", definition, targetURL.Scheme)
+	}
+
+	if target.Path == "" || target.Path == "/" {
+		return TargetDefinition{}, fmt.Errorf("invalid target %q: missing path", definition)
+	}
+
+	target.Name = location
+	for key, values := range targetURL.Query() {
+		value := values[len(values)-1]
+
+		switch {
+		case key == "name":
+			target.Name = strings.TrimSpace(value)
+			if target.Name == "" {
+				return TargetDefinition{}, fmt.Errorf("invalid target %q: empty name", definition)
+			}
+		case strings.HasPrefix(key, "max-") && strings.HasSuffix(key, "-age"):
+			maxAge, err := ParseDuration(value)
+			if err != nil {
+				return TargetDefinition{}, fmt.Errorf("invalid target %q: %s: %v", definition, key, err)
+			}
+			target.maxAge[strings.TrimSuffix(strings.TrimPrefix(key, "max-"), "-age")] = maxAge
+		case strings.HasPrefix(key, "max-"):
+			max, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				return TargetDefinition{}, fmt.Errorf("invalid target %q: %s: expected a non-negative integer, got %q", definition, key, value)
+			}
+			target.max[strings.TrimPrefix(key, "max-")] = uint(max)
+		default:
+			return TargetDefinition{}, fmt.Errorf("invalid target %q: unknown parameter %q, expected name, max-<tier> or max-<tier>-age", definition, key)
+		}
+	}
+
+	return target, nil
+}
+
+// ParseTargets parses a list of target definitions, see ParseTarget. Target names must be
+// unique.
+func ParseTargets(definitions []string, host string, user string, port uint) ([]TargetDefinition, error) {
+	targets := []TargetDefinition{}
+	seen := map[string]bool{}
+
+	for _, definition := range definitions {
+		target, err := ParseTarget(definition, host, user, port)
+		if err != nil {
+			return nil, err
+		}
+
+		if seen[target.Name] {
+			return nil, fmt.Errorf("duplicate target %q; use the name parameter to tell targets apart", target.Name)
+		}
+		seen[target.Name] = true
+
+		targets = append(targets, target)
+	}
+
+	return targets, nil
+}
+
+// IsRemote returns true if the target is on a remote host
+func (target TargetDefinition) IsRemote() bool {
+	return target.Host != ""
+}
+
+// Location returns a description of where the target is, without its limits
+func (target TargetDefinition) Location() string {
+	if target.Daemon {
+		return daemonURL(target.Host, target.User, target.Port, target.Path)
+	} else if target.IsRemote() {
+		return fmt.Sprintf("%s:%s", target.Host, target.Path)
+	}
+
+	return target.Path
+}
+
+// resolveLimits determines the target's limits: the profile's main folder limits and tier
+// chain, with the limits set for the target replacing those of the profile. With the default
+// tier chain (customTiers false), they can also enable the optional hourly and yearly tiers
+// for the target only. profileLimits returns the profile's limits for the default tiers.
+func (target *TargetDefinition) resolveLimits(options *Options, customTiers bool, profileLimits func(name string) (uint, time.Duration)) error {
+	limits := func(name string, max uint, maxAge time.Duration) (uint, time.Duration) {
+		if value, ok := target.max[name]; ok {
+			max = value
+		}
+		if value, ok := target.maxAge[name]; ok {
+			maxAge = value
+		}
+		return max, maxAge
+	}
+
+	known := map[string]bool{"main": true}
+	target.maxMain, target.maxMainAge = limits("main", options.maxMain, options.maxMainAge)
+
+	if customTiers {
+		target.tiers = []Tier{}
+		for _, tier := range options.tiers {
+			tier.Max, tier.MaxAge = limits(tier.Name(), tier.Max, tier.MaxAge)
+			target.tiers = append(target.tiers, tier)
+			known[tier.Name()] = true
+		}
+	} else {
+		target.tiers = DefaultTiers(func(name string) (uint, time.Duration) {
+			known[name] = true
+			max, maxAge := profileLimits(name)
+			return limits(name, max, maxAge)
+		})
+	}
+
+	for name := range target.max {
+		if !known[name] {
+			return fmt.Errorf("target %s: max-%s: unknown tier %q", target.Name, name, name)
+		}
+	}
+	for name := range target.maxAge {
+		if !known[name] {
+			return fmt.Errorf("target %s: max-%s-age: unknown tier %q", target.Name, name, name)
+		}
+	}
+
+	return nil
+}
+
+// useTarget points the options to the passed target and its limits
+func (options *Options) useTarget(target TargetDefinition) {
+	options.target = target.Path
+	options.targetHost = target.Host
+	options.targetUser = target.User
+	options.targetPort = target.Port
+	options.targetDaemon = target.Daemon
+	options.maxMain = target.maxMain
+	options.maxMainAge = target.maxMainAge
+	options.tiers = target.tiers
+}
+
+// TargetOptions returns one Options per target of the profile. For profiles with a single
+// target, this is the profile's Options itself; otherwise, each is a copy pointing to one
+// target, with its own connection and a logger tagged with the target's name. Copies must be
+// closed using CloseTarget.
+func (options *Options) TargetOptions() []*Options {
+	if len(options.targets) <= 1 {
+		return []*Options{options}
+	}
+
+	optionsList := []*Options{}
+	for _, target := range options.targets {
+		targetOptions := *options
+		targetOptions.useTarget(target)
+		targetOptions.targetName = target.Name
+		targetOptions.targetBackend = nil
+		targetOptions.targetLock = nil
+		if options.log != nil {
+			targetOptions.log = options.log.Child(target.Name)
+		}
+
+		optionsList = append(optionsList, &targetOptions)
+	}
+
+	return optionsList
+}
+
+// ProfileDescription returns the profile's name, followed by the target's name for profiles
+// with several targets, for messages
+func (options *Options) ProfileDescription() string {
+	if options.targetName == "" {
+		return options.profileName
+	}
+
+	return fmt.Sprintf("%s, target %s", options.profileName, options.targetName)
+}
+
+// TargetStatus is the outcome of a run for one target of the profile
+type TargetStatus struct {
+	Name   string
+	Result string
+	// Err is the error the target failed with
+	Err string
+	// LogLevel is the highest level logged for the target, see logger.MaxLogLevel
+	LogLevel string
+	Duration time.Duration
+	// Stats are the transfer statistics of the backup, if rsync ran
+	Stats *RsyncStats
+	// Changes summarizes the changes in the backup, if rsync ran
+	Changes *ChangeSummary
+	// Metadata describes the backup, if rsync ran
+	Metadata *BackupMetadata
+	// Rotation are the actions performed by the rotation
+	Rotation []RotationAction
+	// Inventory holds the backups in each tier after the run, see BackupInventory
+	Inventory map[string][]string
+	// FreeSpace is the free space on the target after the run, if known
+	FreeSpace *uint64
+}
+
+func (status TargetStatus) String() string {
+	switch status.Result {
+	case targetResultFailed:
+		return fmt.Sprintf("%s: FAILED after %s: %s", status.Name, status.Duration.Round(100*time.Millisecond), status.Err)
+	case targetResultSkipped:
+		return fmt.Sprintf("%s: skipped", status.Name)
+	}
+
+	if status.LogLevel != "INFO" {
+		return fmt.Sprintf("%s: ok after %s, with %s messages", status.Name, status.Duration.Round(100*time.Millisecond), status.LogLevel)
+	}
+	return fmt.Sprintf("%s: ok after %s", status.Name, status.Duration.Round(100*time.Millisecond))
+}
+
+// targetRun is the run of a profile on one of its targets
+type targetRun struct {
+	options *Options
+	status  *TargetStatus
+}
+
+// newTargetRuns prepares running the profile on each of its targets and records their
+// statuses in the options for the report
+func newTargetRuns(options *Options) []*targetRun {
+	runs := []*targetRun{}
+	options.targetStatuses = []*TargetStatus{}
+
+	for _, targetOptions := range options.TargetOptions() {
+		status := &TargetStatus{Name: targetOptions.targetName, Result: targetResultSkipped}
+		if status.Name == "" {
+			status.Name = targetOptions.TargetPath()
+		}
+
+		runs = append(runs, &targetRun{options: targetOptions, status: status})
+		options.targetStatuses = append(options.targetStatuses, status)
+	}
+
+	return runs
+}
+
+// do runs step for the target unless the target already failed. A failure only fails this
+// target; it is logged for profiles with several targets, and otherwise left to be reported
+// as the failure of the whole run.
+func (run *targetRun) do(step func(options *Options)) {
+	if run.status.Result == targetResultFailed {
+		return
+	}
+
+	start := time.Now()
+	defer func() {
+		run.status.Duration += time.Since(start)
+
+		if recoveryMessage := recover(); recoveryMessage != nil {
+			run.status.Result = targetResultFailed
+			run.status.Err = fmt.Sprintf("%v", recoveryMessage)
+			if run.options.targetName != "" {
+				run.options.log.Error.Printf("Target failed: %s", run.status.Err)
+			}
+		}
+		run.status.LogLevel = run.options.log.MaxLogLevel()
+		run.status.Stats = run.options.rsyncStats
+		run.status.Changes = run.options.changeSummary
+		run.status.Metadata = run.options.backupMetadata
+		run.status.Rotation = run.options.rotationActions
+		run.status.Inventory = run.options.inventory
+		run.status.FreeSpace = run.options.freeSpace
+	}()
+
+	step(run.options)
+}
+
+// runTargets runs step for all targets that have not failed yet, one after the other or,
+// with parallel, all at once. Backup steps thus read the sources once per target.
+func runTargets(runs []*targetRun, parallel bool, step func(options *Options)) {
+	if !parallel {
+		for _, run := range runs {
+			run.do(step)
+		}
+		return
+	}
+
+	var wg sync.WaitGroup
+	for _, run := range runs {
+		wg.Add(1)
+		go func(run *targetRun) {
+			defer wg.Done()
+			run.do(step)
+		}(run)
+	}
+	wg.Wait()
+}
+
+// checkTargetRuns fails the run if targets have failed: if all have failed, or, with
+// complete, if any has. For a single target, its error is passed on as is.
+func checkTargetRuns(runs []*targetRun, complete bool) {
+	failed := []string{}
+	for _, run := range runs {
+		if run.status.Result == targetResultFailed {
+			failed = append(failed, run.status.Name)
+		}
+	}
+
+	if len(failed) == 0 || (len(failed) < len(runs) && !complete) {
+		return
+	}
+
+	if len(runs) == 1 {
+		panic(runs[0].status.Err)
+	}
+	panic(fmt.Sprintf("%d of %d targets failed: %s", len(failed), len(runs), strings.Join(failed, ", ")))
+}
+
+// closeTargetRuns closes the connections of all target runs
+func closeTargetRuns(runs []*targetRun) {
+	for _, run := range runs {
+		run.options.CloseTarget()
+	}
+}
+
+// logTargetStatuses logs the outcome of the run for each target of profiles with several
+// targets
+func logTargetStatuses(options *Options) {
+	if len(options.targetStatuses) <= 1 {
+		return
+	}
+
+	options.log.Info.Printf("Targets:")
+	for _, status := range options.targetStatuses {
+		options.log.Info.Printf("  %s", status)
+	}
+}
+
+// ReportLogLevel returns the highest level logged during the run, for the profile itself and
+// all of its targets
+func (options *Options) ReportLogLevel() string {
+	levels := []string{"INFO", "WARN", "ERROR", "FATAL"}
+	rank := func(level string) int {
+		for i, l := range levels {
+			if l == level {
+				return i
+			}
+		}
+		return 0
+	}
+
+	logLevel := options.log.MaxLogLevel()
+	for _, status := range options.targetStatuses {
+		if rank(status.LogLevel) > rank(logLevel) {
+			logLevel = status.LogLevel
+		}
+	}
+
+	return logLevel
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseTarget(t *testing.T) {
+	tests := []struct {
+		definition string
+		expected   TargetDefinition
+		err        bool
+	}{
+		{"/backups/www", TargetDefinition{Name: "/backups/www", Path: "/backups/www"}, false},
+		{"file:///backups/www", TargetDefinition{Name: "file:///backups/www", Path: "/backups/www"}, false},
+		{
+			"ssh://backup@offsite:2222/backups/www?name=offsite",
+			TargetDefinition{Name: "offsite", Host: "offsite", User: "backup", Port: 2222, Path: "/backups/www"},
+			false,
+		},
+		{"ssh://offsite/backups/www", TargetDefinition{Name: "ssh://offsite/backups/www", Host: "offsite", Port: 22, Path: "/backups/www"}, false},
+		{
+			"rsync://nas/backups/www",
+			TargetDefinition{Name: "rsync://nas/backups/www", Host: "nas", Port: rsyncDaemonDefaultPort, Daemon: true, Path: "/backups/www"},
+			false,
+		},
+		{"", TargetDefinition{}, true},
+		{"file://host/backups", TargetDefinition{}, true},
+		{"ssh:///backups", TargetDefinition{}, true},
+		{"ssh://offsite", TargetDefinition{}, true},
+		{"ssh://offsite:99999/backups", TargetDefinition{}, true},
+		{"ftp://offsite/backups", TargetDefinition{}, true},
+		{"file:///backups?name=", TargetDefinition{}, true},
+		{"file:///backups?max-daily=-1", TargetDefinition{}, true},
+		{"file:///backups?max-daily-age=soon", TargetDefinition{}, true},
+	}
+
+	for _, test := range tests {
+		target, err := ParseTarget(test.definition, "", "", 0)
+		if test.err {
+			if err == nil {
+				t.Errorf("ParseTarget(%q) = %+v, expected an error", test.definition, target)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseTarget(%q): unexpected error: %v", test.definition, err)
+			continue
+		}
+
+		if target.Name != test.expected.Name || target.Path != test.expected.Path || target.Host != test.expected.Host ||
+			target.User != test.expected.User || target.Port != test.expected.Port || target.Daemon != test.expected.Daemon {
+			t.Errorf("ParseTarget(%q) = %+v, expected %+v", test.definition, target, test.expected)
+		}
+	}
+}
+
+func TestParseTargetLimits(t *testing.T) {
+	target, err := ParseTarget("file:///backups?max-main=3&max-daily=14&max-weekly-age=8w", "", "", 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if target.max["main"] != 3 || target.max["daily"] != 14 || target.maxAge["weekly"] != 8*7*24*time.Hour {
+		t.Errorf("got limits %v and %v", target.max, target.maxAge)
+	}
+}
+
+func TestParseTargetPlainPathUsesHost(t *testing.T) {
+	target, err := ParseTarget("/backups/www", "nas", "backup", 2222)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if target.Host != "nas" || target.User != "backup" || target.Port != 2222 || target.Name != "nas:/backups/www" {
+		t.Errorf("got %+v", target)
+	}
+}
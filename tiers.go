@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Calendar periods backups in a tier can be grouped by
+const (
+	tierPeriodHour    = "hour"
+	tierPeriodDay     = "day"
+	tierPeriodWeek    = "week"
+	tierPeriodMonth   = "month"
+	tierPeriodQuarter = "quarter"
+	tierPeriodYear    = "year"
+)
+
+// reservedTierNames are tier names (see Tier.Name) that refer to something else in backup
+// references and limits: the main folder and the _error folders of failed backups
+var reservedTierNames = []string{"main", "error"}
+
+// Tier is a folder in the rotation chain. Backups exceeding the limits of the previous folder
+// (the main folder for the first tier) are moved into it, all but the most recent backup of
+// each period are deleted, and backups exceeding the tier's limits are moved on to the next
+// tier, or deleted for the last tier.
+type Tier struct {
+	// FolderName is the name of the tier's folder inside the target folder, e.g. "_daily"
+	FolderName string
+	Period     TierPeriod
+	// Max is the number of backups to keep; 0 means no count limit if MaxAge is set
+	Max uint
+	// MaxAge is the age up to which backups are kept; 0 means no age limit
+	MaxAge time.Duration
+}
+
+// Name returns the name the tier is referred to by in listings and backup references: its
+// folder name without the leading underscore
+func (tier Tier) Name() string {
+	return strings.TrimPrefix(tier.FolderName, "_")
+}
+
+func (tier Tier) String() string {
+	if tier.MaxAge > 0 {
+		return fmt.Sprintf("%s:%s:%d:%s", tier.FolderName, tier.Period, tier.Max, FormatDuration(tier.MaxAge))
+	}
+
+	return fmt.Sprintf("%s:%s:%d", tier.FolderName, tier.Period, tier.Max)
+}
+
+// TierPeriod is the period backups in a tier are grouped by: either a calendar period (see
+// the tierPeriod* constants) or a fixed duration
+type TierPeriod struct {
+	unit     string
+	duration time.Duration
+}
+
+// ParseTierPeriod parses a calendar period name (hour, day, week, month, quarter, year) or a
+// duration such as "6h" or "3d"
+func ParseTierPeriod(value string) (TierPeriod, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+
+	switch value {
+	case tierPeriodHour, tierPeriodDay, tierPeriodWeek, tierPeriodMonth, tierPeriodQuarter, tierPeriodYear:
+		return TierPeriod{unit: value}, nil
+	}
+
+	duration, err := ParseDuration(value)
+	if err != nil {
+		return TierPeriod{}, fmt.Errorf("invalid period %q: expected hour, day, week, month, quarter, year or a duration such as 6h or 3d", value)
+	}
+
+	if duration < time.Second {
+		return TierPeriod{}, fmt.Errorf("invalid period %q: must be at least 1s", value)
+	}
+
+	return TierPeriod{duration: duration}, nil
+}
+
+func (period TierPeriod) String() string {
+	if period.unit != "" {
+		return period.unit
+	}
+
+	return FormatDuration(period.duration)
+}
+
+// Group returns a number identifying the period t falls into. Later periods have higher
+// numbers.
+func (period TierPeriod) Group(t time.Time) int64 {
+	switch period.unit {
+	case tierPeriodHour:
+		return int64(t.Year())*1000000 + int64(t.Month())*10000 + int64(t.Day())*100 + int64(t.Hour())
+	case tierPeriodDay:
+		return int64(t.Year())*10000 + int64(t.Month())*100 + int64(t.Day())
+	case tierPeriodWeek:
+		year, week := t.ISOWeek()
+		return int64(year)*10000 + int64(week)*100
+	case tierPeriodMonth:
+		return int64(t.Year())*10000 + int64(t.Month())*100
+	case tierPeriodQuarter:
+		return int64(t.Year())*10000 + int64((int(t.Month())-1)/3+1)*100
+	case tierPeriodYear:
+		return int64(t.Year()) * 10000
+	}
+
+	// Align fixed durations to the local epoch, so e.g. "1d" periods start at midnight
+	_, offset := t.Zone()
+	return (t.Unix() + int64(offset)) / int64(period.duration/time.Second)
+}
+
+// Describe returns the period for use in log messages, e.g. "day" or "6h period"
+func (period TierPeriod) Describe() string {
+	if period.unit != "" {
+		return period.unit
+	}
+
+	return fmt.Sprintf("%s period", period)
+}
+
+// ParseTier parses a tier definition of the form <folder name>:<period>:<max>[:<max age>],
+// e.g. "_daily:day:7" or "_daily:day:7:14d"
+func ParseTier(definition string) (Tier, error) {
+	parts := strings.Split(definition, ":")
+	if len(parts) != 3 && len(parts) != 4 {
+		return Tier{}, fmt.Errorf("invalid tier %q: expected <folder name>:<period>:<max>[:<max age>]", definition)
+	}
+
+	folderName := strings.TrimSpace(parts[0])
+	if folderName == "" || folderName == "." || folderName == ".." || strings.Contains(folderName, "/") {
+		return Tier{}, fmt.Errorf("invalid tier %q: invalid folder name %q", definition, folderName)
+	}
+	// Names starting with "__" are used for the files of this tool in the target folder, such
+	// as LatestSymlinkName and LockFolderName
+	if strings.HasPrefix(folderName, "__") || BackupFolderNameRegex.MatchString(folderName) || LeftoverFolderNameRegex.MatchString(folderName) {
+		return Tier{}, fmt.Errorf("invalid tier %q: folder name %q is reserved", definition, folderName)
+	}
+	for _, reserved := range reservedTierNames {
+		if strings.TrimPrefix(folderName, "_") == reserved {
+			return Tier{}, fmt.Errorf("invalid tier %q: tier name %q is reserved", definition, reserved)
+		}
+	}
+
+	period, err := ParseTierPeriod(parts[1])
+	if err != nil {
+		return Tier{}, fmt.Errorf("invalid tier %q: %v", definition, err)
+	}
+
+	var maxAge time.Duration
+	if len(parts) == 4 {
+		maxAge, err = ParseDuration(parts[3])
+		if err != nil || maxAge <= 0 {
+			return Tier{}, fmt.Errorf("invalid tier %q: invalid max age %q", definition, parts[3])
+		}
+	}
+
+	max, err := strconv.ParseUint(strings.TrimSpace(parts[2]), 10, 32)
+	if err != nil || (max < 1 && maxAge == 0) {
+		return Tier{}, fmt.Errorf("invalid tier %q: max must be a number >= 1, or 0 if a max age is set", definition)
+	}
+
+	return Tier{FolderName: folderName, Period: period, Max: uint(max), MaxAge: maxAge}, nil
+}
+
+// ParseTiers parses a list of tier definitions (see ParseTier) into a tier chain
+func ParseTiers(definitions []string) ([]Tier, error) {
+	tiers := []Tier{}
+	seenFolders := map[string]bool{}
+	seenNames := map[string]bool{}
+
+	for _, definition := range definitions {
+		tier, err := ParseTier(definition)
+		if err != nil {
+			return nil, err
+		}
+
+		if seenFolders[tier.FolderName] {
+			return nil, fmt.Errorf("duplicate tier folder %q", tier.FolderName)
+		}
+		// e.g. "daily" and "_daily"
+		if seenNames[tier.Name()] {
+			return nil, fmt.Errorf("duplicate tier %q", tier.Name())
+		}
+		seenFolders[tier.FolderName] = true
+		seenNames[tier.Name()] = true
+
+		tiers = append(tiers, tier)
+	}
+
+	return tiers, nil
+}
+
+// DefaultTiers returns the tier chain used when no tiers are configured explicitly: the
+// daily, weekly and monthly folders, preceded by the hourly folder and followed by the
+// yearly folder if enabled by their --max-* or --max-*-age option. limits returns the max
+// count and max age for the passed tier name.
+func DefaultTiers(limits func(name string) (uint, time.Duration)) []Tier {
+	tiers := []Tier{}
+
+	for _, tier := range []struct {
+		folderName string
+		period     string
+		optional   bool
+	}{
+		{HourlyFolderName, tierPeriodHour, true},
+		{DailyFolderName, tierPeriodDay, false},
+		{WeeklyFolderName, tierPeriodWeek, false},
+		{MonthlyFolderName, tierPeriodMonth, false},
+		{YearlyFolderName, tierPeriodYear, true},
+	} {
+		t := Tier{FolderName: tier.folderName, Period: TierPeriod{unit: tier.period}}
+		t.Max, t.MaxAge = limits(t.Name())
+
+		if tier.optional && t.Max == 0 && t.MaxAge == 0 {
+			continue
+		}
+
+		tiers = append(tiers, t)
+	}
+
+	return tiers
+}
+
+// TierFolderPath returns the full path to the passed tier's folder based on the target path
+func (options *Options) TierFolderPath(tier Tier) string {
+	return NormalizeFolderPath(filepath.Join(options.target, tier.FolderName))
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseTier(t *testing.T) {
+	tests := []struct {
+		definition string
+		expected   string
+		err        bool
+	}{
+		{"_daily:day:7", "_daily:day:7", false},
+		{"_daily:day:7:14d", "_daily:day:7:2w", false},
+		{"_daily:day:0:10d", "_daily:day:0:10d", false},
+		{"_6h:6h:4", "_6h:6h:4", false},
+		{"_quarterly:Quarter:4", "_quarterly:quarter:4", false},
+		{"_daily:day", "", true},
+		{"_daily:day:7:14d:x", "", true},
+		{"_daily:day:0", "", true},
+		{"_daily:day:-1", "", true},
+		{"_daily:day:7:0", "", true},
+		{"_daily:fortnight:7", "", true},
+		{"_daily:500ms:7", "", true},
+		{":day:7", "", true},
+		{"a/b:day:7", "", true},
+		{"..:day:7", "", true},
+		{"__latest:day:7", "", true},
+		{"2026-10-16_22-00-00:day:7", "", true},
+		{"_main:day:7", "", true},
+		{"error:day:7", "", true},
+	}
+
+	for _, test := range tests {
+		tier, err := ParseTier(test.definition)
+		if test.err {
+			if err == nil {
+				t.Errorf("ParseTier(%q) = %s, expected an error", test.definition, tier)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseTier(%q): unexpected error: %v", test.definition, err)
+		} else if tier.String() != test.expected {
+			t.Errorf("ParseTier(%q) = %s, expected %s", test.definition, tier, test.expected)
+		}
+	}
+}
+
+func TestParseTiersRejectsDuplicates(t *testing.T) {
+	for _, definitions := range [][]string{
+		{"_daily:day:7", "_daily:week:4"},
+		{"_daily:day:7", "daily:week:4"},
+	} {
+		if _, err := ParseTiers(definitions); err == nil {
+			t.Errorf("ParseTiers(%q): expected an error", definitions)
+		}
+	}
+
+	if tiers, err := ParseTiers([]string{"_daily:day:7", "_weekly:week:4:8w"}); err != nil {
+		t.Errorf("ParseTiers: unexpected error: %v", err)
+	} else if len(tiers) != 2 || tiers[1].MaxAge != 8*7*24*time.Hour {
+		t.Errorf("ParseTiers returned %v", tiers)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -49,6 +50,107 @@ func BackupNameToTime(backupName string) (time.Time, error) {
 	return iDate, nil
 }
 
+// BackupAge returns the age at now of a backup whose time was returned by BackupNameToTime.
+// Backup names hold the local wall clock time without a timezone and are parsed as UTC, so
+// now is converted the same way before comparing.
+func BackupAge(backupTime time.Time, now time.Time) time.Duration {
+	wallClockNow, _ := time.Parse(BackupFolderTimeFormat, now.Format(BackupFolderTimeFormat))
+
+	return wallClockNow.Sub(backupTime)
+}
+
+// FormatAge formats a duration as a short, human-readable age such as "3d 4h" or "12m"
+func FormatAge(age time.Duration) string {
+	if age < time.Minute {
+		return "<1m"
+	}
+
+	days := int(age / (24 * time.Hour))
+	hours := int(age % (24 * time.Hour) / time.Hour)
+	minutes := int(age % time.Hour / time.Minute)
+
+	if days > 0 {
+		return fmt.Sprintf("%dd %dh", days, hours)
+	} else if hours > 0 {
+		return fmt.Sprintf("%dh %dm", hours, minutes)
+	}
+
+	return fmt.Sprintf("%dm", minutes)
+}
+
+// FormatBytes formats a byte count using binary units, e.g. "1.5 GiB"
+func FormatBytes(bytes uint64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%d B", bytes)
+	}
+
+	div, exp := uint64(unit), 0
+	for n := bytes / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(bytes)/float64(div), "KMGTPE"[exp])
+}
+
+// ParseDuration parses a duration such as "90m", "6h", "14d", "2w" or "3y". Besides the units
+// understood by time.ParseDuration, d (days), w (weeks) and y (365 days) are supported as
+// single units. Negative durations are rejected.
+func ParseDuration(value string) (time.Duration, error) {
+	value = strings.TrimSpace(value)
+
+	units := map[string]time.Duration{
+		"d": 24 * time.Hour,
+		"w": 7 * 24 * time.Hour,
+		"y": 365 * 24 * time.Hour,
+	}
+	for suffix, unit := range units {
+		if strings.HasSuffix(value, suffix) {
+			n, err := strconv.ParseUint(strings.TrimSuffix(value, suffix), 10, 32)
+			if err != nil {
+				return 0, fmt.Errorf("invalid duration %q", value)
+			}
+			return time.Duration(n) * unit, nil
+		}
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q", value)
+	}
+	if duration < 0 {
+		return 0, fmt.Errorf("invalid duration %q: must not be negative", value)
+	}
+
+	return duration, nil
+}
+
+// FormatDuration formats a duration in the largest of the units understood by ParseDuration
+// that represents it exactly, e.g. "14d" or "90m"
+func FormatDuration(duration time.Duration) string {
+	switch {
+	case duration == 0:
+		return "0s"
+	case duration%(365*24*time.Hour) == 0:
+		return fmt.Sprintf("%dy", duration/(365*24*time.Hour))
+	case duration%(7*24*time.Hour) == 0:
+		return fmt.Sprintf("%dw", duration/(7*24*time.Hour))
+	case duration%(24*time.Hour) == 0:
+		return fmt.Sprintf("%dd", duration/(24*time.Hour))
+	case duration%time.Hour == 0:
+		return fmt.Sprintf("%dh", duration/time.Hour)
+	}
+
+	// e.g. "13h30m0s" -> "13h30m"
+	formatted := duration.String()
+	if strings.HasSuffix(formatted, "m0s") {
+		formatted = strings.TrimSuffix(formatted, "0s")
+	}
+
+	return formatted
+}
+
 // NormalizeFolderPath ensures a folder path is well-formed and ends with a slash
 func NormalizeFolderPath(dirtyPath string) string {
 	path := filepath.Clean(dirtyPath)
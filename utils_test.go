@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseDuration(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected time.Duration
+		err      bool
+	}{
+		{"90m", 90 * time.Minute, false},
+		{"1h30m", 90 * time.Minute, false},
+		{" 6h ", 6 * time.Hour, false},
+		{"14d", 14 * 24 * time.Hour, false},
+		{"2w", 14 * 24 * time.Hour, false},
+		{"3y", 3 * 365 * 24 * time.Hour, false},
+		{"0", 0, false},
+		{"-1h", 0, true},
+		{"-1d", 0, true},
+		{"1.5d", 0, true},
+		{"d", 0, true},
+		{"", 0, true},
+		{"soon", 0, true},
+	}
+
+	for _, test := range tests {
+		duration, err := ParseDuration(test.value)
+		if test.err {
+			if err == nil {
+				t.Errorf("ParseDuration(%q) = %s, expected an error", test.value, duration)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseDuration(%q): unexpected error: %v", test.value, err)
+		} else if duration != test.expected {
+			t.Errorf("ParseDuration(%q) = %s, expected %s", test.value, duration, test.expected)
+		}
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	neturl "net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// webhookPayloadVersion is the version of the format of webhook payloads
+const webhookPayloadVersion = 1
+
+// webhookSignatureHeader is the header carrying the HMAC-SHA256 signature of the timestamp
+// and the body, if a webhook secret is set, see SignWebhookBody
+const webhookSignatureHeader = "X-RRB-Signature"
+
+// webhookTimestampHeader is the header carrying the time of the call in Unix seconds, which
+// is signed along with the body so receivers can reject replayed calls
+const webhookTimestampHeader = "X-RRB-Timestamp"
+
+// webhookSecretEnv is the environment variable the webhook secret is taken from if neither
+// --webhook-secret nor --webhook-secret-file is set
+const webhookSecretEnv = "RRB_WEBHOOK_SECRET"
+
+// webhookLogExcerptLines is the number of lines at the end of the log included in payloads
+const webhookLogExcerptLines = 50
+
+// webhookRetryDelay is the delay before the first retry of a failed webhook call; it doubles
+// with every further retry
+const webhookRetryDelay = time.Second
+
+// WebhookOptions is the options struct for webhook-related options
+type WebhookOptions struct {
+	urls    []string
+	headers http.Header
+	secret  string
+	timeout time.Duration
+	retries uint
+}
+
+// ValidateWebhookURLs returns an error if any of urls is not an http or https URL
+func ValidateWebhookURLs(urls []string) error {
+	for _, url := range urls {
+		parsed, err := neturl.Parse(url)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return fmt.Errorf("invalid webhook URL %s: expected http(s)://host/...", webhookDescription(url))
+		}
+	}
+
+	return nil
+}
+
+// ReadWebhookSecret returns the webhook secret: secret if set, otherwise the contents of
+// secretFile (without surrounding whitespace) if set, otherwise the value of webhookSecretEnv.
+// Setting both secret and secretFile is an error.
+func ReadWebhookSecret(secret string, secretFile string) (string, error) {
+	if secret != "" && secretFile != "" {
+		return "", fmt.Errorf("only one of --webhook-secret and --webhook-secret-file may be set")
+	}
+	if secret != "" {
+		return secret, nil
+	}
+	if secretFile != "" {
+		data, err := ioutil.ReadFile(secretFile)
+		if err != nil {
+			return "", fmt.Errorf("could not read webhook secret: %v", err)
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+
+	return os.Getenv(webhookSecretEnv), nil
+}
+
+// ParseWebhookHeaders parses header definitions of the form "Name: value"
+func ParseWebhookHeaders(definitions []string) (http.Header, error) {
+	headers := http.Header{}
+
+	for _, definition := range definitions {
+		parts := strings.SplitN(definition, ":", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("invalid header %q: expected \"Name: value\"", definition)
+		}
+		headers.Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	}
+
+	return headers, nil
+}
+
+// WebhookTarget is the outcome of a run for one target in webhook payloads
+type WebhookTarget struct {
+	Name   string      `json:"name"`
+	Result string      `json:"result"`
+	Err    string      `json:"error,omitempty"`
+	Stats  *RsyncStats `json:"stats"`
+}
+
+// WebhookPayload is the JSON document posted to webhooks after each run
+type WebhookPayload struct {
+	Version    int             `json:"version"`
+	RunID      string          `json:"runId"`
+	Profile    string          `json:"profile"`
+	Status     string          `json:"status"`
+	LogLevel   string          `json:"logLevel"`
+	Err        string          `json:"error,omitempty"`
+	BackupName string          `json:"backupName"`
+	Started    time.Time       `json:"started"`
+	Finished   time.Time       `json:"finished"`
+	Targets    []WebhookTarget `json:"targets"`
+	// LogExcerpt are the last lines of the log
+	LogExcerpt []string `json:"logExcerpt"`
+}
+
+// NewWebhookPayload returns the webhook payload for the run that just ended
+func NewWebhookPayload(options *Options) *WebhookPayload {
+	payload := &WebhookPayload{
+		Version:    webhookPayloadVersion,
+		RunID:      options.runID,
+		Profile:    options.profileName,
+		Status:     runResult(options),
+		LogLevel:   options.ReportLogLevel(),
+		Err:        options.hookState.err,
+		BackupName: options.hookState.backupName,
+		Started:    options.runStarted,
+		Finished:   time.Now(),
+		Targets:    []WebhookTarget{},
+	}
+
+	for _, status := range options.targetStatuses {
+		payload.Targets = append(payload.Targets, WebhookTarget{
+			Name:   status.Name,
+			Result: status.Result,
+			Err:    status.Err,
+			Stats:  status.Stats,
+		})
+	}
+
+	lines := strings.Split(strings.TrimRight(options.log.String(), "\n"), "\n")
+	if len(lines) > webhookLogExcerptLines {
+		lines = lines[len(lines)-webhookLogExcerptLines:]
+	}
+	payload.LogExcerpt = lines
+
+	return payload
+}
+
+// SignWebhookBody returns the value of webhookSignatureHeader for a call at timestamp (the
+// value of webhookTimestampHeader) with body: "sha256=" followed by the hex-encoded
+// HMAC-SHA256 of the timestamp, a dot and the body using secret
+func SignWebhookBody(timestamp string, body []byte, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookDescription returns the host of url for log messages; the rest of webhook URLs often
+// contains secrets
+func webhookDescription(url string) string {
+	parsed, err := neturl.Parse(url)
+	if err != nil || parsed.Host == "" {
+		return "(invalid URL)"
+	}
+
+	return parsed.Host
+}
+
+// postWebhook posts body to url once. The returned bool is true if the call may succeed when
+// retried.
+func postWebhook(options *Options, client *http.Client, url string, body []byte) (bool, error) {
+	request, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+
+	for name, values := range options.WebhookOptions.headers {
+		for _, value := range values {
+			request.Header.Add(name, value)
+		}
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "rotating-rsync-backup/"+appVersion)
+	if options.WebhookOptions.secret != "" {
+		// Set for every attempt, so retries are not rejected as replays
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		request.Header.Set(webhookTimestampHeader, timestamp)
+		request.Header.Set(webhookSignatureHeader, SignWebhookBody(timestamp, body, options.WebhookOptions.secret))
+	}
+
+	response, err := client.Do(request)
+	if urlErr, ok := err.(*neturl.Error); ok {
+		// Without the URL
+		return true, urlErr.Err
+	} else if err != nil {
+		return true, err
+	}
+	defer response.Body.Close()
+	io.Copy(ioutil.Discard, response.Body)
+
+	if response.StatusCode >= 200 && response.StatusCode < 300 {
+		return false, nil
+	}
+
+	retry := response.StatusCode >= 500 || response.StatusCode == http.StatusTooManyRequests
+	return retry, fmt.Errorf("server responded with %s", response.Status)
+}
+
+// SendWebhooks posts the webhook payload of the run that just ended to all configured webhook
+// URLs. Failed calls are retried with increasing delays; webhooks that still fail are logged
+// as errors, without affecting the others. Problems are logged to a child logger, so they
+// show in the report mail without raising the level reported for the run itself.
+func SendWebhooks(options *Options) {
+	if len(options.WebhookOptions.urls) == 0 {
+		return
+	}
+
+	webhookLog := options.log.Child("webhook")
+
+	body, err := json.Marshal(NewWebhookPayload(options))
+	if err != nil {
+		webhookLog.Error.Printf("Could not encode webhook payload: %v", err)
+		return
+	}
+
+	client := &http.Client{Timeout: options.WebhookOptions.timeout}
+
+	for _, url := range options.WebhookOptions.urls {
+		description := webhookDescription(url)
+		webhookLog.Info.Printf("Calling webhook on %s", description)
+
+		delay := webhookRetryDelay
+		for attempt := uint(0); ; attempt++ {
+			retry, err := postWebhook(options, client, url, body)
+			if err == nil {
+				break
+			}
+
+			if !retry || attempt == options.WebhookOptions.retries {
+				webhookLog.Error.Printf("Webhook on %s failed: %v", description, err)
+				break
+			}
+
+			webhookLog.Warn.Printf("Webhook on %s failed, retrying in %s: %v", description, delay, err)
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestParseWebhookHeaders(t *testing.T) {
+	tests := []struct {
+		definitions []string
+		expected    http.Header
+		err         bool
+	}{
+		{[]string{}, http.Header{}, false},
+		{[]string{"Authorization: Bearer abc"}, http.Header{"Authorization": {"Bearer abc"}}, false},
+		{[]string{"x-token:abc:def"}, http.Header{"X-Token": {"abc:def"}}, false},
+		{[]string{"X-A: 1", "X-A: 2"}, http.Header{"X-A": {"1", "2"}}, false},
+		{[]string{"X-Empty:"}, http.Header{"X-Empty": {""}}, false},
+		{[]string{"Authorization"}, nil, true},
+		{[]string{": value"}, nil, true},
+	}
+
+	for _, test := range tests {
+		headers, err := ParseWebhookHeaders(test.definitions)
+		if test.err {
+			if err == nil {
+				t.Errorf("ParseWebhookHeaders(%q) = %v, expected an error", test.definitions, headers)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseWebhookHeaders(%q): unexpected error: %v", test.definitions, err)
+		} else if !reflect.DeepEqual(headers, test.expected) {
+			t.Errorf("ParseWebhookHeaders(%q) = %v, expected %v", test.definitions, headers, test.expected)
+		}
+	}
+}
+
+func TestSignWebhookBody(t *testing.T) {
+	// printf '1700000000.{}' | openssl dgst -sha256 -hmac secret
+	expected := "sha256=b8569b78799ff9e3cbff0fc2d63a33a2b57f3282abd07c37ae5e8e7d79a5f163"
+
+	if signature := SignWebhookBody("1700000000", []byte("{}"), "secret"); signature != expected {
+		t.Errorf("SignWebhookBody returned %q, expected %q", signature, expected)
+	}
+	if SignWebhookBody("1700000001", []byte("{}"), "secret") == expected {
+		t.Errorf("signature does not depend on the timestamp")
+	}
+}